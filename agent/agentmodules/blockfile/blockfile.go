@@ -0,0 +1,280 @@
+package blockfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/hyperledger/fabric-protos-go/common"
+)
+
+// Prefix of the block files in the chain directory of a channel (e.g. ledgersData/chains/chains/mychannel/blockfile_000000)
+const blockfilePrefix = "blockfile_"
+
+// Reads the blocks of a channel from the block files of a peer ledger, without a running peer.
+// Every block is stored as a varint length prefix followed by the block serialized in the format of Fabric's blkstorage.
+// The files are read sequentially through a buffer, so the block files (up to 64 MB each) are never loaded into memory at once.
+type Reader struct {
+	files     []string
+	fileIndex int
+	file      *os.File
+	fileSize  int64
+	reader    *bufio.Reader
+	done      bool
+}
+
+// Creates a reader for the chain directory of a channel.
+func NewReader(channelDir string) (*Reader, error) {
+	files, err := listBlockfiles(channelDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("No block files found in " + channelDir)
+	}
+	return &Reader{files: files, fileIndex: -1}, nil
+}
+
+// Returns the next block, or io.EOF after the last block. A partially written block at the end of the last file
+// (e.g. the copy was taken while the peer was writing) is treated as the end of the ledger.
+func (r *Reader) Next() (*common.Block, error) {
+	blockBytes, err := r.nextRecord(false)
+	if err != nil {
+		return nil, err
+	}
+	return DeserializeBlock(blockBytes)
+}
+
+// Skips the next block without reading or decoding it (only its length prefix is read), or returns io.EOF after the last block.
+func (r *Reader) Skip() error {
+	_, err := r.nextRecord(true)
+	return err
+}
+
+// Closes the block file being read. Next returns io.EOF afterwards.
+func (r *Reader) Close() error {
+	r.done = true
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file, r.reader = nil, nil
+	return err
+}
+
+// Reads (or skips) the next length-prefixed record, opening the next block file when the current one is finished.
+func (r *Reader) nextRecord(skip bool) ([]byte, error) {
+	for !r.done {
+		if r.reader == nil {
+			if r.fileIndex+1 >= len(r.files) {
+				r.done = true
+				break
+			}
+			r.fileIndex++
+			file, err := os.Open(r.files[r.fileIndex])
+			if err != nil {
+				return nil, err
+			}
+			info, err := file.Stat()
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			r.file, r.fileSize, r.reader = file, info.Size(), bufio.NewReader(file)
+		}
+
+		length, err := binary.ReadUvarint(r.reader)
+		if err == io.EOF {
+			// End of the file at a record boundary
+			err = r.file.Close()
+			r.file, r.reader = nil, nil
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var record []byte
+		if err == nil && length > uint64(r.fileSize) {
+			// The length cannot be right, the rest of the file is not a complete record
+			err = io.ErrUnexpectedEOF
+		} else if err == nil && skip {
+			err = r.skipBytes(length)
+		} else if err == nil {
+			record = make([]byte, length)
+			_, err = io.ReadFull(r.reader, record)
+		}
+		if err == io.ErrUnexpectedEOF && r.fileIndex == len(r.files)-1 {
+			// Skipping the partial block, the following calls return io.EOF as well
+			r.Close()
+			break
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error reading block from %s: %s", r.files[r.fileIndex], err.Error()))
+		}
+		return record, nil
+	}
+	return nil, io.EOF
+}
+
+// Skips length bytes of the current file, seeking over the part that is not buffered yet.
+func (r *Reader) skipBytes(length uint64) error {
+	buffered := uint64(r.reader.Buffered())
+	if length <= buffered {
+		_, err := r.reader.Discard(int(length))
+		return err
+	}
+	r.reader.Discard(int(buffered))
+	offset, err := r.file.Seek(int64(length-buffered), io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if offset > r.fileSize {
+		return io.ErrUnexpectedEOF
+	}
+	r.reader.Reset(r.file)
+	return nil
+}
+
+// Decodes a block serialized in the format of Fabric's blkstorage: the header (number, data hash, previous hash),
+// the number of transactions followed by the transactions, then the number of metadata entries followed by the entries.
+func DeserializeBlock(serializedBlock []byte) (*common.Block, error) {
+	block := &common.Block{
+		Header:   &common.BlockHeader{},
+		Data:     &common.BlockData{},
+		Metadata: &common.BlockMetadata{},
+	}
+	b := &buffer{data: serializedBlock}
+	var err error
+
+	if block.Header.Number, err = b.decodeVarint(); err != nil {
+		return nil, errors.New("Error decoding block number: " + err.Error())
+	}
+	if block.Header.DataHash, err = b.decodeRawBytes(); err != nil {
+		return nil, errors.New("Error decoding data hash: " + err.Error())
+	}
+	if block.Header.PreviousHash, err = b.decodeRawBytes(); err != nil {
+		return nil, errors.New("Error decoding previous hash: " + err.Error())
+	}
+	if len(block.Header.PreviousHash) == 0 {
+		block.Header.PreviousHash = nil
+	}
+
+	txCount, err := b.decodeVarint()
+	if err != nil {
+		return nil, errors.New("Error decoding transaction count: " + err.Error())
+	}
+	for i := uint64(0); i < txCount; i++ {
+		txEnvelope, err := b.decodeRawBytes()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error decoding transaction %d: %s", i, err.Error()))
+		}
+		block.Data.Data = append(block.Data.Data, txEnvelope)
+	}
+
+	metadataCount, err := b.decodeVarint()
+	if err != nil {
+		return nil, errors.New("Error decoding metadata count: " + err.Error())
+	}
+	for i := uint64(0); i < metadataCount; i++ {
+		metadata, err := b.decodeRawBytes()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error decoding metadata %d: %s", i, err.Error()))
+		}
+		block.Metadata.Metadata = append(block.Metadata.Metadata, metadata)
+	}
+	return block, nil
+}
+
+// Cursor over serialized data consisting of varints and length-prefixed byte slices
+type buffer struct {
+	data   []byte
+	offset int
+}
+
+func (b *buffer) remaining() int {
+	return len(b.data) - b.offset
+}
+
+func (b *buffer) decodeVarint() (uint64, error) {
+	value, n := proto.DecodeVarint(b.data[b.offset:])
+	if n == 0 {
+		return 0, errors.New("unexpected end of data while decoding varint")
+	}
+	b.offset += n
+	return value, nil
+}
+
+func (b *buffer) decodeRawBytes() ([]byte, error) {
+	length, err := b.decodeVarint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(b.remaining()) {
+		return nil, errors.New(fmt.Sprintf("unexpected end of data, %d bytes expected but only %d left", length, b.remaining()))
+	}
+	value := b.data[b.offset : b.offset+int(length)]
+	b.offset += int(length)
+	return value, nil
+}
+
+// Returns the chain directories of the channels under the given directory, keyed by channel ID.
+// The directory is either the chain directory of one channel or the directory of all chains (ledgersData/chains/chains).
+func ChannelDirs(dir string) (map[string]string, error) {
+	files, err := listBlockfiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		return map[string]string{filepath.Base(filepath.Clean(dir)): dir}, nil
+	}
+
+	channelDirs := map[string]string{}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		files, err := listBlockfiles(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 {
+			channelDirs[entry.Name()] = filepath.Join(dir, entry.Name())
+		}
+	}
+	if len(channelDirs) == 0 {
+		return nil, errors.New("No channel with block files found in " + dir)
+	}
+	return channelDirs, nil
+}
+
+// Returns the block files of a chain directory in order (the numbering of the files is zero-padded).
+func listBlockfiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("Directory " + dir + " does not exist")
+		}
+		return nil, err
+	}
+	files := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), blockfilePrefix) {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
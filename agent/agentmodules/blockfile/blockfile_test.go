@@ -0,0 +1,167 @@
+package blockfile
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric/protoutil"
+)
+
+// Serializes a block in the format of Fabric's blkstorage, with the varint length prefix of the block files
+func serializeBlock(block *common.Block) []byte {
+	b := proto.NewBuffer(nil)
+	b.EncodeVarint(block.Header.Number)
+	b.EncodeRawBytes(block.Header.DataHash)
+	b.EncodeRawBytes(block.Header.PreviousHash)
+	b.EncodeVarint(uint64(len(block.Data.Data)))
+	for _, tx := range block.Data.Data {
+		b.EncodeRawBytes(tx)
+	}
+	b.EncodeVarint(uint64(len(block.Metadata.Metadata)))
+	for _, metadata := range block.Metadata.Metadata {
+		b.EncodeRawBytes(metadata)
+	}
+
+	record := proto.NewBuffer(nil)
+	record.EncodeRawBytes(b.Bytes())
+	return record.Bytes()
+}
+
+func writeBlockfile(t *testing.T, dir string, name string, records ...[]byte) {
+	data := []byte{}
+	for _, record := range records {
+		data = append(data, record...)
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Creates a chain of blocks with one transaction each, linked by their previous hashes
+func newTestChain(blocks int) []*common.Block {
+	chain := []*common.Block{}
+	var previousHash []byte
+	for i := 0; i < blocks; i++ {
+		envelope := protoutil.MarshalOrPanic(&common.Envelope{Payload: []byte(fmt.Sprintf("transaction %d", i))})
+		block := protoutil.NewBlock(uint64(i), previousHash)
+		block.Data.Data = [][]byte{envelope}
+		block.Header.DataHash = protoutil.BlockDataHash(block.Data)
+		block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = []byte{0}
+		previousHash = protoutil.BlockHeaderHash(block.Header)
+		chain = append(chain, block)
+	}
+	return chain
+}
+
+func TestReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	chain := newTestChain(4)
+	lastRecord := serializeBlock(chain[3])
+	writeBlockfile(t, dir, "blockfile_000000", serializeBlock(chain[0]), serializeBlock(chain[1]))
+	// The copy of the ledger was taken while the peer was writing the last block
+	writeBlockfile(t, dir, "blockfile_000001", serializeBlock(chain[2]), lastRecord[:len(lastRecord)/2])
+
+	reader, err := NewReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range chain[:3] {
+		block, err := reader.Next()
+		if err != nil {
+			t.Fatalf("block %d: %s", expected.Header.Number, err)
+		}
+		if !proto.Equal(block, expected) {
+			t.Errorf("block %d is not read back as it was written", expected.Header.Number)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("%v instead of io.EOF for the truncated last block", err)
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("%v instead of io.EOF after the last block", err)
+	}
+
+	// Skipping counts the same blocks without decoding them
+	reader, err = NewReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	skipped := 0
+	for reader.Skip() == nil {
+		skipped++
+	}
+	if skipped != 3 {
+		t.Errorf("%d blocks skipped instead of 3", skipped)
+	}
+}
+
+func TestReaderTruncatedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only a partially written block at the end of the last file is the end of the ledger
+	chain := newTestChain(2)
+	record := serializeBlock(chain[0])
+	writeBlockfile(t, dir, "blockfile_000000", record[:len(record)-1])
+	writeBlockfile(t, dir, "blockfile_000001", serializeBlock(chain[1]))
+
+	reader, err := NewReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Next(); err == nil || err == io.EOF {
+		t.Errorf("%v instead of an error for a truncated block in the first file", err)
+	}
+}
+
+func TestChannelDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	record := serializeBlock(newTestChain(1)[0])
+	for _, channel := range []string{"mychannel", "otherchannel"} {
+		err = os.Mkdir(filepath.Join(dir, channel), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeBlockfile(t, filepath.Join(dir, channel), "blockfile_000000", record)
+	}
+	err = os.Mkdir(filepath.Join(dir, "empty"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channelDirs, err := ChannelDirs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channelDirs) != 2 || channelDirs["mychannel"] != filepath.Join(dir, "mychannel") || channelDirs["otherchannel"] == "" {
+		t.Errorf("unexpected channel directories %v", channelDirs)
+	}
+	channelDirs, err = ChannelDirs(filepath.Join(dir, "mychannel"))
+	if err != nil || len(channelDirs) != 1 || channelDirs["mychannel"] == "" {
+		t.Errorf("unexpected channel directories %v (error: %v)", channelDirs, err)
+	}
+	if _, err := ChannelDirs(filepath.Join(dir, "empty")); err == nil {
+		t.Error("no error for a directory without block files")
+	}
+}
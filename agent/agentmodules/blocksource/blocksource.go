@@ -0,0 +1,342 @@
+package blocksource
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
+	"github.com/hyperledger/fabric/protoutil"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/blockfile"
+)
+
+// Extension of the files written by peer channel fetch and configtxlator
+const blockExtension = ".block"
+
+// Path that selects the standard input instead of a directory
+const Stdin = "-"
+
+// The blocks of one channel, regardless of where they are read from.
+type BlockSource interface {
+	// Gets the ID of the channel the blocks belong to.
+	ChannelID() string
+	// Gets the number of the first block available from the source.
+	First() (uint64, error)
+	// Gets the number of the block following the last available block.
+	Height() (uint64, error)
+	// Gets the block with the given number.
+	Block(number uint64) (*common.Block, error)
+}
+
+// Blocks queried from the ledger of the connected peer.
+type LedgerSource struct {
+	channelId    string
+	ledgerClient *ledger.Client
+}
+
+// Creates a block source for the ledger client of a channel.
+func NewLedgerSource(channelId string, ledgerClient *ledger.Client) *LedgerSource {
+	return &LedgerSource{channelId: channelId, ledgerClient: ledgerClient}
+}
+
+func (s *LedgerSource) ChannelID() string {
+	return s.channelId
+}
+
+func (s *LedgerSource) First() (uint64, error) {
+	return 0, nil
+}
+
+func (s *LedgerSource) Height() (uint64, error) {
+	infoResponse, err := s.ledgerClient.QueryInfo()
+	if err != nil {
+		return 0, err
+	}
+	return infoResponse.BCI.Height, nil
+}
+
+func (s *LedgerSource) Block(number uint64) (*common.Block, error) {
+	return s.ledgerClient.QueryBlock(number)
+}
+
+// Gets the ledger client behind a block source, for the queries that are only possible with a running peer.
+// Returns nil if the blocks are not read from a running peer.
+func LedgerClientOf(source BlockSource) *ledger.Client {
+	if ledgerSource, ok := source.(*LedgerSource); ok {
+		return ledgerSource.ledgerClient
+	}
+	return nil
+}
+
+// Returns true if the blocks of the source are read one after another, so they should be requested in order
+// from a single goroutine. The blocks of the other sources can be requested concurrently.
+func IsSequential(source BlockSource) bool {
+	_, ok := source.(*BlockfileSource)
+	return ok
+}
+
+// Blocks held in memory, e.g. blocks read from .block files or from the standard input.
+type MemorySource struct {
+	channelId string
+	blocks    map[uint64]*common.Block
+	first     uint64
+	height    uint64
+}
+
+// Creates a block source from blocks of the same channel. The blocks do not have to be ordered,
+// but there must not be any gap between them.
+func NewMemorySource(blocks ...*common.Block) (*MemorySource, error) {
+	if len(blocks) == 0 {
+		return nil, errors.New("No blocks given")
+	}
+	s := &MemorySource{blocks: map[uint64]*common.Block{}}
+	for _, block := range blocks {
+		channelId, err := GetChannelId(block)
+		if err != nil {
+			return nil, err
+		}
+		if s.channelId == "" {
+			s.channelId = channelId
+			s.first = block.Header.Number
+		}
+		if channelId != s.channelId {
+			return nil, errors.New(fmt.Sprintf("Block %d belongs to channel %s instead of %s", block.Header.Number, channelId, s.channelId))
+		}
+		if block.Header.Number < s.first {
+			s.first = block.Header.Number
+		}
+		if block.Header.Number+1 > s.height {
+			s.height = block.Header.Number + 1
+		}
+		s.blocks[block.Header.Number] = block
+	}
+	if uint64(len(s.blocks)) != s.height-s.first {
+		return nil, errors.New(fmt.Sprintf("Blocks of channel %s are missing between block %d and %d", s.channelId, s.first, s.height-1))
+	}
+	return s, nil
+}
+
+func (s *MemorySource) ChannelID() string {
+	return s.channelId
+}
+
+func (s *MemorySource) First() (uint64, error) {
+	return s.first, nil
+}
+
+func (s *MemorySource) Height() (uint64, error) {
+	return s.height, nil
+}
+
+func (s *MemorySource) Block(number uint64) (*common.Block, error) {
+	block, ok := s.blocks[number]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Block %d of channel %s is not available", number, s.channelId))
+	}
+	return block, nil
+}
+
+// Creates a block source for every channel found in a directory of .block files (the output of peer channel fetch or configtxlator),
+// or for the single block read from the standard input if the path is "-".
+func Open(path string) ([]BlockSource, error) {
+	if path == Stdin {
+		source, err := NewReaderSource(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		return []BlockSource{source}, nil
+	}
+	return NewDirectorySources(path)
+}
+
+// Creates a block source from one protobuf encoded block read from r.
+func NewReaderSource(r io.Reader) (*MemorySource, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	block, err := UnmarshalBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewMemorySource(block)
+}
+
+// Creates a block source for every channel found in a directory of .block files, ordered by channel ID.
+func NewDirectorySources(dir string) ([]BlockSource, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	blocksByChannel := map[string][]*common.Block{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), blockExtension) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		block, err := UnmarshalBlock(data)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error reading %s: %s", entry.Name(), err.Error()))
+		}
+		channelId, err := GetChannelId(block)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error reading %s: %s", entry.Name(), err.Error()))
+		}
+		blocksByChannel[channelId] = append(blocksByChannel[channelId], block)
+	}
+	if len(blocksByChannel) == 0 {
+		return nil, errors.New("No block files found in " + dir)
+	}
+
+	channelIds := []string{}
+	for channelId := range blocksByChannel {
+		channelIds = append(channelIds, channelId)
+	}
+	sort.Strings(channelIds)
+
+	sources := []BlockSource{}
+	for _, channelId := range channelIds {
+		source, err := NewMemorySource(blocksByChannel[channelId]...)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// Decodes a block encoded as a common.Block protobuf message.
+func UnmarshalBlock(data []byte) (*common.Block, error) {
+	block := &common.Block{}
+	err := proto.Unmarshal(data, block)
+	if err != nil {
+		return nil, err
+	}
+	if block.Header == nil || block.Data == nil || len(block.Data.Data) == 0 {
+		return nil, errors.New("Data is not a block")
+	}
+	return block, nil
+}
+
+// Gets the channel ID from the header of the first transaction of a block.
+func GetChannelId(block *common.Block) (string, error) {
+	env, err := protoutil.GetEnvelopeFromBlock(block.Data.Data[0])
+	if err != nil {
+		return "", err
+	}
+	channelHeader, err := protoutil.ChannelHeader(env)
+	if err != nil {
+		return "", err
+	}
+	return channelHeader.ChannelId, nil
+}
+
+// Blocks read from the block files of a peer ledger. The blocks are read sequentially, so they should be requested in order.
+type BlockfileSource struct {
+	channelId  string
+	channelDir string
+	reader     *blockfile.Reader
+	next       uint64
+	height     *uint64
+}
+
+// Creates a block source for every channel found under the chain directory of a peer ledger, ordered by channel ID.
+func NewBlockfileSources(path string) ([]BlockSource, error) {
+	channelDirs, err := blockfile.ChannelDirs(path)
+	if err != nil {
+		return nil, err
+	}
+	channelIds := []string{}
+	for channelId := range channelDirs {
+		channelIds = append(channelIds, channelId)
+	}
+	sort.Strings(channelIds)
+
+	sources := []BlockSource{}
+	for _, channelId := range channelIds {
+		sources = append(sources, &BlockfileSource{channelId: channelId, channelDir: channelDirs[channelId]})
+	}
+	return sources, nil
+}
+
+func (s *BlockfileSource) ChannelID() string {
+	return s.channelId
+}
+
+func (s *BlockfileSource) First() (uint64, error) {
+	return 0, nil
+}
+
+// The block files are a copy of the ledger, so they are only counted once. Only the length prefixes of the blocks are read.
+func (s *BlockfileSource) Height() (uint64, error) {
+	if s.height == nil {
+		reader, err := blockfile.NewReader(s.channelDir)
+		if err != nil {
+			return 0, err
+		}
+		defer reader.Close()
+		var height uint64
+		for {
+			err := reader.Skip()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+			height++
+		}
+		s.height = &height
+	}
+	return *s.height, nil
+}
+
+// The block files hold the blocks of the channel in order from block 0, the blocks before the requested one are skipped without decoding them.
+func (s *BlockfileSource) Block(number uint64) (*common.Block, error) {
+	// Starting over if an earlier block is requested
+	if s.reader == nil || number < s.next {
+		if s.reader != nil {
+			s.reader.Close()
+		}
+		reader, err := blockfile.NewReader(s.channelDir)
+		if err != nil {
+			return nil, err
+		}
+		s.reader = reader
+		s.next = 0
+	}
+	for s.next < number {
+		err := s.reader.Skip()
+		if err == io.EOF {
+			return nil, errors.New(fmt.Sprintf("Block %d of channel %s is not available in the block files", number, s.channelId))
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.next++
+	}
+	block, err := s.reader.Next()
+	if err == io.EOF {
+		return nil, errors.New(fmt.Sprintf("Block %d of channel %s is not available in the block files", number, s.channelId))
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.next++
+	if block.Header.Number != number {
+		return nil, errors.New(fmt.Sprintf("Block %d of channel %s found at the position of block %d in the block files", block.Header.Number, s.channelId, number))
+	}
+	return block, nil
+}
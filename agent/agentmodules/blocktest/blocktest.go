@@ -0,0 +1,209 @@
+// Builds the blocks of a channel in code, so that the parsing of the blocks can be tested without a Fabric network.
+// The blocks are structurally complete (headers, data hashes, validation flags, last config index),
+// but the signatures and certificates are placeholders.
+package blocktest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
+	"github.com/hyperledger/fabric/protoutil"
+)
+
+// PEM encoded placeholder of the certificate of the creators and endorsers
+const Certificate = "-----BEGIN CERTIFICATE-----\ndGVzdA==\n-----END CERTIFICATE-----\n"
+
+// Timestamp of the transactions that do not set one
+var Timestamp = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Data of an endorser transaction with a single action. Empty fields get default values:
+// the transaction ID is generated from the position of the transaction, the MSP ID is Org1MSP.
+type Tx struct {
+	TxId           string
+	MSPID          string
+	Chaincode      string
+	Version        string
+	Function       string
+	Args           []string
+	Reads          []*kvrwset.KVRead
+	Writes         []*kvrwset.KVWrite
+	MetadataWrites []*kvrwset.KVMetadataWrite
+	Event          *peer.ChaincodeEvent
+	ResponseStatus int32
+	Timestamp      time.Time
+	ValidationCode peer.TxValidationCode
+}
+
+// The blocks of one channel, each block linked to the previous one
+type Chain struct {
+	ChannelId  string
+	Blocks     []*common.Block
+	lastConfig uint64
+}
+
+// Creates a chain without blocks. The first block added is the genesis block.
+func NewChain(channelId string) *Chain {
+	return &Chain{ChannelId: channelId}
+}
+
+// Appends a block containing the given endorser transactions.
+func (c *Chain) AddBlock(txs ...*Tx) *common.Block {
+	blockNumber := uint64(len(c.Blocks))
+	envelopes := [][]byte{}
+	validationCodes := []peer.TxValidationCode{}
+	for txIndex, tx := range txs {
+		envelopes = append(envelopes, EndorserTx(c.ChannelId, blockNumber, txIndex, tx))
+		validationCodes = append(validationCodes, tx.ValidationCode)
+	}
+	return c.addBlock(envelopes, validationCodes)
+}
+
+// Appends a config block with the given channel configuration.
+func (c *Chain) AddConfigBlock(config *common.Config) *common.Block {
+	c.lastConfig = uint64(len(c.Blocks))
+	return c.addBlock([][]byte{ConfigTx(c.ChannelId, config)}, []peer.TxValidationCode{peer.TxValidationCode_VALID})
+}
+
+func (c *Chain) addBlock(envelopes [][]byte, validationCodes []peer.TxValidationCode) *common.Block {
+	var previousHash []byte
+	if len(c.Blocks) > 0 {
+		previousHash = protoutil.BlockHeaderHash(c.Blocks[len(c.Blocks)-1].Header)
+	}
+	block := NewBlock(uint64(len(c.Blocks)), previousHash, c.lastConfig, envelopes, validationCodes)
+	c.Blocks = append(c.Blocks, block)
+	return block
+}
+
+// Creates a block from serialized envelopes, with the TRANSACTIONS_FILTER set to the validation codes
+// and the last config index stored in the SIGNATURES metadata, like the orderers of Fabric 2.0 do.
+func NewBlock(blockNumber uint64, previousHash []byte, lastConfig uint64, envelopes [][]byte, validationCodes []peer.TxValidationCode) *common.Block {
+	data := &common.BlockData{Data: envelopes}
+	metadata := make([][]byte, len(common.BlockMetadataIndex_name))
+	metadata[common.BlockMetadataIndex_SIGNATURES] = protoutil.MarshalOrPanic(&common.Metadata{
+		Value: protoutil.MarshalOrPanic(&common.OrdererBlockMetadata{LastConfig: &common.LastConfig{Index: lastConfig}}),
+	})
+	txsFilter := make([]byte, len(validationCodes))
+	for i, validationCode := range validationCodes {
+		txsFilter[i] = byte(validationCode)
+	}
+	metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = txsFilter
+
+	return &common.Block{
+		Header: &common.BlockHeader{
+			Number:       blockNumber,
+			PreviousHash: previousHash,
+			DataHash:     protoutil.BlockDataHash(data),
+		},
+		Data:     data,
+		Metadata: &common.BlockMetadata{Metadata: metadata},
+	}
+}
+
+// Creates the serialized envelope of an endorser transaction.
+func EndorserTx(channelId string, blockNumber uint64, txIndex int, tx *Tx) []byte {
+	txId := tx.TxId
+	if txId == "" {
+		txId = fmt.Sprintf("tx-%d-%d", blockNumber, txIndex)
+	}
+	creator := Identity(tx.MSPID)
+
+	results, err := (&rwsetutil.TxRwSet{
+		NsRwSets: []*rwsetutil.NsRwSet{
+			{
+				NameSpace: tx.Chaincode,
+				KvRwSet: &kvrwset.KVRWSet{
+					Reads:          tx.Reads,
+					Writes:         tx.Writes,
+					MetadataWrites: tx.MetadataWrites,
+				},
+			},
+		},
+	}).ToProtoBytes()
+	if err != nil {
+		panic(err)
+	}
+	var events []byte
+	if tx.Event != nil {
+		events = protoutil.MarshalOrPanic(tx.Event)
+	}
+	responseStatus := tx.ResponseStatus
+	if responseStatus == 0 {
+		responseStatus = 200
+	}
+	chaincodeId := &peer.ChaincodeID{Name: tx.Chaincode, Version: tx.Version}
+	chaincodeAction := &peer.ChaincodeAction{
+		Results:     results,
+		Events:      events,
+		Response:    &peer.Response{Status: responseStatus},
+		ChaincodeId: chaincodeId,
+	}
+
+	args := [][]byte{[]byte(tx.Function)}
+	for _, arg := range tx.Args {
+		args = append(args, []byte(arg))
+	}
+	invocationSpec := &peer.ChaincodeInvocationSpec{
+		ChaincodeSpec: &peer.ChaincodeSpec{
+			ChaincodeId: chaincodeId,
+			Input:       &peer.ChaincodeInput{Args: args},
+		},
+	}
+
+	actionPayload := &peer.ChaincodeActionPayload{
+		ChaincodeProposalPayload: protoutil.MarshalOrPanic(&peer.ChaincodeProposalPayload{Input: protoutil.MarshalOrPanic(invocationSpec)}),
+		Action: &peer.ChaincodeEndorsedAction{
+			ProposalResponsePayload: protoutil.MarshalOrPanic(&peer.ProposalResponsePayload{
+				ProposalHash: []byte(txId),
+				Extension:    protoutil.MarshalOrPanic(chaincodeAction),
+			}),
+			Endorsements: []*peer.Endorsement{{Endorser: creator, Signature: []byte("signature")}},
+		},
+	}
+	signatureHeader := protoutil.MarshalOrPanic(&common.SignatureHeader{Creator: creator, Nonce: []byte(txId)})
+	transaction := &peer.Transaction{
+		Actions: []*peer.TransactionAction{{Header: signatureHeader, Payload: protoutil.MarshalOrPanic(actionPayload)}},
+	}
+
+	return envelope(common.HeaderType_ENDORSER_TRANSACTION, channelId, txId, tx.Timestamp, signatureHeader, protoutil.MarshalOrPanic(transaction))
+}
+
+// Creates the serialized envelope of a config transaction.
+func ConfigTx(channelId string, config *common.Config) []byte {
+	signatureHeader := protoutil.MarshalOrPanic(&common.SignatureHeader{Creator: Identity("OrdererMSP")})
+	return envelope(common.HeaderType_CONFIG, channelId, "", time.Time{}, signatureHeader, protoutil.MarshalOrPanic(&common.ConfigEnvelope{Config: config}))
+}
+
+// Creates a serialized identity with the placeholder certificate. The MSP ID defaults to Org1MSP.
+func Identity(mspId string) []byte {
+	if mspId == "" {
+		mspId = "Org1MSP"
+	}
+	return protoutil.MarshalOrPanic(&msp.SerializedIdentity{Mspid: mspId, IdBytes: []byte(Certificate)})
+}
+
+func envelope(headerType common.HeaderType, channelId, txId string, createdAt time.Time, signatureHeader, data []byte) []byte {
+	if createdAt.IsZero() {
+		createdAt = Timestamp
+	}
+	channelHeader := &common.ChannelHeader{
+		Type:      int32(headerType),
+		ChannelId: channelId,
+		TxId:      txId,
+		Timestamp: &timestamp.Timestamp{Seconds: createdAt.Unix(), Nanos: int32(createdAt.Nanosecond())},
+	}
+	payload := &common.Payload{
+		Header: &common.Header{
+			ChannelHeader:   protoutil.MarshalOrPanic(channelHeader),
+			SignatureHeader: signatureHeader,
+		},
+		Data: data,
+	}
+	return protoutil.MarshalOrPanic(&common.Envelope{Payload: protoutil.MarshalOrPanic(payload), Signature: []byte("signature")})
+}
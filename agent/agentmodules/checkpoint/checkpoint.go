@@ -0,0 +1,96 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Last processed block of a channel
+type Checkpoint struct {
+	ChannelId   string `json:"channelId"`
+	BlockNumber uint64 `json:"blockNumber"`
+	BlockHash   string `json:"blockHash"`
+}
+
+// Implement this interface to store the checkpoints somewhere else. For example, see FileCheckpointer.
+type Checkpointer interface {
+	// Returns the checkpoint of the channel, or nil if no block of the channel has been processed yet.
+	Load(channelId string) (*Checkpoint, error)
+	// Stores the checkpoint of a channel, replacing the previous one.
+	Save(checkpoint *Checkpoint) error
+}
+
+// This implementation of the Checkpointer interface keeps the checkpoints of every channel in a local json file.
+// The file is replaced atomically on every save, so a crash never leaves a partially written file behind.
+type FileCheckpointer struct {
+	path        string
+	mutex       sync.Mutex
+	checkpoints map[string]*Checkpoint
+}
+
+// Creates a FileCheckpointer, loading the existing checkpoints from the file if it exists.
+func NewFileCheckpointer(path string) (*FileCheckpointer, error) {
+	fc := &FileCheckpointer{
+		path:        path,
+		checkpoints: map[string]*Checkpoint{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &fc.checkpoints)
+	if err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+func (fc *FileCheckpointer) Load(channelId string) (*Checkpoint, error) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	checkpoint, ok := fc.checkpoints[channelId]
+	if !ok {
+		return nil, nil
+	}
+	loaded := *checkpoint
+	return &loaded, nil
+}
+
+func (fc *FileCheckpointer) Save(checkpoint *Checkpoint) error {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	saved := *checkpoint
+	fc.checkpoints[checkpoint.ChannelId] = &saved
+
+	data, err := json.MarshalIndent(fc.checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(fc.path), 0755)
+	if err != nil {
+		return err
+	}
+	// Writing to a temporary file first, then replacing the checkpoint file with it
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fc.path), filepath.Base(fc.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), fc.path)
+}
@@ -0,0 +1,119 @@
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fc, err := NewFileCheckpointer(filepath.Join(dir, "missing", "checkpoints.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err := fc.Load("mychannel")
+	if err != nil || checkpoint != nil {
+		t.Errorf("checkpoint %+v (error: %v) instead of nil for a missing file", checkpoint, err)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data", "checkpoints.json")
+
+	fc, err := NewFileCheckpointer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints := []*Checkpoint{
+		{ChannelId: "mychannel", BlockNumber: 3, BlockHash: "hash-3"},
+		{ChannelId: "otherchannel", BlockNumber: 7, BlockHash: "hash-7"},
+		{ChannelId: "mychannel", BlockNumber: 5, BlockHash: "hash-5"},
+	}
+	for _, checkpoint := range checkpoints {
+		err = fc.Save(checkpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Changing a saved checkpoint does not change the stored one
+	checkpoints[2].BlockNumber = 6
+
+	// The checkpoints are read back from the file by a new checkpointer
+	fc, err = NewFileCheckpointer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		channelId   string
+		blockNumber uint64
+		blockHash   string
+	}{
+		{"mychannel", 5, "hash-5"},
+		{"otherchannel", 7, "hash-7"},
+	}
+	for _, test := range tests {
+		checkpoint, err := fc.Load(test.channelId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkpoint == nil || checkpoint.ChannelId != test.channelId || checkpoint.BlockNumber != test.blockNumber || checkpoint.BlockHash != test.blockHash {
+			t.Errorf("%s: checkpoint %+v instead of block %d with hash %s", test.channelId, checkpoint, test.blockNumber, test.blockHash)
+		}
+	}
+	if checkpoint, _ := fc.Load("thirdchannel"); checkpoint != nil {
+		t.Errorf("checkpoint %+v for a channel that was never saved", checkpoint)
+	}
+}
+
+func TestSaveReplacesFile(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoints.json")
+
+	fc, err := NewFileCheckpointer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for blockNumber := uint64(1); blockNumber <= 3; blockNumber++ {
+		err = fc.Save(&Checkpoint{ChannelId: "mychannel", BlockNumber: blockNumber})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The temporary files are renamed to the checkpoint file, none of them is left behind
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "checkpoints.json" {
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("files %v instead of checkpoints.json", names)
+	}
+
+	// A file that cannot be parsed is an error instead of starting over from the first block
+	err = ioutil.WriteFile(path, []byte(`{"mychannel":`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileCheckpointer(path); err == nil {
+		t.Error("no error for a partially written checkpoint file")
+	}
+}
@@ -0,0 +1,386 @@
+package configutils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/orderer"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric/protoutil"
+)
+
+// Organization (member) of the channel, the orderer or a consortium
+type Organization struct {
+	Name        string   `json:"name"`
+	Group       string   `json:"group"`
+	MSPID       string   `json:"mspId"`
+	AnchorPeers []string `json:"anchorPeers"`
+}
+
+// Batch size parameters of the orderer
+type BatchSize struct {
+	MaxMessageCount   uint32 `json:"maxMessageCount"`
+	AbsoluteMaxBytes  uint32 `json:"absoluteMaxBytes"`
+	PreferredMaxBytes uint32 `json:"preferredMaxBytes"`
+}
+
+// Policy definition of a config group
+type Policy struct {
+	Type      string `json:"type"`
+	Rule      string `json:"rule"`
+	ModPolicy string `json:"modPolicy"`
+}
+
+// Decoded channel configuration. Capabilities are keyed by config group (e.g. Channel/Application),
+// policies by their full path (e.g. Channel/Application/Org1MSP/Admins).
+type ChannelConfig struct {
+	ChannelId        string              `json:"channelId"`
+	Sequence         uint64              `json:"sequence"`
+	Organizations    []*Organization     `json:"organizations"`
+	OrdererAddresses []string            `json:"ordererAddresses"`
+	BatchSize        *BatchSize          `json:"batchSize"`
+	BatchTimeout     string              `json:"batchTimeout"`
+	ConsensusType    string              `json:"consensusType"`
+	Capabilities     map[string][]string `json:"capabilities"`
+	ACLs             map[string]string   `json:"acls"`
+	Policies         map[string]*Policy  `json:"policies"`
+	Signers          []string            `json:"signers"`
+}
+
+// One difference between two channel configurations
+type ConfigChange struct {
+	Path      string `json:"path"`
+	Operation string `json:"operation"`
+	OldValue  string `json:"oldValue"`
+	NewValue  string `json:"newValue"`
+}
+
+// Decodes the channel configuration of a CONFIG or CONFIG_UPDATE transaction.
+// Signers are the MSP IDs of the organizations that signed the config update.
+func ProcessConfigTx(txData []byte) (*ChannelConfig, error) {
+	env, err := protoutil.GetEnvelopeFromBlock(txData)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := protoutil.UnmarshalPayload(env.GetPayload())
+	if err != nil {
+		return nil, err
+	}
+
+	chdr, err := protoutil.UnmarshalChannelHeader(payload.Header.ChannelHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	switch common.HeaderType(chdr.Type) {
+	case common.HeaderType_CONFIG:
+		configEnvelope := &common.ConfigEnvelope{}
+		err = proto.Unmarshal(payload.Data, configEnvelope)
+		if err != nil {
+			return nil, err
+		}
+		if configEnvelope.Config == nil {
+			return nil, errors.New("Config envelope does not contain config")
+		}
+		config := newChannelConfig(chdr.ChannelId, configEnvelope.Config.Sequence)
+		config.decodeGroup("Channel", configEnvelope.Config.ChannelGroup)
+		if configEnvelope.LastUpdate != nil {
+			lastUpdatePayload, err := protoutil.UnmarshalPayload(configEnvelope.LastUpdate.GetPayload())
+			if err != nil {
+				return nil, err
+			}
+			configUpdateEnvelope := &common.ConfigUpdateEnvelope{}
+			err = proto.Unmarshal(lastUpdatePayload.Data, configUpdateEnvelope)
+			if err != nil {
+				return nil, err
+			}
+			config.Signers, err = getSigners(configUpdateEnvelope)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return config, nil
+
+	case common.HeaderType_CONFIG_UPDATE:
+		configUpdateEnvelope := &common.ConfigUpdateEnvelope{}
+		err = proto.Unmarshal(payload.Data, configUpdateEnvelope)
+		if err != nil {
+			return nil, err
+		}
+		configUpdate := &common.ConfigUpdate{}
+		err = proto.Unmarshal(configUpdateEnvelope.ConfigUpdate, configUpdate)
+		if err != nil {
+			return nil, err
+		}
+		// A config update only contains the write set of the modified groups
+		config := newChannelConfig(configUpdate.ChannelId, 0)
+		config.decodeGroup("Channel", configUpdate.WriteSet)
+		config.Signers, err = getSigners(configUpdateEnvelope)
+		if err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Transaction of type %s is not a config transaction", fabricutils.TypeCodeToInfo(chdr.Type)))
+}
+
+// Returns the differences between the previous and the current channel configuration ordered by path.
+// If there is no previous configuration (genesis block), every setting is reported as added.
+func DiffConfig(previous, current *ChannelConfig) []*ConfigChange {
+	previousSettings := map[string]string{}
+	if previous != nil {
+		previousSettings = previous.flatten()
+	}
+	currentSettings := current.flatten()
+
+	changes := []*ConfigChange{}
+	for path, newValue := range currentSettings {
+		oldValue, ok := previousSettings[path]
+		if !ok {
+			changes = append(changes, &ConfigChange{Path: path, Operation: "added", NewValue: newValue})
+		} else if oldValue != newValue {
+			changes = append(changes, &ConfigChange{Path: path, Operation: "modified", OldValue: oldValue, NewValue: newValue})
+		}
+	}
+	for path, oldValue := range previousSettings {
+		if _, ok := currentSettings[path]; !ok {
+			changes = append(changes, &ConfigChange{Path: path, Operation: "removed", OldValue: oldValue})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+func newChannelConfig(channelId string, sequence uint64) *ChannelConfig {
+	return &ChannelConfig{
+		ChannelId:     channelId,
+		Sequence:      sequence,
+		Organizations: []*Organization{},
+		Capabilities:  map[string][]string{},
+		ACLs:          map[string]string{},
+		Policies:      map[string]*Policy{},
+	}
+}
+
+// Decodes the values and policies of a config group, then its subgroups recursively.
+// Groups holding an MSP value are organizations.
+func (config *ChannelConfig) decodeGroup(path string, group *common.ConfigGroup) {
+	if group == nil {
+		return
+	}
+
+	for name, configPolicy := range group.Policies {
+		config.Policies[path+"/"+name] = decodePolicy(configPolicy)
+	}
+
+	if mspValue, ok := group.Values["MSP"]; ok {
+		org := &Organization{
+			Name:        path[strings.LastIndex(path, "/")+1:],
+			Group:       path[:strings.LastIndex(path, "/")],
+			MSPID:       decodeMSPID(mspValue.Value),
+			AnchorPeers: []string{},
+		}
+		if anchorPeersValue, ok := group.Values["AnchorPeers"]; ok {
+			anchorPeers := &peer.AnchorPeers{}
+			if proto.Unmarshal(anchorPeersValue.Value, anchorPeers) == nil {
+				for _, anchorPeer := range anchorPeers.AnchorPeers {
+					org.AnchorPeers = append(org.AnchorPeers, fmt.Sprintf("%s:%d", anchorPeer.Host, anchorPeer.Port))
+				}
+			}
+		}
+		// Since Fabric 1.4.2 the orderer addresses are defined per orderer organization
+		if endpointsValue, ok := group.Values["Endpoints"]; ok {
+			endpoints := &common.OrdererAddresses{}
+			if proto.Unmarshal(endpointsValue.Value, endpoints) == nil {
+				config.OrdererAddresses = append(config.OrdererAddresses, endpoints.Addresses...)
+			}
+		}
+		config.Organizations = append(config.Organizations, org)
+	}
+
+	for name, configValue := range group.Values {
+		switch name {
+		case "OrdererAddresses":
+			addresses := &common.OrdererAddresses{}
+			if proto.Unmarshal(configValue.Value, addresses) == nil {
+				config.OrdererAddresses = append(config.OrdererAddresses, addresses.Addresses...)
+			}
+		case "BatchSize":
+			batchSize := &orderer.BatchSize{}
+			if proto.Unmarshal(configValue.Value, batchSize) == nil {
+				config.BatchSize = &BatchSize{
+					MaxMessageCount:   batchSize.MaxMessageCount,
+					AbsoluteMaxBytes:  batchSize.AbsoluteMaxBytes,
+					PreferredMaxBytes: batchSize.PreferredMaxBytes,
+				}
+			}
+		case "BatchTimeout":
+			batchTimeout := &orderer.BatchTimeout{}
+			if proto.Unmarshal(configValue.Value, batchTimeout) == nil {
+				config.BatchTimeout = batchTimeout.Timeout
+			}
+		case "ConsensusType":
+			consensusType := &orderer.ConsensusType{}
+			if proto.Unmarshal(configValue.Value, consensusType) == nil {
+				config.ConsensusType = consensusType.Type
+			}
+		case "Capabilities":
+			capabilities := &common.Capabilities{}
+			if proto.Unmarshal(configValue.Value, capabilities) == nil {
+				names := []string{}
+				for capability := range capabilities.Capabilities {
+					names = append(names, capability)
+				}
+				sort.Strings(names)
+				config.Capabilities[path] = names
+			}
+		case "ACLs":
+			acls := &peer.ACLs{}
+			if proto.Unmarshal(configValue.Value, acls) == nil {
+				for resource, apiResource := range acls.Acls {
+					config.ACLs[resource] = apiResource.PolicyRef
+				}
+			}
+		}
+	}
+
+	for name, subGroup := range group.Groups {
+		config.decodeGroup(path+"/"+name, subGroup)
+	}
+}
+
+// Returns the MSP ID from a serialized MSP config, or an empty string if it cannot be decoded.
+func decodeMSPID(value []byte) string {
+	mspConfig := &msp.MSPConfig{}
+	if proto.Unmarshal(value, mspConfig) != nil {
+		return ""
+	}
+	fabricMSPConfig := &msp.FabricMSPConfig{}
+	if proto.Unmarshal(mspConfig.Config, fabricMSPConfig) != nil {
+		return ""
+	}
+	return fabricMSPConfig.Name
+}
+
+// Decodes the type and the rule of a policy into a human readable form, e.g. MAJORITY Admins or OutOf(1, 'Org1MSP.member').
+func decodePolicy(configPolicy *common.ConfigPolicy) *Policy {
+	policy := &Policy{ModPolicy: configPolicy.ModPolicy}
+	if configPolicy.Policy == nil {
+		return policy
+	}
+	policy.Type = common.Policy_PolicyType_name[configPolicy.Policy.Type]
+
+	switch common.Policy_PolicyType(configPolicy.Policy.Type) {
+	case common.Policy_IMPLICIT_META:
+		implicitMetaPolicy := &common.ImplicitMetaPolicy{}
+		if proto.Unmarshal(configPolicy.Policy.Value, implicitMetaPolicy) == nil {
+			policy.Rule = fmt.Sprintf("%s %s", implicitMetaPolicy.Rule.String(), implicitMetaPolicy.SubPolicy)
+		}
+	case common.Policy_SIGNATURE:
+		signaturePolicy := &common.SignaturePolicyEnvelope{}
+		if proto.Unmarshal(configPolicy.Policy.Value, signaturePolicy) == nil {
+			policy.Rule = signaturePolicyToString(signaturePolicy.Rule, signaturePolicy.Identities)
+		}
+	}
+	return policy
+}
+
+// Decodes a serialized signature policy envelope (e.g. a key-level endorsement policy) into a human readable form.
+func DecodeSignaturePolicy(value []byte) (string, error) {
+	signaturePolicy := &common.SignaturePolicyEnvelope{}
+	err := proto.Unmarshal(value, signaturePolicy)
+	if err != nil {
+		return "", err
+	}
+	return signaturePolicyToString(signaturePolicy.Rule, signaturePolicy.Identities), nil
+}
+
+func signaturePolicyToString(rule *common.SignaturePolicy, identities []*msp.MSPPrincipal) string {
+	if rule == nil {
+		return ""
+	}
+	switch t := rule.Type.(type) {
+	case *common.SignaturePolicy_SignedBy:
+		if t.SignedBy < 0 || int(t.SignedBy) >= len(identities) {
+			return fmt.Sprintf("'unknown identity %d'", t.SignedBy)
+		}
+		return principalToString(identities[t.SignedBy])
+	case *common.SignaturePolicy_NOutOf_:
+		rules := []string{}
+		for _, subRule := range t.NOutOf.Rules {
+			rules = append(rules, signaturePolicyToString(subRule, identities))
+		}
+		return fmt.Sprintf("OutOf(%d, %s)", t.NOutOf.N, strings.Join(rules, ", "))
+	}
+	return ""
+}
+
+func principalToString(principal *msp.MSPPrincipal) string {
+	if principal.PrincipalClassification == msp.MSPPrincipal_ROLE {
+		role := &msp.MSPRole{}
+		if proto.Unmarshal(principal.Principal, role) == nil {
+			return fmt.Sprintf("'%s.%s'", role.MspIdentifier, strings.ToLower(role.Role.String()))
+		}
+	}
+	return fmt.Sprintf("'%s'", principal.PrincipalClassification.String())
+}
+
+// Returns the MSP IDs of the organizations that signed the config update.
+func getSigners(configUpdateEnvelope *common.ConfigUpdateEnvelope) ([]string, error) {
+	signers := []string{}
+	for _, configSignature := range configUpdateEnvelope.Signatures {
+		shdr, err := protoutil.UnmarshalSignatureHeader(configSignature.SignatureHeader)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, fabricutils.ReturnCreatorOrgString(shdr.Creator))
+	}
+	return signers, nil
+}
+
+// Flattens the configuration into path - value pairs, which makes two configurations comparable.
+func (config *ChannelConfig) flatten() map[string]string {
+	settings := map[string]string{}
+	for _, org := range config.Organizations {
+		orgPath := fmt.Sprintf("organizations/%s/%s", org.Group, org.Name)
+		settings[orgPath+"/mspId"] = org.MSPID
+		anchorPeers := append([]string{}, org.AnchorPeers...)
+		sort.Strings(anchorPeers)
+		settings[orgPath+"/anchorPeers"] = strings.Join(anchorPeers, ",")
+	}
+	ordererAddresses := append([]string{}, config.OrdererAddresses...)
+	sort.Strings(ordererAddresses)
+	settings["ordererAddresses"] = strings.Join(ordererAddresses, ",")
+	if config.BatchSize != nil {
+		settings["batchSize/maxMessageCount"] = fmt.Sprintf("%d", config.BatchSize.MaxMessageCount)
+		settings["batchSize/absoluteMaxBytes"] = fmt.Sprintf("%d", config.BatchSize.AbsoluteMaxBytes)
+		settings["batchSize/preferredMaxBytes"] = fmt.Sprintf("%d", config.BatchSize.PreferredMaxBytes)
+	}
+	if config.BatchTimeout != "" {
+		settings["batchTimeout"] = config.BatchTimeout
+	}
+	if config.ConsensusType != "" {
+		settings["consensusType"] = config.ConsensusType
+	}
+	for group, capabilities := range config.Capabilities {
+		settings["capabilities/"+group] = strings.Join(capabilities, ",")
+	}
+	for resource, policyRef := range config.ACLs {
+		settings["acls/"+resource] = policyRef
+	}
+	for path, policy := range config.Policies {
+		settings["policies/"+path] = fmt.Sprintf("%s %s (mod_policy: %s)", policy.Type, policy.Rule, policy.ModPolicy)
+	}
+	return settings
+}
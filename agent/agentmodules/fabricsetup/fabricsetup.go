@@ -2,22 +2,31 @@ package fabricsetup
 
 import (
 	"io/ioutil"
-
 	"log"
+	"sync"
+
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/event"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/msp"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/resmgmt"
 	providerMSP "github.com/hyperledger/fabric-sdk-go/pkg/common/providers/msp"
 	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fab/events/deliverclient/seek"
 	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
 	"github.com/pkg/errors"
-
+	"google.golang.org/grpc"
 )
 
+// Chaincode settings. Decoder is the name of the value decoder of the writes (defaults to json),
+// ProtoDescriptorSet and ProtoMessage configure the protobuf decoder. The keys are the same in fabricbeat.yml and in the config file of the dumper.
 type Chaincode struct {
-	Name       string   //`chaincode:"name"`
-	Linkingkey string   //`chaincode:"linkingKey"`
-	Values     []string //`chaincode:"values"`
+	Name               string   //`chaincode:"name"`
+	Linkingkey         string   //`chaincode:"linkingKey"`
+	Values             []string //`chaincode:"values"`
+	RedactArgs         []int    `config:"redactArgs" yaml:"redactArgs"`
+	Decoder            string   `config:"decoder" yaml:"decoder"`
+	ProtoDescriptorSet string   `config:"protoDescriptorSet" yaml:"protoDescriptorSet"`
+	ProtoMessage       string   `config:"protoMessage" yaml:"protoMessage"`
 }
 
 // Fabric, Elasticsearch and Kibana specific setup
@@ -42,6 +51,9 @@ type FabricSetup struct {
 	BlockIndexName       string
 	TransactionIndexName string
 	KeyIndexName         string
+	// Connection to the peer for the private data, opened on first use and shared by the channels
+	peerConn     *grpc.ClientConn
+	peerConnLock sync.Mutex
 }
 
 // Initialize reads the configuration file and sets up FabricSetup
@@ -134,7 +146,29 @@ func (setup *FabricSetup) Initialize() error {
 	return nil
 }
 
-// Closes SDK
+// Creates an event client for the given channel which receives full blocks from the Deliver service of the peers,
+// starting with the specified block number.
+func (setup *FabricSetup) NewBlockEventClient(channelId string, startBlock uint64) (*event.Client, error) {
+	if !setup.initialized {
+		return nil, errors.New("SDK not initialized")
+	}
+	channelContext := setup.SDK.ChannelContext(channelId, fabsdk.WithIdentity(setup.AdminIdentity))
+	eventClient, err := event.New(channelContext, event.WithBlockEvents(), event.WithSeekType(seek.FromBlock), event.WithBlockNum(startBlock))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create event client for channel "+channelId)
+	}
+	return eventClient, nil
+}
+
+// Closes the private data connection to the peer and the SDK
 func (setup *FabricSetup) CloseSDK() {
-	setup.SDK.Close()
+	setup.peerConnLock.Lock()
+	if setup.peerConn != nil {
+		setup.peerConn.Close()
+		setup.peerConn = nil
+	}
+	setup.peerConnLock.Unlock()
+	if setup.SDK != nil {
+		setup.SDK.Close()
+	}
 }
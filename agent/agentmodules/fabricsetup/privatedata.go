@@ -0,0 +1,155 @@
+package fabricsetup
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
+	"github.com/hyperledger/fabric-protos-go/orderer"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
+	"github.com/hyperledger/fabric/protoutil"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const privateDataTimeout = 30 * time.Second
+
+// Signer for the seek envelopes of the Deliver service, backed by the admin identity
+type identitySigner struct {
+	setup *FabricSetup
+}
+
+func (signer *identitySigner) Sign(message []byte) ([]byte, error) {
+	return signer.setup.AdminIdentity.Sign(message)
+}
+
+func (signer *identitySigner) Serialize() ([]byte, error) {
+	return signer.setup.AdminIdentity.Serialize()
+}
+
+func (signer *identitySigner) NewSignatureHeader() (*common.SignatureHeader, error) {
+	creator, err := signer.setup.AdminIdentity.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := protoutil.CreateNonce()
+	if err != nil {
+		return nil, err
+	}
+	return &common.SignatureHeader{Creator: creator, Nonce: nonce}, nil
+}
+
+// Gets the cleartext private data of a block from the private data store of the peer through the DeliverWithPrivateData service.
+// The result is keyed by the index of the transaction in the block. The peer only returns the collections
+// the organization of the agent is a member of.
+func (setup *FabricSetup) GetBlockPrivateData(channelId string, blockNumber uint64) (map[uint64]*rwset.TxPvtReadWriteSet, error) {
+	if !setup.initialized {
+		return nil, errors.New("SDK not initialized")
+	}
+
+	conn, err := setup.peerConnection()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to connect to peer "+setup.Peer)
+	}
+
+	position := &orderer.SeekPosition{Type: &orderer.SeekPosition_Specified{Specified: &orderer.SeekSpecified{Number: blockNumber}}}
+	seekInfo := &orderer.SeekInfo{
+		Start:    position,
+		Stop:     position,
+		Behavior: orderer.SeekInfo_BLOCK_UNTIL_READY,
+	}
+	envelope, err := protoutil.CreateSignedEnvelope(common.HeaderType_DELIVER_SEEK_INFO, channelId, &identitySigner{setup: setup}, seekInfo, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), privateDataTimeout)
+	defer cancel()
+	stream, err := peer.NewDeliverClient(conn).DeliverWithPrivateData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Send(envelope)
+	if err != nil {
+		return nil, err
+	}
+	stream.CloseSend()
+
+	var privateData map[uint64]*rwset.TxPvtReadWriteSet
+	for {
+		response, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		switch t := response.Type.(type) {
+		case *peer.DeliverResponse_BlockAndPrivateData:
+			privateData = t.BlockAndPrivateData.PrivateDataMap
+		case *peer.DeliverResponse_Status:
+			if t.Status != common.Status_SUCCESS {
+				return nil, errors.New(fmt.Sprintf("Deliver service returned status %s for block %d", t.Status.String(), blockNumber))
+			}
+			if privateData == nil {
+				privateData = map[uint64]*rwset.TxPvtReadWriteSet{}
+			}
+			return privateData, nil
+		}
+	}
+}
+
+// Gets the gRPC connection to the peer of the agent, dialing it on the first call. The connection is closed by CloseSDK.
+func (setup *FabricSetup) peerConnection() (*grpc.ClientConn, error) {
+	setup.peerConnLock.Lock()
+	defer setup.peerConnLock.Unlock()
+	if setup.peerConn == nil {
+		conn, err := setup.dialPeer()
+		if err != nil {
+			return nil, err
+		}
+		setup.peerConn = conn
+	}
+	return setup.peerConn, nil
+}
+
+// Opens a gRPC connection to the peer of the agent using the settings of the connection profile.
+func (setup *FabricSetup) dialPeer() (*grpc.ClientConn, error) {
+	clientContext, err := setup.SDK.Context(fabsdk.WithIdentity(setup.AdminIdentity))()
+	if err != nil {
+		return nil, err
+	}
+	peerConfig, ok := clientContext.EndpointConfig().PeerConfig(setup.Peer)
+	if !ok {
+		return nil, errors.New("No configuration found for peer " + setup.Peer)
+	}
+
+	address := peerConfig.URL
+	dialOptions := []grpc.DialOption{grpc.WithBlock(), grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32))}
+	if strings.HasPrefix(address, "grpc://") {
+		address = strings.TrimPrefix(address, "grpc://")
+		dialOptions = append(dialOptions, grpc.WithInsecure())
+	} else {
+		address = strings.TrimPrefix(address, "grpcs://")
+		tlsConfig := &tls.Config{
+			RootCAs:      x509.NewCertPool(),
+			Certificates: clientContext.EndpointConfig().TLSClientCerts(),
+		}
+		if peerConfig.TLSCACert != nil {
+			tlsConfig.RootCAs.AddCert(peerConfig.TLSCACert)
+		}
+		if serverName, ok := peerConfig.GRPCOptions["ssl-target-name-override"].(string); ok {
+			tlsConfig.ServerName = serverName
+		}
+		dialOptions = append(dialOptions, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), privateDataTimeout)
+	defer cancel()
+	return grpc.DialContext(ctx, address, dialOptions...)
+}
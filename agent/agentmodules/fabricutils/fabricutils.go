@@ -1,9 +1,16 @@
 package fabricutils
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"fmt"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/blockchain-analyzer/agent/agentmodules/fabricsetup"
 
@@ -11,6 +18,7 @@ import (
 
 	"github.com/hyperledger/fabric-protos-go/common"
 	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/hyperledger/fabric/protoutil"
 )
 
@@ -89,6 +97,114 @@ func ReturnCreatorOrgString(bytes []byte) string {
 	return sId.Mspid
 }
 
+// Returns the MSP ID, the certificate subject and the SHA-256 fingerprint of the certificate of every endorser.
+// Fields that cannot be decoded are left empty.
+func ProcessEndorsements(endorsements []*peer.Endorsement) []*Endorser {
+	endorsers := []*Endorser{}
+	for _, endorsement := range endorsements {
+		endorser := &Endorser{}
+		sId := &msp.SerializedIdentity{}
+		err := proto.Unmarshal(endorsement.Endorser, sId)
+		if err == nil {
+			endorser.MSPID = sId.Mspid
+			bl, _ := pem.Decode(sId.IdBytes)
+			if bl != nil {
+				fingerprint := sha256.Sum256(bl.Bytes)
+				endorser.Fingerprint = hex.EncodeToString(fingerprint[:])
+				cert, err := x509.ParseCertificate(bl.Bytes)
+				if err == nil {
+					endorser.Subject = cert.Subject.String()
+				}
+			}
+		}
+		endorsers = append(endorsers, endorser)
+	}
+	return endorsers
+}
+
+// Returns the distinct MSP IDs of the endorsers.
+func EndorserOrgs(endorsers []*Endorser) []string {
+	orgs := []string{}
+	seen := make(map[string]bool)
+	for _, endorser := range endorsers {
+		if !seen[endorser.MSPID] {
+			seen[endorser.MSPID] = true
+			orgs = append(orgs, endorser.MSPID)
+		}
+	}
+	return orgs
+}
+
+// Converts the arguments of a chaincode invocation into strings. Arguments at the redacted positions (zero-based, not counting the function name)
+// are replaced with "[REDACTED]", arguments that are not valid UTF-8 are base64 encoded, and arguments longer than maxArgSize bytes are truncated.
+// If maxArgSize is 0, arguments are not truncated.
+func FormatArgs(args [][]byte, maxArgSize int, redactArgs []int) []string {
+	formattedArgs := []string{}
+	for argIndex, arg := range args {
+		redacted := false
+		for _, redactIndex := range redactArgs {
+			if redactIndex == argIndex {
+				redacted = true
+			}
+		}
+		if redacted {
+			formattedArgs = append(formattedArgs, "[REDACTED]")
+		} else {
+			formattedArgs = append(formattedArgs, truncate(arg, maxArgSize))
+		}
+	}
+	return formattedArgs
+}
+
+// Decodes the payload as JSON if possible. Otherwise it returns the payload as a string if it is valid UTF-8, or base64 encoded.
+func DecodePayload(payload []byte) interface{} {
+	var decoded interface{}
+	if json.Unmarshal(payload, &decoded) == nil {
+		return decoded
+	}
+	if utf8.Valid(payload) {
+		return string(payload)
+	}
+	return base64.StdEncoding.EncodeToString(payload)
+}
+
+// Returns the chaincode response payload limited to maxSize bytes. Payloads that fit are decoded with DecodePayload,
+// longer ones are truncated (base64 encoded first if they are not valid UTF-8). If maxSize is 0, the payload is omitted.
+func FormatResponsePayload(payload []byte, maxSize int) interface{} {
+	if maxSize <= 0 || len(payload) == 0 {
+		return nil
+	}
+	if len(payload) > maxSize {
+		return truncate(payload, maxSize)
+	}
+	return DecodePayload(payload)
+}
+
+// Converts the value into a string: as is if it is valid UTF-8, base64 encoded otherwise. If maxSize is positive, longer strings
+// are cut at the last rune boundary within maxSize bytes and suffixed with "...".
+func truncate(value []byte, maxSize int) string {
+	if !utf8.Valid(value) {
+		value = []byte(base64.StdEncoding.EncodeToString(value))
+	}
+	if maxSize <= 0 || len(value) <= maxSize {
+		return string(value)
+	}
+	end := maxSize
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return string(value[:end]) + "..."
+}
+
+// Returns the redacted argument positions of the chaincode, or nil if the chaincode is not configured.
+func RedactedArgsOfChaincode(array []fabricsetup.Chaincode, name string) []int {
+	ccIndex := IndexOfChaincode(array, name)
+	if ccIndex < 0 {
+		return nil
+	}
+	return array[ccIndex].RedactArgs
+}
+
 func IndexOfChaincode(array []fabricsetup.Chaincode, name string) int {
 	for i, v := range array {
 		if v.Name == name {
@@ -98,9 +214,38 @@ func IndexOfChaincode(array []fabricsetup.Chaincode, name string) int {
 	return -1
 }
 
+// Version of a key: the block and transaction number of the committed write that was read.
+// A nil version means that the key did not exist when it was read.
+type Version struct {
+	BlockNum uint64 `json:"blockNum"`
+	TxNum    uint64 `json:"txNum"`
+}
+
 type Readset struct {
-	Namespace string `json:"namespace"`
-	Key       string `json:"key"`
+	Namespace string   `json:"namespace"`
+	Key       string   `json:"key"`
+	Version   *Version `json:"version"`
+}
+
+// Range query executed by the transaction. Reads are only available if the peer recorded the raw reads instead of a merkle summary.
+type RangeQuery struct {
+	Namespace    string     `json:"namespace"`
+	StartKey     string     `json:"startKey"`
+	EndKey       string     `json:"endKey"`
+	ItrExhausted bool       `json:"itrExhausted"`
+	Reads        []*Readset `json:"reads"`
+}
+
+type MetadataEntry struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Metadata write of a key, e.g. a key-level endorsement policy set with SetStateValidationParameter
+type MetadataWrite struct {
+	Namespace string           `json:"namespace"`
+	Key       string           `json:"key"`
+	Entries   []*MetadataEntry `json:"entries"`
 }
 
 type Writeset struct {
@@ -109,3 +254,44 @@ type Writeset struct {
 	Value     interface{} `json:"value"`
 	IsDelete  bool        `json:"isDelete"`
 }
+
+// Write of a private data collection. Only the hashes are on the ledger, the key and the value are set
+// if the cleartext private data was fetched from the private data store of the peer.
+type HashedWrite struct {
+	Namespace  string      `json:"namespace"`
+	Collection string      `json:"collection"`
+	KeyHash    string      `json:"keyHash"`
+	ValueHash  string      `json:"valueHash"`
+	IsDelete   bool        `json:"isDelete"`
+	Key        string      `json:"key"`
+	Value      interface{} `json:"value"`
+}
+
+// Builds a deterministic document ID from the channel, the block number and the position of the data in the block
+// (e.g. transaction index, action index, write index), so that indexing a block again overwrites its documents.
+func DocumentID(channelId string, blockNumber uint64, position ...interface{}) string {
+	parts := []string{channelId, strconv.FormatUint(blockNumber, 10)}
+	for _, p := range position {
+		parts = append(parts, fmt.Sprint(p))
+	}
+	return strings.Join(parts, "-")
+}
+
+// Returns the distinct collection names of hashed writes
+func CollectionsOfHashedWrites(hashedWrites []*HashedWrite) []string {
+	collections := []string{}
+	seen := map[string]bool{}
+	for _, hashedWrite := range hashedWrites {
+		if !seen[hashedWrite.Collection] {
+			seen[hashedWrite.Collection] = true
+			collections = append(collections, hashedWrite.Collection)
+		}
+	}
+	return collections
+}
+
+type Endorser struct {
+	MSPID       string `json:"mspId"`
+	Subject     string `json:"subject"`
+	Fingerprint string `json:"fingerprint"`
+}
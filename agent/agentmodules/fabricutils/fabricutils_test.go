@@ -0,0 +1,62 @@
+package fabricutils
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFormatArgs(t *testing.T) {
+	binary := []byte{0xff, 0x00, 0x01}
+	tests := []struct {
+		name       string
+		arg        []byte
+		maxArgSize int
+		redacted   bool
+		expected   string
+	}{
+		{"short", []byte("owner"), 8, false, "owner"},
+		{"long", []byte("owner"), 3, false, "own..."},
+		{"no limit", []byte("owner"), 0, false, "owner"},
+		{"multi-byte fits", []byte("héllo"), 6, false, "héllo"},
+		{"multi-byte cut inside a rune", []byte("héllo"), 2, false, "h..."},
+		{"multi-byte cut after a rune", []byte("héllo"), 3, false, "hé..."},
+		{"binary", binary, 0, false, "/wAB"},
+		{"binary truncated", binary, 2, false, "/w..."},
+		{"redacted", []byte("secret"), 0, true, "[REDACTED]"},
+	}
+	for _, test := range tests {
+		var redactArgs []int
+		if test.redacted {
+			redactArgs = []int{0}
+		}
+		formatted := FormatArgs([][]byte{test.arg}, test.maxArgSize, redactArgs)
+		if len(formatted) != 1 || formatted[0] != test.expected {
+			t.Errorf("%s: %q instead of %q", test.name, formatted, test.expected)
+		} else if !utf8.ValidString(formatted[0]) {
+			t.Errorf("%s: %q is not valid UTF-8", test.name, formatted[0])
+		}
+	}
+}
+
+func TestFormatResponsePayload(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  []byte
+		maxSize  int
+		expected interface{}
+	}{
+		{"omitted", []byte("ok"), 0, nil},
+		{"empty", []byte{}, 10, nil},
+		{"string", []byte("ok"), 10, "ok"},
+		{"json", []byte("42"), 10, float64(42)},
+		{"multi-byte truncated", []byte("€€€"), 4, "€..."},
+		{"binary", []byte{0xff, 0x00, 0x01}, 10, "/wAB"},
+		{"binary truncated", []byte{0xff, 0x00, 0x01, 0x02, 0x03}, 4, "/wAB..."},
+	}
+	for _, test := range tests {
+		formatted := FormatResponsePayload(test.payload, test.maxSize)
+		if formatted != test.expected {
+			t.Errorf("%s: %#v instead of %#v", test.name, formatted, test.expected)
+		}
+	}
+}
@@ -1,22 +1,30 @@
 package ledgerutils
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"time"
 
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/configutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+	"github.com/gogo/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
 	protoCommon "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
 	"github.com/hyperledger/fabric/core/ledger/util"
-	"github.com/hyperledger/fabric-protos-go/common"
-	"github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/hyperledger/fabric/protoutil"
-	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
 
 	"log"
 )
 
-func GetBlockHash(blockNumber uint64, ledgerClient *ledger.Client) (string, error) {
-	blockResponse, blockError := ledgerClient.QueryBlock(blockNumber)
+func GetBlockHash(blockNumber uint64, source blocksource.BlockSource) (string, error) {
+	blockResponse, blockError := source.Block(blockNumber)
 	if blockError != nil {
 		return "", blockError
 	}
@@ -26,39 +34,106 @@ func GetBlockHash(blockNumber uint64, ledgerClient *ledger.Client) (string, erro
 	return blockHash, nil
 }
 
-func GetBlockHeight(ledgerClient *ledger.Client) (uint64, error) {
+func GetBlockHeight(source blocksource.BlockSource) (uint64, error) {
 	// Get the block height of this channel
-	infoResponse, err := ledgerClient.QueryInfo()
+	blockHeight, err := source.Height()
 	if err != nil {
 		return 0, err
 	}
-	blockHeight := infoResponse.BCI.Height
 	return blockHeight, nil
 }
 
-func ProcessBlock(blockNumber uint64, ledgerClient *ledger.Client) (blockResponse *protoCommon.Block, typeInfo string, createdAt time.Time, txsFltr util.TxValidationFlags, err error) {
-	blockResponse, blockError := ledgerClient.QueryBlock(blockNumber)
+// Gets the block height of the channel from the specified peer (the name of the peer in the connection profile).
+func GetBlockHeightFromPeer(ledgerClient *ledger.Client, peer string) (uint64, error) {
+	infoResponse, err := ledgerClient.QueryInfo(ledger.WithTargetEndpoints(peer))
+	if err != nil {
+		return 0, err
+	}
+	return infoResponse.BCI.Height, nil
+}
+
+// Gets the hash of the specified block from the specified peer (the name of the peer in the connection profile).
+func GetBlockHashFromPeer(blockNumber uint64, ledgerClient *ledger.Client, peer string) (string, error) {
+	blockResponse, err := ledgerClient.QueryBlock(blockNumber, ledger.WithTargetEndpoints(peer))
+	if err != nil {
+		return "", err
+	}
+	return fabricutils.GenerateBlockHash(blockResponse.Header.PreviousHash, blockResponse.Header.DataHash, blockResponse.Header.Number), nil
+}
+
+func ProcessBlock(blockNumber uint64, source blocksource.BlockSource) (blockResponse *protoCommon.Block, typeInfo string, createdAt time.Time, txsFltr util.TxValidationFlags, err error) {
+	blockResponse, blockError := source.Block(blockNumber)
 	if blockError != nil {
 		return nil, "", time.Now(), nil, blockError
 	}
 
-	// Getting block creation timestamp
-	env, err := protoutil.GetEnvelopeFromBlock(blockResponse.Data.Data[0])
+	typeInfo, createdAt, txsFltr, err = ProcessBlockData(blockResponse)
 	if err != nil {
 		return nil, "", time.Now(), nil, err
 	}
+	return blockResponse, typeInfo, createdAt, txsFltr, nil
+}
+
+// Returns the transaction type, the creation timestamp and the validation flags of an already retrieved block
+// (e.g. a block received from the Deliver service).
+func ProcessBlockData(block *protoCommon.Block) (typeInfo string, createdAt time.Time, txsFltr util.TxValidationFlags, err error) {
+	// Getting block creation timestamp
+	env, err := protoutil.GetEnvelopeFromBlock(block.Data.Data[0])
+	if err != nil {
+		return "", time.Now(), nil, err
+	}
 
 	channelHeader, err := protoutil.ChannelHeader(env)
 	if err != nil {
-		return nil, "", time.Now(), nil, err
+		return "", time.Now(), nil, err
 	}
 	typeCode := channelHeader.GetType()
 	typeInfo = fabricutils.TypeCodeToInfo(typeCode)
 	createdAt = time.Unix(channelHeader.GetTimestamp().Seconds, int64(channelHeader.GetTimestamp().Nanos))
 
 	// Checking validity
-	txsFltr = util.TxValidationFlags(blockResponse.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER])
-	return
+	txsFltr = util.TxValidationFlags(block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER])
+	return typeInfo, createdAt, txsFltr, nil
+}
+
+// Returns the channel configuration that was in effect before the specified block, using the LAST_CONFIG metadata of the previous block.
+// Returns nil for the genesis block, and if the previous block or the config block is not available from the source.
+func GetPreviousConfig(blockNumber uint64, source blocksource.BlockSource) (*configutils.ChannelConfig, error) {
+	firstBlockNumber, err := source.First()
+	if err != nil {
+		return nil, err
+	}
+	if blockNumber <= firstBlockNumber {
+		return nil, nil
+	}
+	previousBlock, err := source.Block(blockNumber - 1)
+	if err != nil {
+		return nil, err
+	}
+	lastConfigIndex, err := protoutil.GetLastConfigIndexFromBlock(previousBlock)
+	if err != nil {
+		return nil, err
+	}
+	if lastConfigIndex < firstBlockNumber {
+		return nil, nil
+	}
+	configBlock := previousBlock
+	if lastConfigIndex != previousBlock.Header.Number {
+		configBlock, err = source.Block(lastConfigIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return configutils.ProcessConfigTx(configBlock.Data.Data[0])
+}
+
+// Returns the validation code of the transaction at the given index of the block and whether the transaction is valid.
+// Transactions not covered by the TRANSACTIONS_FILTER metadata are reported as NOT_VALIDATED.
+func GetTxValidationCode(txsFltr util.TxValidationFlags, txIndex int) (validationCode string, isValid bool) {
+	if txIndex >= len(txsFltr) {
+		return peer.TxValidationCode_NOT_VALIDATED.String(), false
+	}
+	return txsFltr.Flag(txIndex).String(), txsFltr.IsValid(txIndex)
 }
 
 func ProcessTx(txData []byte) (txId, channelId, creator, creatorOrg string, tx *peer.Transaction, err error) {
@@ -90,23 +165,197 @@ func ProcessTx(txData []byte) (txId, channelId, creator, creatorOrg string, tx *
 	return chdr.TxId, chdr.ChannelId, fabricutils.ReturnCreatorString(shdr.Creator), fabricutils.ReturnCreatorOrgString(shdr.Creator), tx, nil
 }
 
-func ProcessEndorserTx(txData []byte) (txId, channelId, creator, creatorOrg string, txRWSet *rwsetutil.TxRwSet, chaincodeName, chaincodeVersion string, err error) {
+// Data of one action of an endorser transaction
+type EndorserAction struct {
+	Index            int
+	TxRWSet          *rwsetutil.TxRwSet
+	ChaincodeName    string
+	ChaincodeVersion string
+	Endorsers        []*fabricutils.Endorser
+	Function         string
+	Args             [][]byte
+	ResponseStatus   int32
+	ResponseMessage  string
+	ResponsePayload  []byte
+	ChaincodeEvent   *peer.ChaincodeEvent
+}
+
+// Returns the header data of the endorser transaction and the data of each of its actions.
+func ProcessEndorserTx(txData []byte) (txId, channelId, creator, creatorOrg string, actions []*EndorserAction, err error) {
 
 	txId, channelId, creator, creatorOrg, tx, err := ProcessTx(txData)
 	if err != nil {
-		return "", "", "", "", nil, "", "", err
+		return "", "", "", "", nil, err
 	}
 
-	_, respPayload, payloadErr := protoutil.GetPayloads(tx.Actions[0])
-	if payloadErr != nil {
-		return "", "", "", "", nil, "", "", err
+	for actionIndex, txAction := range tx.Actions {
+		actionPayload, respPayload, err := protoutil.GetPayloads(txAction)
+		if err != nil {
+			return "", "", "", "", nil, err
+		}
+
+		txRWSet := &rwsetutil.TxRwSet{}
+		err = txRWSet.FromProtoBytes(respPayload.Results)
+		if err != nil {
+			return "", "", "", "", nil, err
+		}
+
+		function, args, err := processChaincodeInput(actionPayload.ChaincodeProposalPayload)
+		if err != nil {
+			return "", "", "", "", nil, err
+		}
+
+		// The chaincode can set at most one event per action
+		var chaincodeEvent *peer.ChaincodeEvent
+		if len(respPayload.Events) > 0 {
+			chaincodeEvent, err = protoutil.UnmarshalChaincodeEvents(respPayload.Events)
+			if err != nil {
+				return "", "", "", "", nil, err
+			}
+		}
+
+		actions = append(actions, &EndorserAction{
+			Index:            actionIndex,
+			TxRWSet:          txRWSet,
+			ChaincodeName:    respPayload.ChaincodeId.Name,
+			ChaincodeVersion: respPayload.ChaincodeId.Version,
+			Endorsers:        fabricutils.ProcessEndorsements(actionPayload.Action.Endorsements),
+			Function:         function,
+			Args:             args,
+			ResponseStatus:   respPayload.GetResponse().GetStatus(),
+			ResponseMessage:  respPayload.GetResponse().GetMessage(),
+			ResponsePayload:  respPayload.GetResponse().GetPayload(),
+			ChaincodeEvent:   chaincodeEvent,
+		})
 	}
 
-	txRWSet = &rwsetutil.TxRwSet{}
-	err = txRWSet.FromProtoBytes(respPayload.Results)
+	return txId, channelId, creator, creatorOrg, actions, nil
+}
+
+// Decodes the chaincode invocation spec of the proposal payload, and returns the name of the invoked function and its arguments.
+func processChaincodeInput(chaincodeProposalPayload []byte) (function string, args [][]byte, err error) {
+	proposalPayload, err := protoutil.UnmarshalChaincodeProposalPayload(chaincodeProposalPayload)
+	if err != nil {
+		return "", nil, err
+	}
+
+	invocationSpec, err := protoutil.UnmarshalChaincodeInvocationSpec(proposalPayload.Input)
 	if err != nil {
-		return "", "", "", "", nil, "", "", err
+		return "", nil, err
+	}
+
+	input := invocationSpec.GetChaincodeSpec().GetInput()
+	if input == nil || len(input.Args) == 0 {
+		return "", [][]byte{}, nil
+	}
+	return string(input.Args[0]), input.Args[1:], nil
+}
+
+// Converts a read of the read set, including the version of the committed write that was read.
+func ProcessRead(namespace string, read *kvrwset.KVRead) *fabricutils.Readset {
+	readset := &fabricutils.Readset{
+		Namespace: namespace,
+		Key:       read.Key,
+	}
+	if read.Version != nil {
+		readset.Version = &fabricutils.Version{
+			BlockNum: read.Version.BlockNum,
+			TxNum:    read.Version.TxNum,
+		}
 	}
+	return readset
+}
 
-	return txId, channelId, creator, creatorOrg, txRWSet, respPayload.ChaincodeId.Name, respPayload.ChaincodeId.Version, nil
+// Converts the info of a range query executed by the transaction.
+func ProcessRangeQuery(namespace string, rangeQueryInfo *kvrwset.RangeQueryInfo) *fabricutils.RangeQuery {
+	rangeQuery := &fabricutils.RangeQuery{
+		Namespace:    namespace,
+		StartKey:     rangeQueryInfo.StartKey,
+		EndKey:       rangeQueryInfo.EndKey,
+		ItrExhausted: rangeQueryInfo.ItrExhausted,
+		Reads:        []*fabricutils.Readset{},
+	}
+	for _, read := range rangeQueryInfo.GetRawReads().GetKvReads() {
+		rangeQuery.Reads = append(rangeQuery.Reads, ProcessRead(namespace, read))
+	}
+	return rangeQuery
+}
+
+// Converts a metadata write of the write set. Key-level endorsement policies (VALIDATION_PARAMETER entries) are decoded,
+// other metadata values are base64 encoded.
+func ProcessMetadataWrite(namespace string, metadataWrite *kvrwset.KVMetadataWrite) *fabricutils.MetadataWrite {
+	processed := &fabricutils.MetadataWrite{
+		Namespace: namespace,
+		Key:       metadataWrite.Key,
+		Entries:   []*fabricutils.MetadataEntry{},
+	}
+	for _, entry := range metadataWrite.Entries {
+		value := base64.StdEncoding.EncodeToString(entry.Value)
+		if entry.Name == peer.MetaDataKeys_VALIDATION_PARAMETER.String() {
+			policy, err := configutils.DecodeSignaturePolicy(entry.Value)
+			if err == nil {
+				value = policy
+			}
+		}
+		processed.Entries = append(processed.Entries, &fabricutils.MetadataEntry{
+			Name:  entry.Name,
+			Value: value,
+		})
+	}
+	return processed
+}
+
+// Converts the hashed writes of the private data collections of a namespace. If the cleartext private data of the
+// transaction is given, the key and the value are attached to the writes with a matching key hash.
+func ProcessHashedWrites(nsRwSet *rwsetutil.NsRwSet, txPvtRwSet *rwset.TxPvtReadWriteSet) []*fabricutils.HashedWrite {
+	cleartextWrites := processPrivateWrites(nsRwSet.NameSpace, txPvtRwSet)
+	hashedWrites := []*fabricutils.HashedWrite{}
+	for _, collHashedRwSet := range nsRwSet.CollHashedRwSets {
+		if collHashedRwSet.HashedRwSet == nil {
+			continue
+		}
+		for _, w := range collHashedRwSet.HashedRwSet.HashedWrites {
+			hashedWrite := &fabricutils.HashedWrite{
+				Namespace:  nsRwSet.NameSpace,
+				Collection: collHashedRwSet.CollectionName,
+				KeyHash:    hex.EncodeToString(w.KeyHash),
+				ValueHash:  hex.EncodeToString(w.ValueHash),
+				IsDelete:   w.IsDelete,
+			}
+			if cleartextWrite, ok := cleartextWrites[hashedWrite.Collection+"/"+hashedWrite.KeyHash]; ok {
+				hashedWrite.Key = cleartextWrite.Key
+				if !cleartextWrite.IsDelete {
+					hashedWrite.Value = fabricutils.DecodePayload(cleartextWrite.Value)
+				}
+			}
+			hashedWrites = append(hashedWrites, hashedWrite)
+		}
+	}
+	return hashedWrites
+}
+
+// Returns the cleartext private writes of a namespace keyed by collection name and hex encoded SHA-256 hash of the key.
+func processPrivateWrites(namespace string, txPvtRwSet *rwset.TxPvtReadWriteSet) map[string]*kvrwset.KVWrite {
+	privateWrites := map[string]*kvrwset.KVWrite{}
+	if txPvtRwSet == nil {
+		return privateWrites
+	}
+	for _, nsPvtRwSet := range txPvtRwSet.NsPvtRwset {
+		if nsPvtRwSet.Namespace != namespace {
+			continue
+		}
+		for _, collPvtRwSet := range nsPvtRwSet.CollectionPvtRwset {
+			kvRwSet := &kvrwset.KVRWSet{}
+			err := proto.Unmarshal(collPvtRwSet.Rwset, kvRwSet)
+			if err != nil {
+				log.Printf("Error unmarshaling private data of collection %s: %s", collPvtRwSet.CollectionName, err.Error())
+				continue
+			}
+			for _, w := range kvRwSet.Writes {
+				keyHash := sha256.Sum256([]byte(w.Key))
+				privateWrites[collPvtRwSet.CollectionName+"/"+hex.EncodeToString(keyHash[:])] = w
+			}
+		}
+	}
+	return privateWrites
 }
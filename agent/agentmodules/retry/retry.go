@@ -0,0 +1,74 @@
+// Classifies the errors of the ingestion into transient and permanent ones, and computes the delays between the retries.
+package retry
+
+import (
+	"time"
+)
+
+// An error that happens again when the operation that caused it is retried, e.g. a block that cannot be decoded
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Marks an error as permanent: retrying the operation that caused it does not help.
+func Permanent(err error) error {
+	if err == nil || IsPermanent(err) {
+		return err
+	}
+	return &permanentError{err: err}
+}
+
+// Returns true if the error (or the error it wraps) was marked as permanent. Every other error is considered transient
+// (e.g. a timeout of the peer or an unavailable Elasticsearch node), the operation that caused it is worth retrying.
+func IsPermanent(err error) bool {
+	for err != nil {
+		if _, ok := err.(*permanentError); ok {
+			return true
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = cause.Cause()
+	}
+	return false
+}
+
+// Exponential backoff between the retries of an operation. The delay starts from Initial and doubles with every failure up to Max.
+// After MaxAttempts consecutive failures the operation is given up (0 means it is retried forever).
+type Backoff struct {
+	Initial     time.Duration
+	Max         time.Duration
+	MaxAttempts int
+	attempts    int
+}
+
+// Returns the delay before the next attempt, and false if the operation should be given up.
+func (b *Backoff) Next() (time.Duration, bool) {
+	b.attempts++
+	if b.MaxAttempts > 0 && b.attempts > b.MaxAttempts {
+		return 0, false
+	}
+	delay := b.Initial
+	for i := 1; i < b.attempts && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	return delay, true
+}
+
+// Gets the number of consecutive failures.
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Starts over from the initial delay, after the operation succeeded.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
@@ -0,0 +1,60 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type wrappedError struct {
+	cause error
+}
+
+func (e *wrappedError) Error() string {
+	return "wrapped: " + e.cause.Error()
+}
+
+func (e *wrappedError) Cause() error {
+	return e.cause
+}
+
+func TestIsPermanent(t *testing.T) {
+	transient := errors.New("timeout")
+	tests := []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{"nil", nil, false},
+		{"transient", transient, false},
+		{"permanent", Permanent(transient), true},
+		{"wrapped permanent", &wrappedError{Permanent(transient)}, true},
+		{"wrapped transient", &wrappedError{transient}, false},
+	}
+	for _, test := range tests {
+		if IsPermanent(test.err) != test.permanent {
+			t.Errorf("%s: IsPermanent is %v instead of %v", test.name, !test.permanent, test.permanent)
+		}
+	}
+	if Permanent(nil) != nil {
+		t.Error("nil error marked as permanent")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	backoff := &Backoff{Initial: time.Second, Max: 5 * time.Second, MaxAttempts: 5}
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		delay, ok := backoff.Next()
+		if !ok || delay != expected {
+			t.Errorf("attempt %d: delay is %s (retry: %v) instead of %s", backoff.Attempts(), delay, ok, expected)
+		}
+	}
+	if _, ok := backoff.Next(); ok {
+		t.Errorf("attempt %d is allowed after %d attempts", backoff.Attempts(), backoff.MaxAttempts)
+	}
+
+	backoff.Reset()
+	if delay, ok := backoff.Next(); !ok || delay != time.Second {
+		t.Errorf("delay after reset is %s (retry: %v) instead of 1s", delay, ok)
+	}
+}
@@ -0,0 +1,185 @@
+package transform
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/configutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+)
+
+// The records of one block
+type Records struct {
+	Block        *Block
+	Transactions []*Transaction
+	Writes       []*Write
+	Reads        []*Read
+	Configs      []*Config
+	Events       []*Event
+}
+
+// Data of a block. Transactions are the IDs of the endorser transactions of the block, Txs are every transaction of the block in order.
+// Signatures, LastConfigIndex and CommitHash come from the block metadata, CommitHash is only set by peers that compute it (Fabric 2.0+).
+type Block struct {
+	ChannelId       string            `json:"channelId"`
+	BlockNumber     uint64            `json:"blockNumber"`
+	BlockHash       string            `json:"blockHash"`
+	PreviousHash    string            `json:"previousHash"`
+	DataHash        string            `json:"dataHash"`
+	CreatedAt       time.Time         `json:"createdAt"`
+	TxType          string            `json:"txType"`
+	ValidTxCount    int               `json:"validTxCount"`
+	InvalidTxCount  int               `json:"invalidTxCount"`
+	Transactions    []string          `json:"transactions"`
+	Txs             []*BlockTx        `json:"txs"`
+	Signatures      []*BlockSignature `json:"signatures"`
+	LastConfigIndex uint64            `json:"lastConfigIndex"`
+	CommitHash      string            `json:"commitHash,omitempty"`
+}
+
+// A transaction of a block
+type BlockTx struct {
+	TxIndex        int    `json:"txIndex"`
+	TxId           string `json:"txId"`
+	TxType         string `json:"txType"`
+	ValidationCode string `json:"validationCode"`
+}
+
+// A signature of the block metadata (by the orderer that created the block), with the identity of the signer
+type BlockSignature struct {
+	fabricutils.Endorser
+	Signature string `json:"signature"`
+}
+
+// Data shared by every record of a transaction
+type TxHeader struct {
+	ChannelId      string    `json:"channelId"`
+	BlockNumber    uint64    `json:"blockNumber"`
+	TxIndex        int       `json:"txIndex"`
+	TxId           string    `json:"txId"`
+	CreatedAt      time.Time `json:"createdAt"`
+	Creator        string    `json:"creator"`
+	CreatorOrg     string    `json:"creatorOrg"`
+	TxType         string    `json:"txType"`
+	ValidationCode string    `json:"validationCode"`
+	IsValid        bool      `json:"isValid"`
+}
+
+// Data of a transaction. Endorser transactions have one record per action, other transactions (e.g. config) have
+// a single record with only the header set.
+type Transaction struct {
+	TxHeader
+	ActionIndex      int                          `json:"actionIndex"`
+	ActionCount      int                          `json:"actionCount"`
+	ChaincodeName    string                       `json:"chaincodeName"`
+	ChaincodeVersion string                       `json:"chaincodeVersion"`
+	Readset          []*fabricutils.Readset       `json:"readset"`
+	Writeset         []*fabricutils.Writeset      `json:"writeset"`
+	RangeQueries     []*fabricutils.RangeQuery    `json:"rangeQueries"`
+	MetadataWrites   []*fabricutils.MetadataWrite `json:"metadataWrites"`
+	PrivateWriteset  []*fabricutils.HashedWrite   `json:"privateWriteset"`
+	Collections      []string                     `json:"collections"`
+	Endorsers        []*fabricutils.Endorser      `json:"endorsers"`
+	EndorserOrgs     []string                     `json:"endorserOrgs"`
+	EndorsementCount int                          `json:"endorsementCount"`
+	Function         string                       `json:"function"`
+	Args             []string                     `json:"args"`
+	ResponseStatus   int32                        `json:"responseStatus"`
+	ResponseMessage  string                       `json:"responseMessage"`
+	ResponsePayload  interface{}                  `json:"responsePayload"`
+}
+
+// Returns true for the transactions that invoke chaincodes
+func (tx *Transaction) IsEndorserTx() bool {
+	return tx.TxType == EndorserTransaction
+}
+
+// Data of one key write. WriteType is "value" for value writes, "metadata" for metadata writes and "private" for the writes
+// of private data collections, for which Key and Value are only set if the cleartext is available.
+// WriteIndex is the position of the write among the writes of the same type of the action.
+// DecodeError is set if the value could not be decoded with the decoder of the chaincode, or its linking key is not a string
+// (LinkingKey is empty then).
+type Write struct {
+	TxHeader
+	ActionIndex      int                          `json:"actionIndex"`
+	WriteIndex       int                          `json:"writeIndex"`
+	WriteType        string                       `json:"writeType"`
+	Namespace        string                       `json:"namespace"`
+	ChaincodeName    string                       `json:"chaincodeName"`
+	ChaincodeVersion string                       `json:"chaincodeVersion"`
+	Write            interface{}                  `json:"write"`
+	Collection       string                       `json:"collection"`
+	KeyHash          string                       `json:"keyHash"`
+	ValueHash        string                       `json:"valueHash"`
+	Key              string                       `json:"key"`
+	IsDelete         bool                         `json:"isDelete"`
+	LinkingKey       string                       `json:"linkingKey"`
+	Value            interface{}                  `json:"value"`
+	ValueDecoder     string                       `json:"valueDecoder"`
+	DecodeError      string                       `json:"decodeError,omitempty"`
+	Metadata         []*fabricutils.MetadataEntry `json:"metadata"`
+}
+
+// Data of one key read, with the version of the key that was read
+type Read struct {
+	TxHeader
+	ActionIndex   int                  `json:"actionIndex"`
+	ReadIndex     int                  `json:"readIndex"`
+	Namespace     string               `json:"namespace"`
+	ChaincodeName string               `json:"chaincodeName"`
+	Key           string               `json:"key"`
+	Version       *fabricutils.Version `json:"version"`
+}
+
+// The decoded channel configuration of a config transaction, and its changes compared to the previous configuration
+type Config struct {
+	TxHeader
+	Config  *configutils.ChannelConfig  `json:"config"`
+	Changes []*configutils.ConfigChange `json:"changes"`
+	Signers []string                    `json:"signers"`
+}
+
+// Data of an event set by the chaincode
+type Event struct {
+	TxHeader
+	ActionIndex   int         `json:"actionIndex"`
+	ChaincodeName string      `json:"chaincodeName"`
+	EventName     string      `json:"eventName"`
+	Payload       interface{} `json:"payload"`
+}
+
+// Deterministic IDs of the records, so that processing a block again overwrites its records
+
+func (b *Block) ID() string {
+	return fabricutils.DocumentID(b.ChannelId, b.BlockNumber)
+}
+
+func (tx *Transaction) ID() string {
+	if !tx.IsEndorserTx() {
+		return fabricutils.DocumentID(tx.ChannelId, tx.BlockNumber, tx.TxIndex)
+	}
+	return fabricutils.DocumentID(tx.ChannelId, tx.BlockNumber, tx.TxIndex, tx.ActionIndex)
+}
+
+func (w *Write) ID() string {
+	prefix := "w"
+	switch w.WriteType {
+	case WriteTypeMetadata:
+		prefix = "m"
+	case WriteTypePrivate:
+		prefix = "p"
+	}
+	return fabricutils.DocumentID(w.ChannelId, w.BlockNumber, w.TxIndex, w.ActionIndex, fmt.Sprintf("%s%d", prefix, w.WriteIndex))
+}
+
+func (r *Read) ID() string {
+	return fabricutils.DocumentID(r.ChannelId, r.BlockNumber, r.TxIndex, r.ActionIndex, fmt.Sprintf("r%d", r.ReadIndex))
+}
+
+func (c *Config) ID() string {
+	return fabricutils.DocumentID(c.ChannelId, c.BlockNumber, c.TxIndex)
+}
+
+func (e *Event) ID() string {
+	return fabricutils.DocumentID(e.ChannelId, e.BlockNumber, e.TxIndex, e.ActionIndex)
+}
@@ -0,0 +1,397 @@
+// Turns the blocks of a channel into typed records (block, transaction, write, read, config, chaincode event),
+// independently of where the records are sent. Used by fabricbeat and the dumper.
+package transform
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric/protoutil"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/configutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricsetup"
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/ledgerutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/retry"
+	"github.com/blockchain-analyzer/agent/agentmodules/valuedecoders"
+)
+
+// Types of the write records
+const (
+	WriteTypeValue    = "value"
+	WriteTypeMetadata = "metadata"
+	WriteTypePrivate  = "private"
+)
+
+// Transaction type of the transactions that invoke chaincodes
+const EndorserTransaction = "ENDORSER_TRANSACTION"
+
+// Settings of the transformation.
+// Chaincodes are used for the linking keys and the redacted arguments, Decoders are the value decoders keyed by chaincode name.
+// If SkipInvalidWrites is true, no write records are created for invalid transactions (their write sets are kept).
+// Chaincode arguments longer than MaxArgSize bytes are truncated (0 means no limit).
+// Chaincode response payloads are kept up to MaxResponseSize bytes (0 means the payload is omitted).
+type Options struct {
+	Chaincodes        []fabricsetup.Chaincode
+	Decoders          map[string]valuedecoders.Decoder
+	SkipInvalidWrites bool
+	MaxArgSize        int
+	MaxResponseSize   int
+}
+
+// Transforms blocks into records, keeping track of the last complete configuration of each channel,
+// so that config records contain the changes compared to the previous configuration.
+// Blocks can be transformed concurrently, but the config blocks of a channel have to be transformed in order.
+type Transformer struct {
+	options     Options
+	mutex       sync.Mutex
+	lastConfigs map[string]*configutils.ChannelConfig
+}
+
+// Creates a transformer with the given settings.
+func New(options Options) *Transformer {
+	return &Transformer{
+		options:     options,
+		lastConfigs: make(map[string]*configutils.ChannelConfig),
+	}
+}
+
+// Returns the records of a block. The block record is always set, the other records are in the order of the transactions.
+// The source is used to find the configuration preceding the first config transaction seen on the channel (it may be nil),
+// privateData is the cleartext private data of the block keyed by transaction index (it may be nil).
+// Errors of blocks that cannot be decoded are marked as permanent (see retry.IsPermanent), errors of the source are returned as they are.
+func (t *Transformer) Transform(block *common.Block, source blocksource.BlockSource, privateData map[uint64]*rwset.TxPvtReadWriteSet) (*Records, error) {
+	typeInfo, createdAt, txsFltr, err := ledgerutils.ProcessBlockData(block)
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+	channelId, err := blocksource.GetChannelId(block)
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+
+	records := &Records{
+		Block: &Block{
+			ChannelId:    channelId,
+			BlockNumber:  block.Header.Number,
+			BlockHash:    fabricutils.GenerateBlockHash(block.Header.PreviousHash, block.Header.DataHash, block.Header.Number),
+			PreviousHash: hex.EncodeToString(block.Header.PreviousHash),
+			DataHash:     hex.EncodeToString(block.Header.DataHash),
+			CreatedAt:    createdAt,
+			TxType:       typeInfo,
+			Transactions: []string{},
+			Txs:          []*BlockTx{},
+		},
+		Transactions: []*Transaction{},
+		Writes:       []*Write{},
+		Reads:        []*Read{},
+		Configs:      []*Config{},
+		Events:       []*Event{},
+	}
+
+	records.Block.Signatures, records.Block.LastConfigIndex, records.Block.CommitHash = blockMetadata(block)
+
+	for txIndex, txData := range block.Data.Data {
+		validationCode, isValid := ledgerutils.GetTxValidationCode(txsFltr, txIndex)
+		if isValid {
+			records.Block.ValidTxCount++
+		} else {
+			records.Block.InvalidTxCount++
+		}
+		header := TxHeader{
+			ChannelId:      channelId,
+			BlockNumber:    block.Header.Number,
+			TxIndex:        txIndex,
+			CreatedAt:      createdAt,
+			TxType:         typeInfo,
+			ValidationCode: validationCode,
+			IsValid:        isValid,
+		}
+
+		if typeInfo != EndorserTransaction {
+			err = t.transformTx(records, header, txData, source)
+		} else {
+			err = t.transformEndorserTx(records, header, txData, privateData[uint64(txIndex)])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// Transforms a non-endorser (e.g. config) transaction.
+func (t *Transformer) transformTx(records *Records, header TxHeader, txData []byte, source blocksource.BlockSource) error {
+	txId, _, creator, creatorOrg, _, err := ledgerutils.ProcessTx(txData)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	header.TxId, header.Creator, header.CreatorOrg = txId, creator, creatorOrg
+	addBlockTx(records, header)
+	records.Transactions = append(records.Transactions, &Transaction{TxHeader: header})
+
+	if (header.TxType == "CONFIG" || header.TxType == "CONFIG_UPDATE") && header.IsValid {
+		channelConfig, err := configutils.ProcessConfigTx(txData)
+		if err != nil {
+			return retry.Permanent(err)
+		}
+		t.mutex.Lock()
+		previousConfig, ok := t.lastConfigs[header.ChannelId]
+		t.mutex.Unlock()
+		if !ok && source != nil {
+			previousConfig, err = ledgerutils.GetPreviousConfig(header.BlockNumber, source)
+			if err != nil {
+				return err
+			}
+		}
+		records.Configs = append(records.Configs, &Config{
+			TxHeader: header,
+			Config:   channelConfig,
+			Changes:  configutils.DiffConfig(previousConfig, channelConfig),
+			Signers:  channelConfig.Signers,
+		})
+
+		// A config update contains only the modified groups, so only complete configs are kept for the next comparison
+		if header.TxType == "CONFIG" {
+			t.mutex.Lock()
+			t.lastConfigs[header.ChannelId] = channelConfig
+			t.mutex.Unlock()
+		}
+	}
+	return nil
+}
+
+// Transforms an endorser transaction, one transaction record per action.
+func (t *Transformer) transformEndorserTx(records *Records, header TxHeader, txData []byte, txPvtRwSet *rwset.TxPvtReadWriteSet) error {
+	txId, _, creator, creatorOrg, actions, err := ledgerutils.ProcessEndorserTx(txData)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	header.TxId, header.Creator, header.CreatorOrg = txId, creator, creatorOrg
+	addBlockTx(records, header)
+	records.Block.Transactions = append(records.Block.Transactions, txId)
+
+	// Every action of the transaction has its own read-write set, chaincode and endorsements
+	for _, action := range actions {
+		tx := &Transaction{
+			TxHeader:         header,
+			ActionIndex:      action.Index,
+			ActionCount:      len(actions),
+			ChaincodeName:    action.ChaincodeName,
+			ChaincodeVersion: action.ChaincodeVersion,
+			Readset:          []*fabricutils.Readset{},
+			Writeset:         []*fabricutils.Writeset{},
+			RangeQueries:     []*fabricutils.RangeQuery{},
+			MetadataWrites:   []*fabricutils.MetadataWrite{},
+			PrivateWriteset:  []*fabricutils.HashedWrite{},
+			Endorsers:        action.Endorsers,
+			EndorserOrgs:     fabricutils.EndorserOrgs(action.Endorsers),
+			EndorsementCount: len(action.Endorsers),
+			Function:         action.Function,
+			Args:             fabricutils.FormatArgs(action.Args, t.options.MaxArgSize, fabricutils.RedactedArgsOfChaincode(t.options.Chaincodes, action.ChaincodeName)),
+			ResponseStatus:   action.ResponseStatus,
+			ResponseMessage:  action.ResponseMessage,
+			ResponsePayload:  fabricutils.FormatResponsePayload(action.ResponsePayload, t.options.MaxResponseSize),
+		}
+		// Writes of invalid transactions never reached the world state, no write records are created for them if configured so
+		createWrites := header.IsValid || !t.options.SkipInvalidWrites
+		var valueWriteIndex, metadataWriteIndex, privateWriteIndex int
+
+		for _, ns := range action.TxRWSet.NsRwSets {
+			// Getting the writes
+			for _, w := range ns.KvRwSet.Writes {
+				writeset := &fabricutils.Writeset{
+					Namespace: ns.NameSpace,
+					Key:       w.Key,
+					IsDelete:  w.IsDelete,
+				}
+				tx.Writeset = append(tx.Writeset, writeset)
+
+				var valueDecoder string
+				var decodeError string
+				writeset.Value, valueDecoder, err = valuedecoders.Decode(t.options.Decoders, action.ChaincodeName, w.Value)
+				if err != nil {
+					decodeError = err.Error()
+				}
+				// A linking key that cannot be read is recorded like a value that cannot be decoded
+				linkingKey, err := t.linkingKey(action.ChaincodeName, w.Value)
+				if err != nil && decodeError == "" {
+					decodeError = err.Error()
+				}
+
+				if createWrites {
+					records.Writes = append(records.Writes, &Write{
+						TxHeader:         header,
+						ActionIndex:      action.Index,
+						WriteIndex:       valueWriteIndex,
+						WriteType:        WriteTypeValue,
+						Namespace:        ns.NameSpace,
+						ChaincodeName:    action.ChaincodeName,
+						ChaincodeVersion: action.ChaincodeVersion,
+						Write:            writeset,
+						Key:              w.Key,
+						IsDelete:         w.IsDelete,
+						LinkingKey:       linkingKey,
+						Value:            writeset.Value,
+						ValueDecoder:     valueDecoder,
+						DecodeError:      decodeError,
+					})
+				}
+				valueWriteIndex++
+			}
+
+			// Getting the metadata writes (e.g. key-level endorsement policies)
+			for _, mw := range ns.KvRwSet.MetadataWrites {
+				metadataWrite := ledgerutils.ProcessMetadataWrite(ns.NameSpace, mw)
+				tx.MetadataWrites = append(tx.MetadataWrites, metadataWrite)
+
+				if createWrites {
+					records.Writes = append(records.Writes, &Write{
+						TxHeader:         header,
+						ActionIndex:      action.Index,
+						WriteIndex:       metadataWriteIndex,
+						WriteType:        WriteTypeMetadata,
+						Namespace:        ns.NameSpace,
+						ChaincodeName:    action.ChaincodeName,
+						ChaincodeVersion: action.ChaincodeVersion,
+						Key:              mw.Key,
+						Metadata:         metadataWrite.Entries,
+					})
+				}
+				metadataWriteIndex++
+			}
+
+			// Getting the reads with the version of the key that was read
+			for _, r := range ns.KvRwSet.Reads {
+				readset := ledgerutils.ProcessRead(ns.NameSpace, r)
+				tx.Readset = append(tx.Readset, readset)
+				records.Reads = append(records.Reads, &Read{
+					TxHeader:      header,
+					ActionIndex:   action.Index,
+					ReadIndex:     len(tx.Readset) - 1,
+					Namespace:     ns.NameSpace,
+					ChaincodeName: action.ChaincodeName,
+					Key:           r.Key,
+					Version:       readset.Version,
+				})
+			}
+
+			// Getting the range queries
+			for _, rq := range ns.KvRwSet.RangeQueriesInfo {
+				tx.RangeQueries = append(tx.RangeQueries, ledgerutils.ProcessRangeQuery(ns.NameSpace, rq))
+			}
+
+			// Getting the writes of the private data collections, with the cleartext if available
+			for _, hashedWrite := range ledgerutils.ProcessHashedWrites(ns, txPvtRwSet) {
+				tx.PrivateWriteset = append(tx.PrivateWriteset, hashedWrite)
+
+				if createWrites {
+					records.Writes = append(records.Writes, &Write{
+						TxHeader:         header,
+						ActionIndex:      action.Index,
+						WriteIndex:       privateWriteIndex,
+						WriteType:        WriteTypePrivate,
+						Namespace:        ns.NameSpace,
+						ChaincodeName:    action.ChaincodeName,
+						ChaincodeVersion: action.ChaincodeVersion,
+						Write:            hashedWrite,
+						Collection:       hashedWrite.Collection,
+						KeyHash:          hashedWrite.KeyHash,
+						ValueHash:        hashedWrite.ValueHash,
+						Key:              hashedWrite.Key,
+						IsDelete:         hashedWrite.IsDelete,
+						Value:            hashedWrite.Value,
+					})
+				}
+				privateWriteIndex++
+			}
+		}
+		tx.Collections = fabricutils.CollectionsOfHashedWrites(tx.PrivateWriteset)
+		records.Transactions = append(records.Transactions, tx)
+
+		// The chaincode can set at most one event per action
+		if action.ChaincodeEvent != nil {
+			records.Events = append(records.Events, &Event{
+				TxHeader:      header,
+				ActionIndex:   action.Index,
+				ChaincodeName: action.ChaincodeEvent.ChaincodeId,
+				EventName:     action.ChaincodeEvent.EventName,
+				Payload:       fabricutils.DecodePayload(action.ChaincodeEvent.Payload),
+			})
+		}
+	}
+	return nil
+}
+
+// Returns the value of the top level field of a JSON value set as the linking key of the chaincode,
+// or an empty string if the chaincode has no linking key or the value does not contain it.
+func (t *Transformer) linkingKey(chaincodeName string, value []byte) (string, error) {
+	ccIndex := fabricutils.IndexOfChaincode(t.options.Chaincodes, chaincodeName)
+	if ccIndex < 0 || t.options.Chaincodes[ccIndex].Linkingkey == "" {
+		return "", nil
+	}
+	linkingKey := t.options.Chaincodes[ccIndex].Linkingkey
+
+	// With this map, we can obtain the top level fields of the value.
+	var valueMap map[string]interface{}
+	err := json.Unmarshal(value, &valueMap)
+	if err != nil || valueMap[linkingKey] == nil {
+		return "", nil
+	}
+	str, ok := valueMap[linkingKey].(string)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Linking key %s is not a string", linkingKey))
+	}
+	return str, nil
+}
+
+// Adds a transaction to the transaction list of the block record.
+func addBlockTx(records *Records, header TxHeader) {
+	records.Block.Txs = append(records.Block.Txs, &BlockTx{
+		TxIndex:        header.TxIndex,
+		TxId:           header.TxId,
+		TxType:         header.TxType,
+		ValidationCode: header.ValidationCode,
+	})
+}
+
+// Index of the commit hash in the block metadata (common.BlockMetadataIndex_COMMIT_HASH in the protos of Fabric 2.0+)
+const commitHashMetadataIndex = 4
+
+// Returns the signatures, the last config index and the commit hash (hex encoded) of the block metadata.
+// Metadata that is missing or cannot be decoded is left empty, it does not make the block invalid.
+func blockMetadata(block *common.Block) (signatures []*BlockSignature, lastConfigIndex uint64, commitHash string) {
+	signatures = []*BlockSignature{}
+	metadata, err := protoutil.GetMetadataFromBlock(block, common.BlockMetadataIndex_SIGNATURES)
+	if err == nil {
+		for _, metadataSignature := range metadata.Signatures {
+			signatureHeader := &common.SignatureHeader{}
+			err = proto.Unmarshal(metadataSignature.SignatureHeader, signatureHeader)
+			if err != nil {
+				continue
+			}
+			signer := fabricutils.ProcessEndorsements([]*peer.Endorsement{{Endorser: signatureHeader.Creator}})[0]
+			signatures = append(signatures, &BlockSignature{Endorser: *signer, Signature: hex.EncodeToString(metadataSignature.Signature)})
+		}
+	}
+
+	// Stored in the SIGNATURES metadata since Fabric 2.0, and in the LAST_CONFIG metadata before
+	lastConfigIndex, _ = protoutil.GetLastConfigIndexFromBlock(block)
+
+	if block.Metadata != nil && len(block.Metadata.Metadata) > commitHashMetadataIndex && len(block.Metadata.Metadata[commitHashMetadataIndex]) > 0 {
+		commitHashMetadata := &common.Metadata{}
+		err = proto.Unmarshal(block.Metadata.Metadata[commitHashMetadataIndex], commitHashMetadata)
+		if err == nil {
+			commitHash = hex.EncodeToString(commitHashMetadata.Value)
+		}
+	}
+	return signatures, lastConfigIndex, commitHash
+}
@@ -0,0 +1,442 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/orderer"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric/protoutil"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/blocktest"
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricsetup"
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/retry"
+	"github.com/blockchain-analyzer/agent/agentmodules/valuedecoders"
+)
+
+var fabcar = []fabricsetup.Chaincode{{Name: "fabcar", Linkingkey: "owner"}}
+
+func newTestTransformer(t *testing.T, options Options) *Transformer {
+	decoders, err := valuedecoders.ForChaincodes(options.Chaincodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.Decoders = decoders
+	return New(options)
+}
+
+// A channel configuration with the given batch timeout
+func newTestConfig(sequence uint64, batchTimeout string) *common.Config {
+	return &common.Config{
+		Sequence: sequence,
+		ChannelGroup: &common.ConfigGroup{
+			Values: map[string]*common.ConfigValue{
+				"BatchTimeout": {Value: protoutil.MarshalOrPanic(&orderer.BatchTimeout{Timeout: batchTimeout})},
+			},
+		},
+	}
+}
+
+func TestTransform(t *testing.T) {
+	createCar := &blocktest.Tx{
+		Chaincode: "fabcar",
+		Version:   "1.0",
+		Function:  "createCar",
+		Args:      []string{"CAR1", "Toyota"},
+		Reads:     []*kvrwset.KVRead{{Key: "CAR1", Version: &kvrwset.Version{BlockNum: 1, TxNum: 2}}},
+		Writes:    []*kvrwset.KVWrite{{Key: "CAR1", Value: []byte(`{"make":"Toyota","owner":"Tom"}`)}},
+		Event:     &peer.ChaincodeEvent{ChaincodeId: "fabcar", EventName: "created", Payload: []byte(`{"car":"CAR1"}`)},
+	}
+	changeCarOwner := &blocktest.Tx{
+		Chaincode:      "fabcar",
+		Version:        "1.0",
+		Function:       "changeCarOwner",
+		Args:           []string{"CAR1", "Dave"},
+		Writes:         []*kvrwset.KVWrite{{Key: "CAR1", Value: []byte(`{"make":"Toyota","owner":"Dave"}`)}},
+		ValidationCode: peer.TxValidationCode_MVCC_READ_CONFLICT,
+	}
+	setEndorsementPolicy := &blocktest.Tx{
+		Chaincode: "fabcar",
+		Version:   "1.0",
+		Function:  "setEndorsementPolicy",
+		Args:      []string{"CAR1"},
+		Writes: []*kvrwset.KVWrite{
+			{Key: "CAR2", Value: []byte(`{"owner":"Anna"}`)},
+			{Key: "CAR3", IsDelete: true},
+		},
+		MetadataWrites: []*kvrwset.KVMetadataWrite{{
+			Key:     "CAR1",
+			Entries: []*kvrwset.KVMetadataEntry{{Name: "custom", Value: []byte("value")}},
+		}},
+	}
+	numericOwner := &blocktest.Tx{
+		Chaincode: "fabcar",
+		Function:  "createCar",
+		Writes:    []*kvrwset.KVWrite{{Key: "CAR4", Value: []byte(`{"owner":42}`)}},
+	}
+
+	tests := []struct {
+		name              string
+		txs               []*blocktest.Tx
+		skipInvalidWrites bool
+		corruptData       bool
+		expectError       bool
+		validTxCount      int
+		invalidTxCount    int
+		transactions      int
+		writes            []string
+		reads             []string
+		events            []string
+	}{
+		{
+			name:         "valid transaction",
+			txs:          []*blocktest.Tx{createCar},
+			validTxCount: 1,
+			transactions: 1,
+			writes:       []string{"mychannel-1-0-0-w0"},
+			reads:        []string{"mychannel-1-0-0-r0"},
+			events:       []string{"mychannel-1-0-0"},
+		},
+		{
+			name:           "valid and invalid transaction",
+			txs:            []*blocktest.Tx{createCar, changeCarOwner},
+			validTxCount:   1,
+			invalidTxCount: 1,
+			transactions:   2,
+			writes:         []string{"mychannel-1-0-0-w0", "mychannel-1-1-0-w0"},
+			reads:          []string{"mychannel-1-0-0-r0"},
+			events:         []string{"mychannel-1-0-0"},
+		},
+		{
+			name:              "writes of invalid transactions skipped",
+			txs:               []*blocktest.Tx{createCar, changeCarOwner},
+			skipInvalidWrites: true,
+			validTxCount:      1,
+			invalidTxCount:    1,
+			transactions:      2,
+			writes:            []string{"mychannel-1-0-0-w0"},
+			reads:             []string{"mychannel-1-0-0-r0"},
+			events:            []string{"mychannel-1-0-0"},
+		},
+		{
+			name:         "value and metadata writes",
+			txs:          []*blocktest.Tx{setEndorsementPolicy},
+			validTxCount: 1,
+			transactions: 1,
+			writes:       []string{"mychannel-1-0-0-w0", "mychannel-1-0-0-w1", "mychannel-1-0-0-m0"},
+		},
+		{
+			name:         "linking key is not a string",
+			txs:          []*blocktest.Tx{numericOwner},
+			validTxCount: 1,
+			transactions: 1,
+			writes:       []string{"mychannel-1-0-0-w0"},
+		},
+		{
+			name:        "undecodable transaction",
+			txs:         []*blocktest.Tx{createCar},
+			corruptData: true,
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain := blocktest.NewChain("mychannel")
+			chain.AddConfigBlock(newTestConfig(1, "2s"))
+			block := chain.AddBlock(test.txs...)
+			if test.corruptData {
+				block.Data.Data[0] = []byte("not an envelope")
+			}
+			transformer := newTestTransformer(t, Options{Chaincodes: fabcar, SkipInvalidWrites: test.skipInvalidWrites})
+
+			records, err := transformer.Transform(block, nil, nil)
+			if test.expectError {
+				if err == nil {
+					t.Fatal("no error for an invalid block")
+				}
+				// Decoding the block again would fail the same way
+				if !retry.IsPermanent(err) {
+					t.Errorf("error %q is not permanent", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedHash := fabricutils.GenerateBlockHash(block.Header.PreviousHash, block.Header.DataHash, block.Header.Number)
+			if records.Block.BlockHash != expectedHash || records.Block.ID() != "mychannel-1" {
+				t.Errorf("block %s has hash %s instead of %s", records.Block.ID(), records.Block.BlockHash, expectedHash)
+			}
+			if records.Block.ValidTxCount != test.validTxCount || records.Block.InvalidTxCount != test.invalidTxCount {
+				t.Errorf("valid/invalid transaction count is %d/%d instead of %d/%d", records.Block.ValidTxCount, records.Block.InvalidTxCount, test.validTxCount, test.invalidTxCount)
+			}
+			if len(records.Block.Transactions) != len(test.txs) {
+				t.Errorf("block has %d transactions instead of %d", len(records.Block.Transactions), len(test.txs))
+			}
+			if len(records.Transactions) != test.transactions {
+				t.Errorf("%d transaction records instead of %d", len(records.Transactions), test.transactions)
+			}
+			if len(records.Configs) != 0 {
+				t.Errorf("%d config records instead of 0", len(records.Configs))
+			}
+
+			writeIds := []string{}
+			for _, write := range records.Writes {
+				writeIds = append(writeIds, write.ID())
+			}
+			expectIds(t, "write", writeIds, test.writes)
+			readIds := []string{}
+			for _, read := range records.Reads {
+				readIds = append(readIds, read.ID())
+			}
+			expectIds(t, "read", readIds, test.reads)
+			eventIds := []string{}
+			for _, event := range records.Events {
+				eventIds = append(eventIds, event.ID())
+			}
+			expectIds(t, "event", eventIds, test.events)
+		})
+	}
+}
+
+func expectIds(t *testing.T, recordType string, ids, expected []string) {
+	if len(ids) != len(expected) {
+		t.Errorf("%s records %v instead of %v", recordType, ids, expected)
+		return
+	}
+	for i := range ids {
+		if ids[i] != expected[i] {
+			t.Errorf("%s records %v instead of %v", recordType, ids, expected)
+			return
+		}
+	}
+}
+
+func TestTransformRecordFields(t *testing.T) {
+	chain := blocktest.NewChain("mychannel")
+	chain.AddConfigBlock(newTestConfig(1, "2s"))
+	block := chain.AddBlock(
+		&blocktest.Tx{
+			MSPID:     "Org2MSP",
+			Chaincode: "fabcar",
+			Version:   "1.0",
+			Function:  "createCar",
+			Args:      []string{"CAR1"},
+			Reads:     []*kvrwset.KVRead{{Key: "CAR1", Version: &kvrwset.Version{BlockNum: 1, TxNum: 2}}},
+			Writes:    []*kvrwset.KVWrite{{Key: "CAR1", Value: []byte(`{"owner":"Tom"}`)}},
+			MetadataWrites: []*kvrwset.KVMetadataWrite{{
+				Key:     "CAR1",
+				Entries: []*kvrwset.KVMetadataEntry{{Name: "custom", Value: []byte("value")}},
+			}},
+			Event: &peer.ChaincodeEvent{ChaincodeId: "fabcar", EventName: "created", Payload: []byte(`{"car":"CAR1"}`)},
+		},
+	)
+	records, err := newTestTransformer(t, Options{Chaincodes: fabcar}).Transform(block, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := records.Transactions[0]
+	if !tx.IsEndorserTx() || tx.ID() != "mychannel-1-0-0" || tx.TxId != "tx-1-0" {
+		t.Errorf("unexpected transaction %s (ID: %s, type: %s)", tx.TxId, tx.ID(), tx.TxType)
+	}
+	if tx.CreatorOrg != "Org2MSP" || tx.ChaincodeName != "fabcar" || tx.ChaincodeVersion != "1.0" || tx.Function != "createCar" {
+		t.Errorf("unexpected creator org %s, chaincode %s:%s or function %s", tx.CreatorOrg, tx.ChaincodeName, tx.ChaincodeVersion, tx.Function)
+	}
+	if len(tx.Readset) != 1 || len(tx.Writeset) != 1 || len(tx.MetadataWrites) != 1 || tx.EndorsementCount != 1 {
+		t.Errorf("transaction has %d reads, %d writes, %d metadata writes and %d endorsements instead of 1 each", len(tx.Readset), len(tx.Writeset), len(tx.MetadataWrites), tx.EndorsementCount)
+	}
+
+	tests := []struct {
+		writeType    string
+		key          string
+		linkingKey   string
+		valueDecoder string
+		metadata     int
+	}{
+		{WriteTypeValue, "CAR1", "Tom", valuedecoders.DefaultDecoder, 0},
+		{WriteTypeMetadata, "CAR1", "", "", 1},
+	}
+	if len(records.Writes) != len(tests) {
+		t.Fatalf("%d write records instead of %d", len(records.Writes), len(tests))
+	}
+	for i, test := range tests {
+		write := records.Writes[i]
+		if write.WriteType != test.writeType || write.Key != test.key || write.TxId != "tx-1-0" || write.CreatorOrg != "Org2MSP" {
+			t.Errorf("write %d: unexpected %s write of key %s in transaction %s", i, write.WriteType, write.Key, write.TxId)
+		}
+		if write.LinkingKey != test.linkingKey || write.ValueDecoder != test.valueDecoder || write.DecodeError != "" {
+			t.Errorf("write %d: linking key is %q and value decoder is %q (error: %q) instead of %q and %q", i, write.LinkingKey, write.ValueDecoder, write.DecodeError, test.linkingKey, test.valueDecoder)
+		}
+		if len(write.Metadata) != test.metadata {
+			t.Errorf("write %d: %d metadata entries instead of %d", i, len(write.Metadata), test.metadata)
+		}
+	}
+
+	read := records.Reads[0]
+	if read.Key != "CAR1" || read.Version == nil || read.Version.BlockNum != 1 || read.Version.TxNum != 2 {
+		t.Errorf("unexpected read of key %s with version %+v", read.Key, read.Version)
+	}
+	event := records.Events[0]
+	if event.EventName != "created" || event.ChaincodeName != "fabcar" || event.TxId != "tx-1-0" {
+		t.Errorf("unexpected event %s of chaincode %s in transaction %s", event.EventName, event.ChaincodeName, event.TxId)
+	}
+}
+
+func TestTransformLinkingKeyError(t *testing.T) {
+	chain := blocktest.NewChain("mychannel")
+	block := chain.AddBlock(&blocktest.Tx{
+		Chaincode: "fabcar",
+		Function:  "createCar",
+		Writes: []*kvrwset.KVWrite{
+			{Key: "CAR4", Value: []byte(`{"owner":42}`)},
+			{Key: "CAR5", Value: []byte(`{"owner":"Anna"}`)},
+		},
+	})
+	records, err := newTestTransformer(t, Options{Chaincodes: fabcar}).Transform(block, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records.Writes) != 2 {
+		t.Fatalf("%d write records instead of 2", len(records.Writes))
+	}
+	// The write is kept with the decoded value, only the linking key is missing
+	write := records.Writes[0]
+	if write.LinkingKey != "" || write.DecodeError == "" || write.Value == nil {
+		t.Errorf("write of key %s has linking key %q, decode error %q and value %v", write.Key, write.LinkingKey, write.DecodeError, write.Value)
+	}
+	write = records.Writes[1]
+	if write.LinkingKey != "Anna" || write.DecodeError != "" {
+		t.Errorf("write of key %s has linking key %q and decode error %q", write.Key, write.LinkingKey, write.DecodeError)
+	}
+}
+
+func TestTransformBlockMetadata(t *testing.T) {
+	chain := blocktest.NewChain("mychannel")
+	chain.AddConfigBlock(newTestConfig(1, "2s"))
+	chain.AddBlock(&blocktest.Tx{Chaincode: "fabcar", Version: "1.0", Function: "createCar"})
+	chain.AddConfigBlock(newTestConfig(2, "1s"))
+	block := chain.AddBlock(
+		&blocktest.Tx{Chaincode: "fabcar", Version: "1.0", Function: "createCar", Args: []string{"CAR1"}},
+		&blocktest.Tx{Chaincode: "fabcar", Version: "1.0", Function: "createCar", Args: []string{"CAR2"}, ValidationCode: peer.TxValidationCode_MVCC_READ_CONFLICT},
+	)
+	// Orderer signature and commit hash, as set by a Fabric 2.0 orderer and peer
+	signatures := &common.Metadata{}
+	err := proto.Unmarshal(block.Metadata.Metadata[common.BlockMetadataIndex_SIGNATURES], signatures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatures.Signatures = []*common.MetadataSignature{{
+		SignatureHeader: protoutil.MarshalOrPanic(&common.SignatureHeader{Creator: protoutil.MarshalOrPanic(&msp.SerializedIdentity{Mspid: "OrdererMSP"})}),
+		Signature:       []byte{0x01, 0x02},
+	}}
+	block.Metadata.Metadata[common.BlockMetadataIndex_SIGNATURES] = protoutil.MarshalOrPanic(signatures)
+	for len(block.Metadata.Metadata) <= commitHashMetadataIndex {
+		block.Metadata.Metadata = append(block.Metadata.Metadata, nil)
+	}
+	block.Metadata.Metadata[commitHashMetadataIndex] = protoutil.MarshalOrPanic(&common.Metadata{Value: []byte{0xab, 0xcd}})
+
+	records, err := newTestTransformer(t, Options{Chaincodes: fabcar}).Transform(block, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		txId           string
+		validationCode string
+	}{
+		{"tx-3-0", peer.TxValidationCode_VALID.String()},
+		{"tx-3-1", peer.TxValidationCode_MVCC_READ_CONFLICT.String()},
+	}
+	if len(records.Block.Txs) != len(tests) {
+		t.Fatalf("block has %d transactions instead of %d", len(records.Block.Txs), len(tests))
+	}
+	for i, test := range tests {
+		tx := records.Block.Txs[i]
+		if tx.TxIndex != i || tx.TxId != test.txId || tx.TxType != EndorserTransaction || tx.ValidationCode != test.validationCode {
+			t.Errorf("transaction %d: unexpected %s transaction %s at index %d with validation code %s", i, tx.TxType, tx.TxId, tx.TxIndex, tx.ValidationCode)
+		}
+	}
+
+	if records.Block.LastConfigIndex != 2 {
+		t.Errorf("last config index is %d instead of 2", records.Block.LastConfigIndex)
+	}
+	if len(records.Block.Signatures) != 1 || records.Block.Signatures[0].MSPID != "OrdererMSP" || records.Block.Signatures[0].Signature != "0102" {
+		t.Errorf("unexpected block signatures %+v", records.Block.Signatures)
+	}
+	if records.Block.CommitHash != "abcd" {
+		t.Errorf("commit hash is %q instead of %q", records.Block.CommitHash, "abcd")
+	}
+
+	// Blocks without signatures or commit hash
+	records, err = newTestTransformer(t, Options{Chaincodes: fabcar}).Transform(chain.AddBlock(&blocktest.Tx{Chaincode: "fabcar", Version: "1.0", Function: "createCar"}), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records.Block.Signatures) != 0 || records.Block.CommitHash != "" || len(records.Block.Txs) != 1 {
+		t.Errorf("unexpected signatures %+v, commit hash %q or %d transactions", records.Block.Signatures, records.Block.CommitHash, len(records.Block.Txs))
+	}
+}
+
+func TestTransformConfig(t *testing.T) {
+	chain := blocktest.NewChain("mychannel")
+	chain.AddConfigBlock(newTestConfig(1, "2s"))
+	chain.AddBlock(&blocktest.Tx{Chaincode: "fabcar", Function: "initLedger"})
+	chain.AddConfigBlock(newTestConfig(2, "5s"))
+	chain.AddConfigBlock(newTestConfig(3, "5s"))
+	source, err := blocksource.NewMemorySource(chain.Blocks...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		blocks      []uint64
+		source      blocksource.BlockSource
+		lastChanges []string
+	}{
+		// Every setting of the genesis config is new
+		{"genesis block", []uint64{0}, nil, []string{"batchTimeout added", "ordererAddresses added"}},
+		{"compared to the previous config block", []uint64{0, 1, 2}, nil, []string{"batchTimeout modified"}},
+		{"previous config read from the source", []uint64{2}, source, []string{"batchTimeout modified"}},
+		{"no previous config without source", []uint64{2}, nil, []string{"batchTimeout added", "ordererAddresses added"}},
+		{"unchanged config", []uint64{2, 3}, nil, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transformer := newTestTransformer(t, Options{Chaincodes: fabcar})
+			var records *Records
+			for _, blockNumber := range test.blocks {
+				records, err = transformer.Transform(chain.Blocks[blockNumber], test.source, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			lastBlockNumber := test.blocks[len(test.blocks)-1]
+			if len(records.Configs) != 1 || len(records.Transactions) != 1 {
+				t.Fatalf("%d config and %d transaction records instead of 1", len(records.Configs), len(records.Transactions))
+			}
+			config := records.Configs[0]
+			if config.TxType != "CONFIG" || config.Config.ChannelId != "mychannel" || config.BlockNumber != lastBlockNumber {
+				t.Errorf("unexpected %s record of channel %s in block %d", config.TxType, config.Config.ChannelId, config.BlockNumber)
+			}
+			if records.Transactions[0].IsEndorserTx() || records.Transactions[0].ID() != config.ID() {
+				t.Errorf("transaction record %s does not match config record %s", records.Transactions[0].ID(), config.ID())
+			}
+			changes := []string{}
+			for _, change := range config.Changes {
+				changes = append(changes, change.Path+" "+change.Operation)
+			}
+			expectIds(t, "config change", changes, test.lastChanges)
+		})
+	}
+}
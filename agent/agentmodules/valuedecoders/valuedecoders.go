@@ -0,0 +1,179 @@
+package valuedecoders
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"unicode/utf8"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricsetup"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// Name of the decoder used for chaincodes without a configured decoder
+const DefaultDecoder = "json"
+
+// Decoder of the values written to the world state by a chaincode
+type Decoder interface {
+	Name() string
+	Decode(value []byte) (interface{}, error)
+}
+
+// Creates a decoder from the configuration of a chaincode
+type Factory func(chaincode fabricsetup.Chaincode) (Decoder, error)
+
+var factories = map[string]Factory{}
+
+// Registers a decoder factory under the given name, which can be referenced by the decoder setting of the chaincodes.
+func Register(name string, factory Factory) {
+	factories[name] = factory
+}
+
+func init() {
+	Register("json", func(fabricsetup.Chaincode) (Decoder, error) { return &simpleDecoder{"json", decodeJSON}, nil })
+	Register("utf8", func(fabricsetup.Chaincode) (Decoder, error) { return &simpleDecoder{"utf8", decodeUTF8}, nil })
+	Register("base64", func(fabricsetup.Chaincode) (Decoder, error) { return &simpleDecoder{"base64", decodeBase64}, nil })
+	Register("hex", func(fabricsetup.Chaincode) (Decoder, error) { return &simpleDecoder{"hex", decodeHex}, nil })
+	Register("varint", func(fabricsetup.Chaincode) (Decoder, error) { return &simpleDecoder{"varint", decodeVarint}, nil })
+	Register("protobuf", newProtobufDecoder)
+}
+
+// Creates the decoders of the configured chaincodes, keyed by chaincode name.
+func ForChaincodes(chaincodes []fabricsetup.Chaincode) (map[string]Decoder, error) {
+	decoders := map[string]Decoder{}
+	for _, chaincode := range chaincodes {
+		name := chaincode.Decoder
+		if name == "" {
+			name = DefaultDecoder
+		}
+		factory, ok := factories[name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown value decoder %s for chaincode %s", name, chaincode.Name))
+		}
+		decoder, err := factory(chaincode)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error creating value decoder %s for chaincode %s: %s", name, chaincode.Name, err.Error()))
+		}
+		decoders[chaincode.Name] = decoder
+	}
+	return decoders, nil
+}
+
+// Decodes a value written by the given chaincode with its decoder, or with the default decoder if the chaincode is not configured.
+// Returns the decoded value and the name of the decoder.
+func Decode(decoders map[string]Decoder, chaincodeName string, value []byte) (interface{}, string, error) {
+	decoder, ok := decoders[chaincodeName]
+	if !ok {
+		decoder = &simpleDecoder{DefaultDecoder, decodeJSON}
+	}
+	decoded, err := decoder.Decode(value)
+	return decoded, decoder.Name(), err
+}
+
+type simpleDecoder struct {
+	name   string
+	decode func(value []byte) (interface{}, error)
+}
+
+func (decoder *simpleDecoder) Name() string {
+	return decoder.name
+}
+
+func (decoder *simpleDecoder) Decode(value []byte) (interface{}, error) {
+	return decoder.decode(value)
+}
+
+func decodeJSON(value []byte) (interface{}, error) {
+	var decoded interface{}
+	err := json.Unmarshal(value, &decoded)
+	if err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+func decodeUTF8(value []byte) (interface{}, error) {
+	if !utf8.Valid(value) {
+		return nil, errors.New("Value is not valid UTF-8")
+	}
+	return string(value), nil
+}
+
+func decodeBase64(value []byte) (interface{}, error) {
+	return base64.StdEncoding.EncodeToString(value), nil
+}
+
+func decodeHex(value []byte) (interface{}, error) {
+	return hex.EncodeToString(value), nil
+}
+
+// Decodes a signed (zigzag) varint as written by binary.PutVarint. The value may be padded with zero bytes
+// (e.g. the sacc chaincode writes a buffer of binary.MaxVarintLen64 bytes).
+func decodeVarint(value []byte) (interface{}, error) {
+	decoded, n := binary.Varint(value)
+	if n <= 0 {
+		return nil, errors.New("Value is not a varint")
+	}
+	for _, b := range value[n:] {
+		if b != 0 {
+			return nil, errors.New("Value contains data after the varint")
+		}
+	}
+	return decoded, nil
+}
+
+// Decodes protobuf messages of the type set by protoMessage, described by the descriptor set file protoDescriptorSet
+// (generated with protoc --include_imports --descriptor_set_out).
+type protobufDecoder struct {
+	messageDescriptor *desc.MessageDescriptor
+}
+
+func newProtobufDecoder(chaincode fabricsetup.Chaincode) (Decoder, error) {
+	if chaincode.ProtoDescriptorSet == "" || chaincode.ProtoMessage == "" {
+		return nil, errors.New("protoDescriptorSet and protoMessage have to be set for the protobuf decoder")
+	}
+	data, err := ioutil.ReadFile(chaincode.ProtoDescriptorSet)
+	if err != nil {
+		return nil, err
+	}
+	descriptorSet := &descriptor.FileDescriptorSet{}
+	err = proto.Unmarshal(data, descriptorSet)
+	if err != nil {
+		return nil, err
+	}
+	files, err := desc.CreateFileDescriptorsFromSet(descriptorSet)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if messageDescriptor := file.FindMessage(chaincode.ProtoMessage); messageDescriptor != nil {
+			return &protobufDecoder{messageDescriptor: messageDescriptor}, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Message %s not found in %s", chaincode.ProtoMessage, chaincode.ProtoDescriptorSet))
+}
+
+func (decoder *protobufDecoder) Name() string {
+	return "protobuf"
+}
+
+func (decoder *protobufDecoder) Decode(value []byte) (interface{}, error) {
+	message := dynamic.NewMessage(decoder.messageDescriptor)
+	err := message.Unmarshal(value)
+	if err != nil {
+		return nil, err
+	}
+	jsonValue, err := message.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(jsonValue)
+}
@@ -0,0 +1,175 @@
+package valuedecoders
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricsetup"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// A varint as written by the sacc chaincode: binary.PutVarint into a buffer of binary.MaxVarintLen64 bytes
+func saccValue(value int64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	binary.PutVarint(buffer, value)
+	return buffer
+}
+
+func TestSimpleDecoders(t *testing.T) {
+	tests := []struct {
+		decoder     string
+		value       []byte
+		expected    interface{}
+		expectError bool
+	}{
+		{"json", []byte(`{"owner":"Tom"}`), map[string]interface{}{"owner": "Tom"}, false},
+		{"json", []byte(`not json`), nil, true},
+		{"utf8", []byte("héllo"), "héllo", false},
+		{"utf8", []byte{0xff, 0xfe}, nil, true},
+		{"base64", []byte{0xff, 0x00, 0x01}, "/wAB", false},
+		{"base64", []byte{}, "", false},
+		{"hex", []byte{0xff, 0x00, 0x01}, "ff0001", false},
+		{"varint", saccValue(150), int64(150), false},
+		{"varint", saccValue(-3), int64(-3), false},
+		{"varint", []byte{0x04}, int64(2), false},
+		{"varint", append(saccValue(150), 0x01), nil, true},
+		{"varint", []byte{0x04, 0x00, 0x07}, nil, true},
+		{"varint", []byte{}, nil, true},
+		{"varint", []byte{0x80}, nil, true},
+	}
+	for _, test := range tests {
+		decoders, err := ForChaincodes([]fabricsetup.Chaincode{{Name: "mycc", Decoder: test.decoder}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, decoderName, err := Decode(decoders, "mycc", test.value)
+		if decoderName != test.decoder {
+			t.Errorf("%s %x: decoded with %s", test.decoder, test.value, decoderName)
+		}
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%s %x: no error, decoded as %#v", test.decoder, test.value, decoded)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %x: %s", test.decoder, test.value, err)
+		} else if !reflect.DeepEqual(decoded, test.expected) {
+			t.Errorf("%s %x: decoded as %#v instead of %#v", test.decoder, test.value, decoded, test.expected)
+		}
+	}
+}
+
+func TestDefaultDecoder(t *testing.T) {
+	decoders, err := ForChaincodes([]fabricsetup.Chaincode{{Name: "fabcar"}, {Name: "sacc", Decoder: "varint"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chaincodeName := range []string{"fabcar", "unconfigured"} {
+		decoded, decoderName, err := Decode(decoders, chaincodeName, []byte(`"Tom"`))
+		if err != nil || decoded != "Tom" || decoderName != DefaultDecoder {
+			t.Errorf("%s: decoded as %#v with %s (error: %v)", chaincodeName, decoded, decoderName, err)
+		}
+	}
+}
+
+func TestUnknownDecoder(t *testing.T) {
+	_, err := ForChaincodes([]fabricsetup.Chaincode{{Name: "fabcar"}, {Name: "mycc", Decoder: "xml"}})
+	if err == nil || err.Error() != "Unknown value decoder xml for chaincode mycc" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// Writes a descriptor set with the message mycc.Asset { string id = 1; int64 value = 2; }
+func writeDescriptorSet(t *testing.T, path string) {
+	descriptorSet := &descriptor.FileDescriptorSet{
+		File: []*descriptor.FileDescriptorProto{{
+			Name:    proto.String("asset.proto"),
+			Package: proto.String("mycc"),
+			Syntax:  proto.String("proto3"),
+			MessageType: []*descriptor.DescriptorProto{{
+				Name: proto.String("Asset"),
+				Field: []*descriptor.FieldDescriptorProto{
+					{
+						Name:     proto.String("id"),
+						JsonName: proto.String("id"),
+						Number:   proto.Int32(1),
+						Label:    descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+						Type:     descriptor.FieldDescriptorProto_TYPE_STRING.Enum(),
+					},
+					{
+						Name:     proto.String("value"),
+						JsonName: proto.String("value"),
+						Number:   proto.Int32(2),
+						Label:    descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+						Type:     descriptor.FieldDescriptorProto_TYPE_INT64.Enum(),
+					},
+				},
+			}},
+		}},
+	}
+	data, err := proto.Marshal(descriptorSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProtobufDecoder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "valuedecoders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	descriptorSet := filepath.Join(dir, "mycc.protoset")
+	writeDescriptorSet(t, descriptorSet)
+
+	errorTests := []struct {
+		name               string
+		protoDescriptorSet string
+		protoMessage       string
+	}{
+		{"no descriptor set", "", "mycc.Asset"},
+		{"no message", descriptorSet, ""},
+		{"missing descriptor set file", filepath.Join(dir, "missing.protoset"), "mycc.Asset"},
+		{"message not in the descriptor set", descriptorSet, "mycc.Car"},
+	}
+	for _, test := range errorTests {
+		chaincode := fabricsetup.Chaincode{Name: "mycc", Decoder: "protobuf", ProtoDescriptorSet: test.protoDescriptorSet, ProtoMessage: test.protoMessage}
+		if _, err := ForChaincodes([]fabricsetup.Chaincode{chaincode}); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+
+	chaincode := fabricsetup.Chaincode{Name: "mycc", Decoder: "protobuf", ProtoDescriptorSet: descriptorSet, ProtoMessage: "mycc.Asset"}
+	decoders, err := ForChaincodes([]fabricsetup.Chaincode{chaincode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := proto.NewBuffer(nil)
+	value.EncodeVarint(1<<3 | proto.WireBytes)
+	value.EncodeStringBytes("CAR1")
+	value.EncodeVarint(2<<3 | proto.WireVarint)
+	value.EncodeVarint(42)
+	decoded, decoderName, err := Decode(decoders, "mycc", value.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// int64 fields are strings in the JSON mapping of protobuf
+	expected := map[string]interface{}{"id": "CAR1", "value": "42"}
+	if decoderName != "protobuf" || !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("decoded as %#v with %s instead of %#v", decoded, decoderName, expected)
+	}
+	if _, _, err := Decode(decoders, "mycc", []byte{0xff}); err == nil {
+		t.Error("no error for a value that is not a protobuf message")
+	}
+}
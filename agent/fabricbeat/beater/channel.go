@@ -0,0 +1,205 @@
+package beater
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	libbeatCommon "github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+
+	protoCommon "github.com/hyperledger/fabric-protos-go/common"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/checkpoint"
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/retry"
+	"github.com/blockchain-analyzer/agent/fabricbeat/config"
+)
+
+// Number of retries before a channel is given up in the offline ingestion modes, where the block sources do not change
+const offlineRetryAttempts = 3
+
+// Returns true in the ingestion modes that do not need a running peer.
+func (bt *Fabricbeat) offline() bool {
+	return bt.config.Ingestion == config.IngestionBlockfile || bt.config.Ingestion == config.IngestionBlocks
+}
+
+// Ingests every channel in its own goroutine until fabricbeat is stopped. Returns an error if every channel has stopped
+// because of a permanent error.
+func (bt *Fabricbeat) runChannels(b *beat.Beat) error {
+	errs := make(chan error, len(bt.sources))
+	for _, source := range bt.sources {
+		go func(source blocksource.BlockSource) {
+			errs <- bt.runChannel(b, source)
+		}(source)
+	}
+	for range bt.sources {
+		<-errs
+	}
+
+	select {
+	case <-bt.done:
+		return nil
+	default:
+		return errors.New("The ingestion has stopped on every channel")
+	}
+}
+
+// Ingests one channel: catches up with the ledger, then polls the block height periodically or receives the new blocks
+// from the Deliver service. Transient errors are retried with backoff. Returns nil when fabricbeat is stopped, or the
+// permanent error that stopped the channel.
+func (bt *Fabricbeat) runChannel(b *beat.Beat, source blocksource.BlockSource) error {
+	err := bt.rampUpChannel(b, source)
+	if err != nil {
+		return err
+	}
+
+	backoff := bt.newBackoff()
+	if bt.config.Ingestion == config.IngestionDeliver {
+		return bt.retry(source, backoff, func() error {
+			return bt.deliverChannel(b, source, backoff)
+		})
+	}
+
+	ticker := time.NewTicker(bt.config.Period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bt.done:
+			return nil
+		case <-ticker.C:
+		}
+
+		err = bt.retry(source, backoff, func() error {
+			return bt.ProcessNewBlocks(b, source)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Receives the new blocks of the channel from the Deliver service of the peer, starting from the last known block,
+// and sends their data to Elasticsearch. Returns an error if the block event stream is closed.
+func (bt *Fabricbeat) deliverChannel(b *beat.Beat, source blocksource.BlockSource, backoff *retry.Backoff) error {
+	channelId := source.ChannelID()
+	eventClient, err := bt.Fsetup.NewBlockEventClient(channelId, bt.lastBlockNum(channelId))
+	if err != nil {
+		return err
+	}
+	registration, blockEvents, err := eventClient.RegisterBlockEvent()
+	if err != nil {
+		return err
+	}
+	defer eventClient.Unregister(registration)
+	logp.Info("Registered for block events on channel %s, starting from block %d", channelId, bt.lastBlockNum(channelId))
+
+	for {
+		select {
+		case <-bt.done:
+			return nil
+		case blockEvent, ok := <-blockEvents:
+			if !ok {
+				return errors.New(fmt.Sprintf("Block event stream of channel %s has been closed", channelId))
+			}
+			err = bt.processDeliveredBlock(b, source, blockEvent.Block)
+			if err != nil {
+				return err
+			}
+			// The stream works, the next failure starts over from the initial delay
+			backoff.Reset()
+		}
+	}
+}
+
+// Creates the backoff of a channel from the config.
+func (bt *Fabricbeat) newBackoff() *retry.Backoff {
+	backoff := &retry.Backoff{
+		Initial: bt.config.RetryInitialBackoff,
+		Max:     bt.config.RetryMaxBackoff,
+	}
+	if bt.offline() {
+		backoff.MaxAttempts = offlineRetryAttempts
+	}
+	return backoff
+}
+
+// Runs the operation until it succeeds, waiting between the attempts according to the backoff. Permanent errors are not retried,
+// they are returned together with the errors of operations that have been given up. Returns nil if fabricbeat is stopped meanwhile.
+func (bt *Fabricbeat) retry(source blocksource.BlockSource, backoff *retry.Backoff, operation func() error) error {
+	for {
+		err := operation()
+		if err == nil {
+			backoff.Reset()
+			return nil
+		}
+		select {
+		case <-bt.done:
+			return nil
+		default:
+		}
+
+		if retry.IsPermanent(err) {
+			logp.Err("Stopping the ingestion of channel %s: %s", source.ChannelID(), err)
+			return err
+		}
+		delay, ok := backoff.Next()
+		if !ok {
+			logp.Err("Stopping the ingestion of channel %s after %d failed attempts: %s", source.ChannelID(), backoff.Attempts(), err)
+			return err
+		}
+		logp.Warn("Error on channel %s, retrying in %s: %s", source.ChannelID(), delay, err)
+
+		select {
+		case <-bt.done:
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Sends a block that cannot be decoded to the dead-letter index together with the error, and continues with the next block of the channel.
+// The raw block is sent as well (base64 encoded protobuf), so that it can be examined and reprocessed later.
+func (bt *Fabricbeat) quarantineBlock(b *beat.Beat, source blocksource.BlockSource, block *protoCommon.Block, blockErr error) {
+	channelId := source.ChannelID()
+	blockNumber := bt.lastBlockNum(channelId)
+	blockHash := ""
+	if block.GetHeader() != nil {
+		blockNumber = block.Header.Number
+		blockHash = fabricutils.GenerateBlockHash(block.Header.PreviousHash, block.Header.DataHash, block.Header.Number)
+	}
+	logp.Err("Block %d of channel %s cannot be decoded, sending it to the dead-letter index: %s", blockNumber, channelId, blockErr)
+
+	fields := libbeatCommon.MapStr{
+		"type":         b.Info.Name,
+		"channel_id":   channelId,
+		"block_number": blockNumber,
+		"block_hash":   blockHash,
+		"error":        blockErr.Error(),
+		"index_name":   bt.config.DeadLetterIndexName,
+		"peer":         bt.config.Peer,
+	}
+	rawBlock, err := proto.Marshal(block)
+	if err != nil {
+		logp.Warn("Error marshaling block %d of channel %s: %s", blockNumber, channelId, err)
+	} else {
+		fields["block"] = base64.StdEncoding.EncodeToString(rawBlock)
+	}
+
+	// The dead-letter event advances the checkpoint of the channel, just like the block event of a decoded block
+	event := beat.Event{Timestamp: time.Now(), Fields: fields}
+	event.Private = &checkpoint.Checkpoint{
+		ChannelId:   channelId,
+		BlockNumber: blockNumber,
+		BlockHash:   blockHash,
+	}
+	atomic.AddInt64(&bt.pendingBlocks, 1)
+	bt.publish(event, fabricutils.DocumentID(channelId, blockNumber))
+
+	bt.setLastBlockNum(channelId, blockNumber+1)
+}
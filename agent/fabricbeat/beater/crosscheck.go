@@ -0,0 +1,70 @@
+package beater
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	libbeatCommon "github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+	"github.com/blockchain-analyzer/agent/fabricbeat/modules/crosscheck"
+)
+
+// Maximum number of blocks compared per channel in a check, the rest of the chain is compared in the next checks
+const crossCheckMaxBlocks = 100
+
+// Compares the ledger of the peer of the agent with the peers set by crossCheckPeers periodically, and sends
+// the divergences (unreachable or lagging peers, different blocks at the same height) to the "divergence" index.
+func (bt *Fabricbeat) runCrossCheck(b *beat.Beat) {
+	nextBlocks := make(map[string]uint64)
+	ticker := time.NewTicker(bt.config.CrossCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bt.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, ledgerClient := range bt.Fsetup.LedgerClients {
+			channelId := bt.Fsetup.Channels[ledgerClient]
+			var divergences []*crosscheck.Divergence
+			divergences, nextBlocks[channelId] = crosscheck.CheckChannel(channelId, crosscheck.LedgerClientPeers{Client: ledgerClient}, bt.config.Peer, bt.config.CrossCheckPeers, bt.config.MaxPeerLag, nextBlocks[channelId], crossCheckMaxBlocks)
+			if len(divergences) == 0 {
+				logp.Info("Peers of channel %s are consistent up to block %d", channelId, nextBlocks[channelId])
+				continue
+			}
+			logp.Warn("Found %d divergences between the peers of channel %s", len(divergences), channelId)
+
+			for _, divergence := range divergences {
+				event := beat.Event{
+					Timestamp: time.Now(),
+					Fields: libbeatCommon.MapStr{
+						"type":             b.Info.Name,
+						"channel_id":       channelId,
+						"index_name":       bt.config.DivergenceIndexName,
+						"peer":             bt.config.Peer,
+						"divergence_type":  divergence.Type,
+						"diverging_peer":   divergence.Peer,
+						"reference_peer":   divergence.ReferencePeer,
+						"block_number":     divergence.BlockNumber,
+						"block_hash":       divergence.Hash,
+						"reference_hash":   divergence.ReferenceHash,
+						"height":           divergence.Height,
+						"reference_height": divergence.ReferenceHeight,
+						"lag":              divergence.Lag,
+						"divergence_error": divergence.Error,
+					},
+				}
+				// A block mismatch of a peer is reported only once, even if the check is repeated
+				if divergence.Type == crosscheck.HashMismatch {
+					event.SetID(fabricutils.DocumentID(channelId, divergence.BlockNumber, divergence.Peer))
+				}
+				bt.client.Publish(event)
+				logp.Warn(fmt.Sprintf("Divergence on channel %s: %s of peer %s", channelId, divergence.Type, divergence.Peer))
+			}
+		}
+	}
+}
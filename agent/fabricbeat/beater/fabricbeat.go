@@ -1,9 +1,10 @@
 package beater
 
 import (
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blockchain-analyzer/agent/fabricbeat/config"
@@ -11,17 +12,23 @@ import (
 	"github.com/elastic/beats/libbeat/beat"
 	libbeatCommon "github.com/elastic/beats/libbeat/common"
 	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/paths"
 
-	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
+	protoCommon "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
 
 	"github.com/pkg/errors"
 
-	"github.com/blockchain-analyzer/agent/fabricbeat/modules/elastic"
-	"github.com/blockchain-analyzer/agent/agentmodules/ledgerutils"
-	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/checkpoint"
 	"github.com/blockchain-analyzer/agent/agentmodules/fabricsetup"
-	"github.com/blockchain-analyzer/agent/fabricbeat/modules/templates"
+	"github.com/blockchain-analyzer/agent/agentmodules/ledgerutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/retry"
+	"github.com/blockchain-analyzer/agent/agentmodules/transform"
+	"github.com/blockchain-analyzer/agent/agentmodules/valuedecoders"
+	"github.com/blockchain-analyzer/agent/fabricbeat/modules/elastic"
 	"github.com/blockchain-analyzer/agent/fabricbeat/modules/fabricbeatsetup"
+	"github.com/blockchain-analyzer/agent/fabricbeat/modules/templates"
 )
 
 // Fabricbeat configuration.
@@ -30,7 +37,26 @@ type Fabricbeat struct {
 	config        config.Config
 	client        beat.Client
 	Fsetup        *fabricsetup.FabricSetup
-	lastBlockNums map[*ledger.Client]uint64
+	sources       []blocksource.BlockSource
+	lastBlockNums map[string]uint64
+	// Guards lastBlockNums, the channels are ingested in parallel
+	lastBlockNumsMutex sync.Mutex
+	transformer        *transform.Transformer
+	checkpointer       checkpoint.Checkpointer
+	pendingBlocks      int64
+	// Acknowledged blocks whose checkpoint has not been saved yet, keyed by channel ID
+	ackedBlocks      map[string]*ackedBlocks
+	ackedBlocksMutex sync.Mutex
+	// Wakes up the checkpoint flusher when blocks are acknowledged
+	ackSignal chan struct{}
+	// Serializes the saving of the checkpoints
+	checkpointMutex sync.Mutex
+}
+
+// The last acknowledged block of a channel, and the number of blocks acknowledged since the last saved checkpoint
+type ackedBlocks struct {
+	checkpoint *checkpoint.Checkpoint
+	count      int
 }
 
 // New creates an instance of fabricbeat.
@@ -39,29 +65,35 @@ func New(b *beat.Beat, cfg *libbeatCommon.Config) (beat.Beater, error) {
 	if err := cfg.Unpack(&c); err != nil {
 		return nil, fmt.Errorf("Error reading config file: %v", err)
 	}
+	if c.Ingestion != config.IngestionPolling && c.Ingestion != config.IngestionDeliver && c.Ingestion != config.IngestionBlockfile && c.Ingestion != config.IngestionBlocks {
+		return nil, fmt.Errorf("Invalid ingestion mode %q, it must be %q, %q, %q or %q", c.Ingestion, config.IngestionPolling, config.IngestionDeliver, config.IngestionBlockfile, config.IngestionBlocks)
+	}
+	if c.Ingestion == config.IngestionBlockfile && c.BlockfilePath == "" {
+		return nil, fmt.Errorf("blockfilePath has to be set in %q ingestion mode", config.IngestionBlockfile)
+	}
+	if c.Ingestion == config.IngestionBlocks && c.BlocksPath == "" {
+		return nil, fmt.Errorf("blocksPath has to be set in %q ingestion mode", config.IngestionBlocks)
+	}
+	transformer, err := newTransformer(c)
+	if err != nil {
+		return nil, err
+	}
+	checkpointer, err := newCheckpointer(c)
+	if err != nil {
+		return nil, err
+	}
 
 	bt := &Fabricbeat{
 		done:          make(chan struct{}),
 		config:        c,
-		lastBlockNums: make(map[*ledger.Client]uint64),
-	}
-
-	fSetup := &fabricsetup.FabricSetup{
-		OrgName:              bt.config.Organization,
-		ConfigFile:           bt.config.ConnectionProfile,
-		Peer:                 bt.config.Peer,
-		AdminCertPath:        bt.config.AdminCertPath,
-		AdminKeyPath:         bt.config.AdminKeyPath,
-		ElasticURL:           bt.config.ElasticURL,
-		KibanaURL:            bt.config.KibanaURL,
-		BlockIndexName:       bt.config.BlockIndexName,
-		TransactionIndexName: bt.config.TransactionIndexName,
-		KeyIndexName:         bt.config.KeyIndexName,
-		DashboardDirectory:   bt.config.DashboardDirectory,
-		TemplateDirectory:    bt.config.TemplateDirectory,
-		Chaincodes:           bt.config.Chaincodes,
+		lastBlockNums: make(map[string]uint64),
+		checkpointer:  checkpointer,
+		transformer:   transformer,
+		ackedBlocks:   make(map[string]*ackedBlocks),
+		ackSignal:     make(chan struct{}, 1),
 	}
 
+	fSetup := newFabricSetup(bt.config)
 
 	fbeatSetup := &fabricbeatsetup.FabricbeatSetup{
 		OrgName:              bt.config.Organization,
@@ -74,20 +106,27 @@ func New(b *beat.Beat, cfg *libbeatCommon.Config) (beat.Beater, error) {
 		TemplateDirectory:    bt.config.TemplateDirectory,
 	}
 
-	fmt.Println(fmt.Sprintf("len(fSetup.Chaincodes) = %d", len(fSetup.Chaincodes)))
-
-	// Initialization of the Fabric SDK from the previously set properties
-	err1 := fSetup.Initialize()
-	if err1 != nil {
-		logp.Error(err1)
-		return nil, err1
+	// Initialization of the Fabric SDK from the previously set properties. Block files are read without connecting to the network.
+	switch c.Ingestion {
+	case config.IngestionBlockfile:
+		bt.sources, err = blocksource.NewBlockfileSources(c.BlockfilePath)
+	case config.IngestionBlocks:
+		bt.sources, err = blocksource.Open(c.BlocksPath)
+	default:
+		err = fSetup.Initialize()
+		// One block source per channel
+		for _, ledgerClient := range fSetup.LedgerClients {
+			bt.sources = append(bt.sources, blocksource.NewLedgerSource(fSetup.Channels[ledgerClient], ledgerClient))
+		}
+	}
+	if err != nil {
+		logp.Error(err)
+		return nil, err
 	}
 	bt.Fsetup = fSetup
 
-	fmt.Println(fmt.Sprintf("len(fSetup.Chaincodes) = %d", len(fSetup.Chaincodes)))
-
 	// Generate the index patterns and dashboards for the connected peer from templates in the kibana_templates folder
-	err := templates.GenerateDashboards(fbeatSetup)
+	err = templates.GenerateDashboards(fbeatSetup)
 	if err != nil {
 		return nil, err
 	}
@@ -99,89 +138,149 @@ func New(b *beat.Beat, cfg *libbeatCommon.Config) (beat.Beater, error) {
 func (bt *Fabricbeat) Run(b *beat.Beat) error {
 	logp.Info("fabricbeat is running! Hit CTRL-C to stop it.")
 
+	// The checkpoints are only saved after the events of the block are acknowledged by the output
 	var err error
-	bt.client, err = b.Publisher.Connect()
+	bt.client, err = b.Publisher.ConnectWith(beat.ClientConfig{
+		PublishMode: beat.GuaranteedSend,
+		ACKEvents:   bt.ackEvents,
+		WaitClose:   5 * time.Second,
+	})
 	if err != nil {
 		return err
 	}
+	go bt.runCheckpointFlusher()
 
-	// Ramp-up section
-	// Iterate over the known channels (one ledger client per channel)
-	err = bt.rampUp(b)
-	if err != nil {
-		return err
+	if bt.offline() {
+		return bt.runOffline(b)
 	}
 
-	ticker := time.NewTicker(bt.config.Period)
-
-	for {
-		select {
-		case <-bt.done:
-			return nil
-		case <-ticker.C:
-		}
-
-		logp.Info("Start event loop")
-		// Iterate over the known channels (one ledger client per channel)
-		for index, ledgerClient := range bt.Fsetup.LedgerClients {
-			var lastBlockNumber elastic.BlockNumber
-			lastBlockNumber.BlockNumber = bt.lastBlockNums[ledgerClient]
-			err = bt.ProcessNewBlocks(b, ledgerClient, index)
-			if err != nil {
-				return err
-			}
-		}
-
+	// Verifying the indexed blocks periodically in the background
+	if bt.config.VerifyPeriod > 0 {
+		go bt.runVerification(b)
+	}
+	// Comparing the ledger of the peers periodically in the background
+	if len(bt.config.CrossCheckPeers) > 0 {
+		go bt.runCrossCheck(b)
 	}
+
+	// Every channel is ingested by its own goroutine, so that the errors of a channel do not stop the others
+	return bt.runChannels(b)
 }
 
 // Stop stops fabricbeat.
 func (bt *Fabricbeat) Stop() {
 	bt.client.Close()
 	close(bt.done)
+	// Saving the checkpoints of the blocks acknowledged before the client was closed
+	bt.flushCheckpoints(true)
 	defer bt.Fsetup.CloseSDK()
 }
 
-// Helps the Fabricbeat agent to continue where it left off: Gets the last known block from Elasticsearch, compares it to the ledger,
-// and if the two match, it queries every block since the last known block, and sends their data to Elasticsearch. If the block retrieved from Elasticsearch
-// and the block from the ledger do not match, it returns an error.
+// Catches up every channel with its block source, the channels in parallel. Returns the first error that stopped a channel,
+// after the other channels are caught up.
 func (bt *Fabricbeat) rampUp(b *beat.Beat) error {
-	for index, ledgerClient := range bt.Fsetup.LedgerClients {
+	errs := make(chan error, len(bt.sources))
+	for _, source := range bt.sources {
+		go func(source blocksource.BlockSource) {
+			errs <- bt.rampUpChannel(b, source)
+		}(source)
+	}
+	var firstErr error
+	for range bt.sources {
+		err := <-errs
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
 
-		var err error
-		// Get the last known block's number from Elasticsearch.
-		lastBlockNumber, err := elastic.GetBlockNumber(fmt.Sprintf(bt.Fsetup.ElasticURL+"/last_block_%s_%s/_doc/1", bt.config.Peer, bt.Fsetup.Channels[ledgerClient]))
+// Catches up one channel, starting from its checkpoint. Transient errors are retried with backoff.
+func (bt *Fabricbeat) rampUpChannel(b *beat.Beat, source blocksource.BlockSource) error {
+	backoff := bt.newBackoff()
+	err := bt.retry(source, backoff, func() error {
+		return bt.loadCheckpoint(source)
+	})
+	if err != nil {
+		return err
+	}
+	// In deliver mode, the missing blocks are delivered by the event client
+	if bt.config.Ingestion == config.IngestionDeliver {
+		return nil
+	}
+	return bt.retry(source, backoff, func() error {
+		return bt.ProcessNewBlocks(b, source)
+	})
+}
+
+// Helps the Fabricbeat agent to continue where it left off: Gets the last known block of the channel from the checkpoint store, compares it
+// to the block source, and if the two match, the channel continues with the next block. If the block hash of the checkpoint
+// and the hash of the block from the block source do not match, it returns a permanent error.
+func (bt *Fabricbeat) loadCheckpoint(source blocksource.BlockSource) error {
+	channelId := source.ChannelID()
+	firstBlockNumber, err := source.First()
+	if err != nil {
+		return err
+	}
+
+	// Get the last known block of the channel from the checkpoint store
+	lastCheckpoint, err := bt.checkpointer.Load(channelId)
+	if err != nil {
+		return err
+	}
+
+	bt.setLastBlockNum(channelId, firstBlockNumber)
+	if lastCheckpoint == nil {
+		logp.Info("No checkpoint found for channel %s, starting from block %d", channelId, firstBlockNumber)
+	} else if lastCheckpoint.BlockNumber < firstBlockNumber {
+		logp.Warn("The last known block of channel %s (block number: %d) is not available, starting from block %d", channelId, lastCheckpoint.BlockNumber, firstBlockNumber)
+	} else {
+		logp.Info("Last known block number on channel %s: %d", channelId, lastCheckpoint.BlockNumber)
+
+		// Retrieve last known block from the block source
+		blockHashFromLedger, err := ledgerutils.GetBlockHash(lastCheckpoint.BlockNumber, source)
 		if err != nil {
 			return err
 		}
-		// Save last known block number locally for this channel
-		bt.lastBlockNums[ledgerClient] = lastBlockNumber.BlockNumber
-
-		logp.Info("Last known block number on channel %s: %d", lastBlockNumber.ChannelId, bt.lastBlockNums[ledgerClient])
+		// Compare block hash from ledger and the checkpoint
+		if blockHashFromLedger != lastCheckpoint.BlockHash {
+			return retry.Permanent(errors.New(fmt.Sprintf("The hash of the last known block (block number: %d) and the same block on the ledger do not match! Hash from checkpoint: %s, hash from ledger: %s", lastCheckpoint.BlockNumber, lastCheckpoint.BlockHash, blockHashFromLedger)))
+		} else {
+			logp.Info(fmt.Sprintf("The hash of the last known block (block number: %d) and the same block on the ledger match.", lastCheckpoint.BlockNumber))
+		}
+		// Start the querying from the next block
+		bt.setLastBlockNum(channelId, lastCheckpoint.BlockNumber+1)
+	}
+	return nil
+}
 
-		if bt.lastBlockNums[ledgerClient] != 0 {
+// Gets the new blocks from the block source and sends their data to Elasticsearch.
+func (bt *Fabricbeat) ProcessNewBlocks(b *beat.Beat, source blocksource.BlockSource) error {
+	blockHeight, err := ledgerutils.GetBlockHeight(source)
+	if err != nil {
+		return err
+	}
+	return bt.processBlockRange(b, source, blockHeight)
+}
 
-			// Get block hash of the last known block
-			blockHashFromElastic, err := elastic.GetBlockHash(bt.config.ElasticURL, bt.config.BlockIndexName, bt.config.Organization, bt.config.Peer, lastBlockNumber.ChannelId, bt.lastBlockNums[ledgerClient])
-			if err != nil {
-				return err
-			}
+// Gets the blocks from the last known block up to (but not including) the specified block number, and sends their data to Elasticsearch.
+// Ranges of several blocks are fetched and decoded in parallel if fetchWorkers is more than 1.
+func (bt *Fabricbeat) processBlockRange(b *beat.Beat, source blocksource.BlockSource, endBlockNumber uint64) error {
+	if bt.config.FetchWorkers > 1 && bt.lastBlockNum(source.ChannelID())+1 < endBlockNumber {
+		return bt.processBlockRangeParallel(b, source, endBlockNumber)
+	}
+	for bt.lastBlockNum(source.ChannelID()) < endBlockNumber {
+		select {
+		case <-bt.done:
+			return nil
+		default:
+		}
 
-			// Retrieve last known block from the ledger
-			blockHashFromLedger, err := ledgerutils.GetBlockHash(bt.lastBlockNums[ledgerClient], ledgerClient)
-			if err != nil {
-				return err
-			}
-			// Compare block hash from ledger and Elastic
-			if blockHashFromLedger != blockHashFromElastic {
-				return errors.New(fmt.Sprintf("The hash of the last known block (block number: %d) and the same block on the ledger do not match! Hash from Elastic: %s, hash from ledger: %s", bt.lastBlockNums[ledgerClient], blockHashFromElastic, blockHashFromLedger))
-			} else {
-				logp.Info(fmt.Sprintf("The hash of the last known block (block number: %d) and the same block on the ledger match.", bt.lastBlockNums[ledgerClient]))
-			}
-			// Increase last block number, so that the querying starts from the next block
-			bt.lastBlockNums[ledgerClient]++
+		block, err := source.Block(bt.lastBlockNum(source.ChannelID()))
+		if err != nil {
+			return err
 		}
-		err = bt.ProcessNewBlocks(b, ledgerClient, index)
+		err = bt.publishBlock(b, source, block)
 		if err != nil {
 			return err
 		}
@@ -189,186 +288,397 @@ func (bt *Fabricbeat) rampUp(b *beat.Beat) error {
 	return nil
 }
 
-// Gets the blocks from the ledger and sends their data to Elasticsearch.
-func (bt *Fabricbeat) ProcessNewBlocks(b *beat.Beat, ledgerClient *ledger.Client, index int) error {
-
-	var lastBlockNumber elastic.BlockNumber
-	lastBlockNumber.BlockNumber = bt.lastBlockNums[ledgerClient]
+// Sends the data of a block received from the Deliver service to Elasticsearch. Blocks that have already been processed are skipped,
+// and if there are missing blocks between the last known block and the received one, they are queried from the ledger first.
+func (bt *Fabricbeat) processDeliveredBlock(b *beat.Beat, source blocksource.BlockSource, block *protoCommon.Block) error {
+	blockNumber := block.Header.Number
+	lastBlockNumber := bt.lastBlockNum(source.ChannelID())
+	if blockNumber < lastBlockNumber {
+		logp.Info("Block %d on channel %s has already been processed, skipping it", blockNumber, source.ChannelID())
+		return nil
+	}
+	if blockNumber > lastBlockNumber {
+		logp.Warn("Blocks %d-%d on channel %s were not delivered, querying them from the ledger", lastBlockNumber, blockNumber-1, source.ChannelID())
+		err := bt.processBlockRange(b, source, blockNumber)
+		if err != nil {
+			return err
+		}
+		// The range is left unfinished if the beat is stopping, the delivered block must not be published after a gap
+		select {
+		case <-bt.done:
+			return nil
+		default:
+		}
+	}
+	return bt.publishBlock(b, source, block)
+}
 
-	blockHeight, err := ledgerutils.GetBlockHeight(ledgerClient)
+// Sends the records of the block (transactions, writes, configs and chaincode events) to Elasticsearch, then saves the block number
+// as the last known block of the channel. Blocks that cannot be decoded are sent to the dead-letter index instead.
+func (bt *Fabricbeat) publishBlock(b *beat.Beat, source blocksource.BlockSource, block *protoCommon.Block) error {
+	typeInfo, _, _, err := ledgerutils.ProcessBlockData(block)
+	if err != nil {
+		bt.quarantineBlock(b, source, block, err)
+		return nil
+	}
+	records, err := bt.transformBlock(source, block, typeInfo)
+	if retry.IsPermanent(err) {
+		bt.quarantineBlock(b, source, block, err)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	for lastBlockNumber.BlockNumber < blockHeight {
-		var transactions []string
-		block, typeInfo, createdAt, _, err := ledgerutils.ProcessBlock(lastBlockNumber.BlockNumber, ledgerClient)
+	bt.publishRecords(b, source, records)
+	return nil
+}
+
+// Turns the block into records, together with the cleartext private data of the block if configured so.
+func (bt *Fabricbeat) transformBlock(source blocksource.BlockSource, block *protoCommon.Block, typeInfo string) (*transform.Records, error) {
+	// Fetching the cleartext private data of the block, only available for collections the organization is a member of
+	var privateData map[uint64]*rwset.TxPvtReadWriteSet
+	if bt.config.PrivateData && blocksource.LedgerClientOf(source) != nil && typeInfo == transform.EndorserTransaction {
+		var err error
+		privateData, err = bt.Fsetup.GetBlockPrivateData(source.ChannelID(), block.Header.Number)
 		if err != nil {
-			return err
+			logp.Warn("Error fetching private data of block %d: %s", block.Header.Number, err.Error())
 		}
-		for _, d := range block.Data.Data {
-			if typeInfo != "ENDORSER_TRANSACTION" {
-				txId, channelId, creator, creatorOrg, _, err := ledgerutils.ProcessTx(d)
-				lastBlockNumber.ChannelId = channelId
-				if err != nil {
-					return err
-				}
-				event := beat.Event{
-					Timestamp: time.Now(),
-					Fields: libbeatCommon.MapStr{
-						"type":             b.Info.Name,
-						"block_number":     lastBlockNumber.BlockNumber,
-						"tx_id":            txId,
-						"channel_id":       channelId,
-						"index_name":       bt.config.TransactionIndexName,
-						"peer":             bt.config.Peer,
-						"created_at":       createdAt,
-						"creator":          creator,
-						"creator_org":      creatorOrg,
-						"transaction_type": typeInfo,
-					},
-				}
-				bt.client.Publish(event)
-				logp.Info("Non-endorser transaction event sent")
+	}
+	return bt.transformer.Transform(block, source, privateData)
+}
 
-			} else {
-				txId, channelId, creator, creatorOrg, txRWSet, chaincodeName, chaincodeVersion, err := ledgerutils.ProcessEndorserTx(d)
-				if err != nil {
-					return err
-				}
-				readset := []*fabricutils.Readset{}
-				writeset := []*fabricutils.Writeset{}
-				// Getting read-write set
-				// For every namespace
-				for _, ns := range txRWSet.NsRwSets {
-
-					if len(ns.KvRwSet.Writes) > 0 {
-						// Getting the writes
-						for writeIndex, w := range ns.KvRwSet.Writes {
-							writeset = append(writeset, &fabricutils.Writeset{})
-							writeset[writeIndex].Namespace = ns.NameSpace
-							writeset[writeIndex].Key = w.Key
-
-							err = json.Unmarshal(w.Value, &writeset[writeIndex].Value)
-							if err != nil {
-								logp.Warn("Error unmarshaling value into writeset: %s", err.Error())
-							}
-							// With this map, we can obtain the top level fields of the value.
-							var valueMap map[string]interface{}
-							err = json.Unmarshal(w.Value, &valueMap)
-							if err != nil {
-								logp.Warn("Error unmarshaling value into map: %s", err.Error())
-							}
-							fmt.Println(fmt.Sprintf("\n\n\nSize of map: %d\n\n\n", len(valueMap)))
-
-							writeset[writeIndex].IsDelete = w.IsDelete
-
-							fmt.Println(fmt.Sprintf("len(bt.Fsetup.Chaincodes) = %d", len(bt.Fsetup.Chaincodes)))
-							for _, chaincode := range bt.config.Chaincodes {
-								fmt.Println(fmt.Sprintf("Chaincode name: %s, linking key: %s, values length: %d", chaincode.Name, chaincode.Linkingkey, len(chaincode.Values)))
-							}
-
-							var LinkingkeyString string
-							ccIndex := fabricutils.IndexOfChaincode(bt.Fsetup.Chaincodes, chaincodeName)
-							if ccIndex < 0 || valueMap[bt.config.Chaincodes[ccIndex].Linkingkey] == nil {
-								LinkingkeyString = ""
-							} else {
-								if str, ok := valueMap[bt.config.Chaincodes[ccIndex].Linkingkey].(string); ok {
-									LinkingkeyString = str
-								} else {
-									return errors.New(fmt.Sprintf("valueMap contains interface{} value instead of string with key %s", bt.config.Chaincodes[ccIndex].Linkingkey))
-								}
-							}
-
-							// Sending a new event to the "key" index with the write data
-							event := beat.Event{
-								Timestamp: time.Now(),
-								Fields: libbeatCommon.MapStr{
-									"type":              b.Info.Name,
-									"tx_id":             txId,
-									"channel_id":        channelId,
-									"chaincode_name":    chaincodeName,
-									"chaincode_version": chaincodeVersion,
-									"index_name":        bt.config.KeyIndexName,
-									"peer":              bt.config.Peer,
-									"write":             writeset[writeIndex],
-									"key":               w.Key,
-									"linking_key":       LinkingkeyString,
-									"value":             writeset[writeIndex].Value,
-									"created_at":        createdAt,
-									"creator":           creator,
-									"creator_org":       creatorOrg,
-								},
-							}
-							bt.client.Publish(event)
-							logp.Info("Write event sent")
-						}
-					}
-
-					if len(ns.KvRwSet.Reads) > 0 {
-						// Getting the reads
-						for readIndex, w := range ns.KvRwSet.Reads {
-							readset = append(readset, &fabricutils.Readset{})
-							readset[readIndex].Namespace = ns.NameSpace
-							readset[readIndex].Key = w.Key
-						}
-					}
-				}
-
-				transactions = append(transactions, txId)
-				// Sending the transaction data to the "transaction" index
-				event := beat.Event{
-					Timestamp: time.Now(),
-					Fields: libbeatCommon.MapStr{
-						"type":              b.Info.Name,
-						"block_number":      lastBlockNumber.BlockNumber,
-						"tx_id":             txId,
-						"channel_id":        channelId,
-						"chaincode_name":    chaincodeName,
-						"chaincode_version": chaincodeVersion,
-						"index_name":        bt.config.TransactionIndexName,
-						"peer":              bt.config.Peer,
-						"created_at":        createdAt,
-						"creator":           creator,
-						"creator_org":       creatorOrg,
-						"readset":           readset,
-						"writeset":          writeset,
-						"transaction_type":  typeInfo,
-					},
-				}
-				bt.client.Publish(event)
-				logp.Info("Endorsement transaction event sent")
-			}
+// Sends the records of a block to Elasticsearch, the block event last, then saves the block number as the last known block of the channel.
+func (bt *Fabricbeat) publishRecords(b *beat.Beat, source blocksource.BlockSource, records *transform.Records) {
+	for _, tx := range records.Transactions {
+		bt.publish(bt.transactionEvent(b, tx), tx.ID())
+	}
+	for _, write := range records.Writes {
+		if write.DecodeError != "" {
+			logp.Warn("Error decoding value with the %s decoder: %s", write.ValueDecoder, write.DecodeError)
+		}
+		bt.publish(bt.writeEvent(b, write), write.ID())
+	}
+	for _, config := range records.Configs {
+		bt.publish(bt.configEvent(b, config), config.ID())
+		logp.Info("Config event sent with %d changes", len(config.Changes))
+	}
+	for _, chaincodeEvent := range records.Events {
+		bt.publish(bt.chaincodeEvent(b, chaincodeEvent), chaincodeEvent.ID())
+	}
+
+	// Sending the block data to the "block" index. The block event is the last event of the block,
+	// its acknowledgement advances the checkpoint of the channel.
+	event := bt.blockEvent(b, records.Block)
+	event.Private = &checkpoint.Checkpoint{
+		ChannelId:   source.ChannelID(),
+		BlockNumber: records.Block.BlockNumber,
+		BlockHash:   records.Block.BlockHash,
+	}
+	atomic.AddInt64(&bt.pendingBlocks, 1)
+	bt.publish(event, records.Block.ID())
+	logp.Info("Block event sent")
+
+	bt.setLastBlockNum(source.ChannelID(), records.Block.BlockNumber+1)
+}
+
+// Gets the number of the next block to process on the channel.
+func (bt *Fabricbeat) lastBlockNum(channelId string) uint64 {
+	bt.lastBlockNumsMutex.Lock()
+	defer bt.lastBlockNumsMutex.Unlock()
+	return bt.lastBlockNums[channelId]
+}
+
+func (bt *Fabricbeat) setLastBlockNum(channelId string, blockNumber uint64) {
+	bt.lastBlockNumsMutex.Lock()
+	defer bt.lastBlockNumsMutex.Unlock()
+	bt.lastBlockNums[channelId] = blockNumber
+}
+
+// Sends an event with a deterministic document ID.
+func (bt *Fabricbeat) publish(event beat.Event, id string) {
+	event.SetID(id)
+	bt.client.Publish(event)
+}
+
+// Creates the event of the "block" index.
+func (bt *Fabricbeat) blockEvent(b *beat.Beat, block *transform.Block) beat.Event {
+	return beat.Event{
+		Timestamp: time.Now(),
+		Fields: libbeatCommon.MapStr{
+			"type":             b.Info.Name,
+			"block_number":     block.BlockNumber,
+			"channel_id":       block.ChannelId,
+			"block_hash":       block.BlockHash,
+			"previous_hash":    block.PreviousHash,
+			"data_hash":        block.DataHash,
+			"created_at":       block.CreatedAt,
+			"index_name":       bt.config.BlockIndexName,
+			"peer":             bt.config.Peer,
+			"transactions":     block.Transactions,
+			"valid_tx_count":   block.ValidTxCount,
+			"invalid_tx_count": block.InvalidTxCount,
+		},
+	}
+}
+
+// Creates the event of the "transaction" index. Endorser transactions have one event per action.
+func (bt *Fabricbeat) transactionEvent(b *beat.Beat, tx *transform.Transaction) beat.Event {
+	fields := libbeatCommon.MapStr{
+		"type":             b.Info.Name,
+		"block_number":     tx.BlockNumber,
+		"tx_id":            tx.TxId,
+		"channel_id":       tx.ChannelId,
+		"index_name":       bt.config.TransactionIndexName,
+		"peer":             bt.config.Peer,
+		"created_at":       tx.CreatedAt,
+		"creator":          tx.Creator,
+		"creator_org":      tx.CreatorOrg,
+		"transaction_type": tx.TxType,
+		"validation_code":  tx.ValidationCode,
+		"is_valid":         tx.IsValid,
+	}
+	if tx.IsEndorserTx() {
+		fields.Update(libbeatCommon.MapStr{
+			"action_index":      tx.ActionIndex,
+			"action_count":      tx.ActionCount,
+			"chaincode_name":    tx.ChaincodeName,
+			"chaincode_version": tx.ChaincodeVersion,
+			"readset":           tx.Readset,
+			"writeset":          tx.Writeset,
+			"range_queries":     tx.RangeQueries,
+			"metadata_writes":   tx.MetadataWrites,
+			"private_writeset":  tx.PrivateWriteset,
+			"collections":       tx.Collections,
+			"endorsers":         tx.Endorsers,
+			"endorser_orgs":     tx.EndorserOrgs,
+			"endorsement_count": tx.EndorsementCount,
+			"function":          tx.Function,
+			"args":              tx.Args,
+			"response_status":   tx.ResponseStatus,
+			"response_message":  tx.ResponseMessage,
+			"response_payload":  tx.ResponsePayload,
+		})
+	}
+	return beat.Event{Timestamp: time.Now(), Fields: fields}
+}
+
+// Creates the event of the "key" index for a value, metadata or private write.
+func (bt *Fabricbeat) writeEvent(b *beat.Beat, write *transform.Write) beat.Event {
+	fields := libbeatCommon.MapStr{
+		"type":              b.Info.Name,
+		"tx_id":             write.TxId,
+		"action_index":      write.ActionIndex,
+		"channel_id":        write.ChannelId,
+		"chaincode_name":    write.ChaincodeName,
+		"chaincode_version": write.ChaincodeVersion,
+		"index_name":        bt.config.KeyIndexName,
+		"peer":              bt.config.Peer,
+		"write_type":        write.WriteType,
+		"key":               write.Key,
+		"created_at":        write.CreatedAt,
+		"creator":           write.Creator,
+		"creator_org":       write.CreatorOrg,
+		"validation_code":   write.ValidationCode,
+		"is_valid":          write.IsValid,
+	}
+	switch write.WriteType {
+	case transform.WriteTypeValue:
+		fields.Update(libbeatCommon.MapStr{
+			"write":         write.Write,
+			"linking_key":   write.LinkingKey,
+			"value":         write.Value,
+			"value_decoder": write.ValueDecoder,
+		})
+	case transform.WriteTypeMetadata:
+		fields["metadata"] = write.Metadata
+	case transform.WriteTypePrivate:
+		fields.Update(libbeatCommon.MapStr{
+			"write":      write.Write,
+			"collection": write.Collection,
+			"key_hash":   write.KeyHash,
+			"value_hash": write.ValueHash,
+			"value":      write.Value,
+		})
+	}
+	return beat.Event{Timestamp: time.Now(), Fields: fields}
+}
+
+// Creates the event of the "config" index.
+func (bt *Fabricbeat) configEvent(b *beat.Beat, config *transform.Config) beat.Event {
+	return beat.Event{
+		Timestamp: time.Now(),
+		Fields: libbeatCommon.MapStr{
+			"type":             b.Info.Name,
+			"block_number":     config.BlockNumber,
+			"tx_id":            config.TxId,
+			"channel_id":       config.ChannelId,
+			"index_name":       bt.config.ConfigIndexName,
+			"peer":             bt.config.Peer,
+			"created_at":       config.CreatedAt,
+			"creator":          config.Creator,
+			"creator_org":      config.CreatorOrg,
+			"transaction_type": config.TxType,
+			"config":           config.Config,
+			"config_changes":   config.Changes,
+			"signers":          config.Signers,
+		},
+	}
+}
+
+// Creates the event of the "event" index for an event set by the chaincode.
+func (bt *Fabricbeat) chaincodeEvent(b *beat.Beat, chaincodeEvent *transform.Event) beat.Event {
+	return beat.Event{
+		Timestamp: time.Now(),
+		Fields: libbeatCommon.MapStr{
+			"type":            b.Info.Name,
+			"block_number":    chaincodeEvent.BlockNumber,
+			"tx_id":           chaincodeEvent.TxId,
+			"action_index":    chaincodeEvent.ActionIndex,
+			"channel_id":      chaincodeEvent.ChannelId,
+			"chaincode_name":  chaincodeEvent.ChaincodeName,
+			"event_name":      chaincodeEvent.EventName,
+			"payload":         chaincodeEvent.Payload,
+			"index_name":      bt.config.EventIndexName,
+			"peer":            bt.config.Peer,
+			"created_at":      chaincodeEvent.CreatedAt,
+			"creator":         chaincodeEvent.Creator,
+			"creator_org":     chaincodeEvent.CreatorOrg,
+			"validation_code": chaincodeEvent.ValidationCode,
+			"is_valid":        chaincodeEvent.IsValid,
+		},
+	}
+}
+
+// Handles the acknowledged events of the output. Events are acknowledged in publishing order, so only the last acknowledged block
+// of each channel is kept. The checkpoints are saved by the checkpoint flusher, not in the callback of the output.
+func (bt *Fabricbeat) ackEvents(data []interface{}) {
+	bt.ackedBlocksMutex.Lock()
+	for _, private := range data {
+		cp, ok := private.(*checkpoint.Checkpoint)
+		if !ok {
+			continue
 		}
-		prevHash := hex.EncodeToString(block.Header.PreviousHash)
-		dataHash := hex.EncodeToString(block.Header.DataHash)
-		blockHash := fabricutils.GenerateBlockHash(block.Header.PreviousHash, block.Header.DataHash, block.Header.Number)
-
-		// Sending the block data to the "block" index
-		event := beat.Event{
-			Timestamp: time.Now(),
-			Fields: libbeatCommon.MapStr{
-				"type":          b.Info.Name,
-				"block_number":  lastBlockNumber.BlockNumber,
-				"channel_id":    lastBlockNumber.ChannelId,
-				"block_hash":    blockHash,
-				"previous_hash": prevHash,
-				"data_hash":     dataHash,
-				"created_at":    createdAt,
-				"index_name":    bt.config.BlockIndexName,
-				"peer":          bt.config.Peer,
-				"transactions":  transactions,
-			},
+		atomic.AddInt64(&bt.pendingBlocks, -1)
+		acked, ok := bt.ackedBlocks[cp.ChannelId]
+		if !ok {
+			acked = &ackedBlocks{}
+			bt.ackedBlocks[cp.ChannelId] = acked
 		}
-		bt.client.Publish(event)
-		logp.Info("Block event sent")
+		acked.checkpoint = cp
+		acked.count++
+	}
+	bt.ackedBlocksMutex.Unlock()
+
+	select {
+	case bt.ackSignal <- struct{}{}:
+	default:
+	}
+}
 
-		// Send the latest known block number to Elasticsearch
-		err = elastic.SendBlockNumber(fmt.Sprintf(bt.Fsetup.ElasticURL+"/last_block_%s_%s/_doc/1", bt.config.Peer, bt.Fsetup.Channels[ledgerClient]), lastBlockNumber)
+// Saves the checkpoints of the acknowledged blocks until the beat is stopped.
+func (bt *Fabricbeat) runCheckpointFlusher() {
+	for {
+		select {
+		case <-bt.done:
+			return
+		case <-bt.ackSignal:
+			bt.flushCheckpoints(false)
+		}
+	}
+}
+
+// Saves the last acknowledged block of each channel to the checkpoint store: once checkpointBatchSize blocks of the channel
+// have been acknowledged since the last saved checkpoint, when every published block has been acknowledged, or always if all is set.
+func (bt *Fabricbeat) flushCheckpoints(all bool) {
+	bt.checkpointMutex.Lock()
+	defer bt.checkpointMutex.Unlock()
+
+	// Taking the checkpoints to save, so that the output is not blocked while they are saved
+	bt.ackedBlocksMutex.Lock()
+	idle := all || atomic.LoadInt64(&bt.pendingBlocks) <= 0
+	due := map[string]*ackedBlocks{}
+	channelIds := []string{}
+	for channelId, acked := range bt.ackedBlocks {
+		if !idle && acked.count < bt.config.CheckpointBatchSize {
+			continue
+		}
+		due[channelId] = acked
+		channelIds = append(channelIds, channelId)
+		delete(bt.ackedBlocks, channelId)
+	}
+	bt.ackedBlocksMutex.Unlock()
+
+	sort.Strings(channelIds)
+	for _, channelId := range channelIds {
+		acked := due[channelId]
+		cp := acked.checkpoint
+		err := bt.checkpointer.Save(cp)
 		if err != nil {
-			return err
+			// The checkpoint is saved again with the next acknowledged blocks
+			logp.Error(errors.Wrapf(err, "failed to save checkpoint of block %d of channel %s", cp.BlockNumber, cp.ChannelId))
+			bt.ackedBlocksMutex.Lock()
+			if newer, ok := bt.ackedBlocks[channelId]; ok {
+				newer.count += acked.count
+			} else {
+				bt.ackedBlocks[channelId] = acked
+			}
+			bt.ackedBlocksMutex.Unlock()
+			continue
 		}
-		bt.lastBlockNums[ledgerClient]++
-		lastBlockNumber.BlockNumber++
+		logp.Info("Checkpoint of channel %s saved at block %d (%d blocks acknowledged)", cp.ChannelId, cp.BlockNumber, acked.count)
 	}
-	return nil
+}
+
+// Creates the Fabric setup from the configuration. The SDK has to be initialized before use.
+func newFabricSetup(c config.Config) *fabricsetup.FabricSetup {
+	return &fabricsetup.FabricSetup{
+		OrgName:              c.Organization,
+		ConfigFile:           c.ConnectionProfile,
+		Peer:                 c.Peer,
+		AdminCertPath:        c.AdminCertPath,
+		AdminKeyPath:         c.AdminKeyPath,
+		ElasticURL:           c.ElasticURL,
+		KibanaURL:            c.KibanaURL,
+		BlockIndexName:       c.BlockIndexName,
+		TransactionIndexName: c.TransactionIndexName,
+		KeyIndexName:         c.KeyIndexName,
+		DashboardDirectory:   c.DashboardDirectory,
+		TemplateDirectory:    c.TemplateDirectory,
+		Chaincodes:           c.Chaincodes,
+	}
+}
+
+// Creates the transformer of the blocks from the chaincode and size settings of the configuration.
+func newTransformer(c config.Config) (*transform.Transformer, error) {
+	decoders, err := valuedecoders.ForChaincodes(c.Chaincodes)
+	if err != nil {
+		return nil, err
+	}
+	return transform.New(transform.Options{
+		Chaincodes:        c.Chaincodes,
+		Decoders:          decoders,
+		SkipInvalidWrites: c.SkipInvalidWrites,
+		MaxArgSize:        c.MaxArgSize,
+		MaxResponseSize:   c.MaxResponseSize,
+	}), nil
+}
+
+// Creates the checkpoint store set by the checkpointType setting.
+func newCheckpointer(c config.Config) (checkpoint.Checkpointer, error) {
+	switch c.CheckpointType {
+	case config.CheckpointElasticsearch:
+		return &elastic.Checkpointer{
+			ElasticURL:     c.ElasticURL,
+			BlockIndexName: c.BlockIndexName,
+			Organization:   c.Organization,
+			Peer:           c.Peer,
+		}, nil
+	case config.CheckpointFile:
+		checkpointPath := c.CheckpointPath
+		if checkpointPath == "" {
+			checkpointPath = paths.Resolve(paths.Data, "checkpoints.json")
+		}
+		return checkpoint.NewFileCheckpointer(checkpointPath)
+	}
+	return nil, fmt.Errorf("Invalid checkpoint type %q, it must be either %q or %q", c.CheckpointType, config.CheckpointElasticsearch, config.CheckpointFile)
 }
@@ -0,0 +1,643 @@
+package beater
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/peer"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/blocktest"
+	"github.com/blockchain-analyzer/agent/agentmodules/checkpoint"
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricsetup"
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/valuedecoders"
+	"github.com/blockchain-analyzer/agent/fabricbeat/config"
+)
+
+// Collects the published events instead of sending them to the output
+type fakeClient struct {
+	mutex  sync.Mutex
+	events []beat.Event
+}
+
+func (c *fakeClient) Publish(event beat.Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.events = append(c.events, event)
+}
+
+func (c *fakeClient) PublishAll(events []beat.Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.events = append(c.events, events...)
+}
+
+func (c *fakeClient) Close() error {
+	return nil
+}
+
+// Returns the published events sent to the given index
+func (c *fakeClient) eventsOf(indexName string) []beat.Event {
+	events := []beat.Event{}
+	for _, event := range c.events {
+		if event.Fields["index_name"] == indexName {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Keeps the checkpoints in memory
+type memoryCheckpointer map[string]*checkpoint.Checkpoint
+
+func (m memoryCheckpointer) Load(channelId string) (*checkpoint.Checkpoint, error) {
+	return m[channelId], nil
+}
+
+func (m memoryCheckpointer) Save(cp *checkpoint.Checkpoint) error {
+	m[cp.ChannelId] = cp
+	return nil
+}
+
+func newTestBeater(t *testing.T, sources ...blocksource.BlockSource) (*Fabricbeat, *fakeClient, *beat.Beat) {
+	c := config.DefaultConfig
+	c.Chaincodes = []fabricsetup.Chaincode{{Name: "fabcar", Linkingkey: "owner"}}
+	client := &fakeClient{}
+	bt := &Fabricbeat{
+		done:          make(chan struct{}),
+		client:        client,
+		Fsetup:        &fabricsetup.FabricSetup{Chaincodes: c.Chaincodes},
+		sources:       sources,
+		lastBlockNums: make(map[string]uint64),
+		checkpointer:  memoryCheckpointer{},
+		ackedBlocks:   make(map[string]*ackedBlocks),
+		ackSignal:     make(chan struct{}, 1),
+	}
+	setTestConfig(t, bt, c)
+	return bt, client, &beat.Beat{Info: beat.Info{Name: "fabricbeat"}}
+}
+
+// Sets the configuration of the beater, together with the transformer built from it.
+func setTestConfig(t *testing.T, bt *Fabricbeat, c config.Config) {
+	transformer, err := newTransformer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt.config = c
+	bt.transformer = transformer
+}
+
+// A config block followed by a block with a valid and an invalid fabcar transaction
+func newTestChain() *blocktest.Chain {
+	chain := blocktest.NewChain("mychannel")
+	chain.AddConfigBlock(&common.Config{Sequence: 1, ChannelGroup: &common.ConfigGroup{}})
+	chain.AddBlock(
+		&blocktest.Tx{
+			Chaincode: "fabcar",
+			Version:   "1.0",
+			Function:  "createCar",
+			Args:      []string{"CAR1"},
+			Reads:     []*kvrwset.KVRead{{Key: "CAR1"}},
+			Writes:    []*kvrwset.KVWrite{{Key: "CAR1", Value: []byte(`{"owner":"Tom"}`)}},
+			Event:     &peer.ChaincodeEvent{ChaincodeId: "fabcar", EventName: "created", Payload: []byte(`{"car":"CAR1"}`)},
+		},
+		&blocktest.Tx{
+			Chaincode:      "fabcar",
+			Version:        "1.0",
+			Function:       "changeCarOwner",
+			Args:           []string{"CAR1", "Dave"},
+			Writes:         []*kvrwset.KVWrite{{Key: "CAR1", Value: []byte(`{"owner":"Dave"}`)}},
+			ValidationCode: peer.TxValidationCode_MVCC_READ_CONFLICT,
+		},
+	)
+	return chain
+}
+
+func newTestSource(t *testing.T, chain *blocktest.Chain) blocksource.BlockSource {
+	source, err := blocksource.NewMemorySource(chain.Blocks...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func TestProcessNewBlocks(t *testing.T) {
+	chain := newTestChain()
+	source := newTestSource(t, chain)
+	bt, client, b := newTestBeater(t, source)
+
+	err := bt.ProcessNewBlocks(b, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.lastBlockNums["mychannel"] != 2 {
+		t.Errorf("last block number is %d instead of 2", bt.lastBlockNums["mychannel"])
+	}
+
+	blockEvents := client.eventsOf(bt.config.BlockIndexName)
+	if len(blockEvents) != 2 {
+		t.Fatalf("%d block events instead of 2", len(blockEvents))
+	}
+	block := chain.Blocks[1]
+	blockHash := fabricutils.GenerateBlockHash(block.Header.PreviousHash, block.Header.DataHash, block.Header.Number)
+	blockEvent := blockEvents[1]
+	if blockEvent.Fields["block_hash"] != blockHash {
+		t.Errorf("block hash is %v instead of %s", blockEvent.Fields["block_hash"], blockHash)
+	}
+	if blockEvent.Fields["valid_tx_count"] != 1 || blockEvent.Fields["invalid_tx_count"] != 1 {
+		t.Errorf("valid/invalid transaction count is %v/%v instead of 1/1", blockEvent.Fields["valid_tx_count"], blockEvent.Fields["invalid_tx_count"])
+	}
+	if blockEvent.Meta["id"] != "mychannel-1" {
+		t.Errorf("document ID of the block is %v instead of mychannel-1", blockEvent.Meta["id"])
+	}
+	cp, ok := blockEvent.Private.(*checkpoint.Checkpoint)
+	if !ok || cp.ChannelId != "mychannel" || cp.BlockNumber != 1 || cp.BlockHash != blockHash {
+		t.Errorf("unexpected checkpoint of the block event: %+v", blockEvent.Private)
+	}
+
+	if configEvents := client.eventsOf(bt.config.ConfigIndexName); len(configEvents) != 1 {
+		t.Errorf("%d config events instead of 1", len(configEvents))
+	}
+	if chaincodeEvents := client.eventsOf(bt.config.EventIndexName); len(chaincodeEvents) != 1 {
+		t.Errorf("%d chaincode events instead of 1", len(chaincodeEvents))
+	}
+
+	tests := []struct {
+		txId           string
+		owner          string
+		validationCode string
+		isValid        bool
+	}{
+		{"tx-1-0", "Tom", "VALID", true},
+		{"tx-1-1", "Dave", "MVCC_READ_CONFLICT", false},
+	}
+	keyEvents := client.eventsOf(bt.config.KeyIndexName)
+	if len(keyEvents) != len(tests) {
+		t.Fatalf("%d key events instead of %d", len(keyEvents), len(tests))
+	}
+	txEvents := []beat.Event{}
+	for _, event := range client.eventsOf(bt.config.TransactionIndexName) {
+		if event.Fields["transaction_type"] == "ENDORSER_TRANSACTION" {
+			txEvents = append(txEvents, event)
+		}
+	}
+	if len(txEvents) != len(tests) {
+		t.Fatalf("%d endorser transaction events instead of %d", len(txEvents), len(tests))
+	}
+	for i, test := range tests {
+		keyEvent := keyEvents[i]
+		if keyEvent.Fields["tx_id"] != test.txId || keyEvent.Fields["key"] != "CAR1" {
+			t.Errorf("key event %d: unexpected transaction %v or key %v", i, keyEvent.Fields["tx_id"], keyEvent.Fields["key"])
+		}
+		if keyEvent.Fields["linking_key"] != test.owner {
+			t.Errorf("key event %d: linking key is %v instead of %s", i, keyEvent.Fields["linking_key"], test.owner)
+		}
+		if value, ok := keyEvent.Fields["value"].(map[string]interface{}); !ok || value["owner"] != test.owner {
+			t.Errorf("key event %d: unexpected decoded value %v", i, keyEvent.Fields["value"])
+		}
+		if keyEvent.Fields["value_decoder"] != valuedecoders.DefaultDecoder {
+			t.Errorf("key event %d: value decoder is %v instead of %s", i, keyEvent.Fields["value_decoder"], valuedecoders.DefaultDecoder)
+		}
+		if id := fabricutils.DocumentID("mychannel", 1, i, 0, "w0"); keyEvent.Meta["id"] != id {
+			t.Errorf("key event %d: document ID is %v instead of %s", i, keyEvent.Meta["id"], id)
+		}
+
+		txEvent := txEvents[i]
+		if txEvent.Fields["tx_id"] != test.txId || txEvent.Fields["chaincode_name"] != "fabcar" {
+			t.Errorf("transaction event %d: unexpected transaction %v or chaincode %v", i, txEvent.Fields["tx_id"], txEvent.Fields["chaincode_name"])
+		}
+		if txEvent.Fields["validation_code"] != test.validationCode || txEvent.Fields["is_valid"] != test.isValid {
+			t.Errorf("transaction event %d: validation code is %v (valid: %v) instead of %s (valid: %v)", i, txEvent.Fields["validation_code"], txEvent.Fields["is_valid"], test.validationCode, test.isValid)
+		}
+		if txEvent.Fields["creator_org"] != "Org1MSP" {
+			t.Errorf("transaction event %d: creator org is %v instead of Org1MSP", i, txEvent.Fields["creator_org"])
+		}
+	}
+}
+
+func TestProcessDeliveredBlock(t *testing.T) {
+	tests := []struct {
+		name          string
+		lastBlockNum  uint64
+		stopped       bool
+		blockEvents   int
+		nextBlockNum  uint64
+		pendingBlocks int64
+	}{
+		{"next block", 1, false, 1, 2, 1},
+		{"already processed", 2, false, 0, 2, 0},
+		{"missing blocks queried first", 0, false, 2, 2, 2},
+		{"stopping while querying missing blocks", 0, true, 0, 0, 0},
+	}
+	for _, test := range tests {
+		chain := newTestChain()
+		source := newTestSource(t, chain)
+		bt, client, b := newTestBeater(t, source)
+		bt.lastBlockNums["mychannel"] = test.lastBlockNum
+		if test.stopped {
+			close(bt.done)
+		}
+
+		err := bt.processDeliveredBlock(b, source, chain.Blocks[1])
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if events := client.eventsOf(bt.config.BlockIndexName); len(events) != test.blockEvents {
+			t.Errorf("%s: %d block events instead of %d", test.name, len(events), test.blockEvents)
+		}
+		if bt.lastBlockNums["mychannel"] != test.nextBlockNum {
+			t.Errorf("%s: next block is %d instead of %d", test.name, bt.lastBlockNums["mychannel"], test.nextBlockNum)
+		}
+		if bt.pendingBlocks != test.pendingBlocks {
+			t.Errorf("%s: %d blocks are pending instead of %d", test.name, bt.pendingBlocks, test.pendingBlocks)
+		}
+	}
+}
+
+func TestSkipInvalidWrites(t *testing.T) {
+	source := newTestSource(t, newTestChain())
+	bt, client, b := newTestBeater(t, source)
+	c := bt.config
+	c.SkipInvalidWrites = true
+	setTestConfig(t, bt, c)
+
+	err := bt.ProcessNewBlocks(b, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyEvents := client.eventsOf(bt.config.KeyIndexName)
+	if len(keyEvents) != 1 || keyEvents[0].Fields["tx_id"] != "tx-1-0" {
+		t.Errorf("only the write of the valid transaction should be sent, got %d key events", len(keyEvents))
+	}
+}
+
+func TestRampUpFromCheckpoint(t *testing.T) {
+	chain := newTestChain()
+	genesis := chain.Blocks[0]
+	genesisHash := fabricutils.GenerateBlockHash(genesis.Header.PreviousHash, genesis.Header.DataHash, genesis.Header.Number)
+
+	tests := []struct {
+		name           string
+		checkpoint     *checkpoint.Checkpoint
+		expectError    bool
+		expectedBlocks int
+	}{
+		{"no checkpoint", nil, false, 2},
+		{"matching checkpoint", &checkpoint.Checkpoint{ChannelId: "mychannel", BlockNumber: 0, BlockHash: genesisHash}, false, 1},
+		{"checkpoint at the last block", &checkpoint.Checkpoint{ChannelId: "mychannel", BlockNumber: 1, BlockHash: fabricutils.GenerateBlockHash(chain.Blocks[1].Header.PreviousHash, chain.Blocks[1].Header.DataHash, 1)}, false, 0},
+		{"diverging checkpoint", &checkpoint.Checkpoint{ChannelId: "mychannel", BlockNumber: 0, BlockHash: "other"}, true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := newTestSource(t, chain)
+			bt, client, b := newTestBeater(t, source)
+			if test.checkpoint != nil {
+				bt.checkpointer.Save(test.checkpoint)
+			}
+
+			err := bt.rampUp(b)
+			if test.expectError {
+				if err == nil {
+					t.Fatal("expected an error because of the hash mismatch")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if blockEvents := client.eventsOf(bt.config.BlockIndexName); len(blockEvents) != test.expectedBlocks {
+				t.Errorf("%d block events instead of %d", len(blockEvents), test.expectedBlocks)
+			}
+			if bt.lastBlockNums["mychannel"] != 2 {
+				t.Errorf("last block number is %d instead of 2", bt.lastBlockNums["mychannel"])
+			}
+		})
+	}
+}
+
+func TestAckEventsSavesLastCheckpoint(t *testing.T) {
+	bt, _, _ := newTestBeater(t)
+	bt.pendingBlocks = 3
+	bt.ackEvents([]interface{}{
+		&checkpoint.Checkpoint{ChannelId: "mychannel", BlockNumber: 4, BlockHash: "a"},
+		nil,
+		&checkpoint.Checkpoint{ChannelId: "mychannel", BlockNumber: 5, BlockHash: "b"},
+		&checkpoint.Checkpoint{ChannelId: "otherchannel", BlockNumber: 1, BlockHash: "c"},
+	})
+	// The output callback only records the acknowledged blocks
+	if cp, _ := bt.checkpointer.Load("mychannel"); cp != nil {
+		t.Errorf("checkpoint %+v saved before the flush", cp)
+	}
+	select {
+	case <-bt.ackSignal:
+	default:
+		t.Error("checkpoint flusher not signaled")
+	}
+
+	bt.flushCheckpoints(false)
+	cp, _ := bt.checkpointer.Load("mychannel")
+	if cp == nil || cp.BlockNumber != 5 {
+		t.Errorf("checkpoint of mychannel is %+v instead of block 5", cp)
+	}
+	if cp, _ := bt.checkpointer.Load("otherchannel"); cp == nil || cp.BlockNumber != 1 {
+		t.Errorf("checkpoint of otherchannel is %+v instead of block 1", cp)
+	}
+	if bt.pendingBlocks != 0 {
+		t.Errorf("%d blocks are pending instead of 0", bt.pendingBlocks)
+	}
+}
+
+func TestAckEventsSavesCheckpointsInBatches(t *testing.T) {
+	bt, _, _ := newTestBeater(t)
+	bt.config.CheckpointBatchSize = 3
+	bt.pendingBlocks = 5
+
+	ack := func(blockNumber uint64) {
+		bt.ackEvents([]interface{}{&checkpoint.Checkpoint{ChannelId: "mychannel", BlockNumber: blockNumber}})
+		bt.flushCheckpoints(false)
+	}
+	tests := []struct {
+		ackedBlock     uint64
+		expectedSaved  uint64
+		expectedExists bool
+	}{
+		{0, 0, false},
+		{1, 0, false},
+		// Batch of 3 blocks
+		{2, 2, true},
+		{3, 2, true},
+		// Every published block acknowledged
+		{4, 4, true},
+	}
+	for _, test := range tests {
+		ack(test.ackedBlock)
+		cp, _ := bt.checkpointer.Load("mychannel")
+		if (cp != nil) != test.expectedExists || (cp != nil && cp.BlockNumber != test.expectedSaved) {
+			t.Errorf("after block %d: checkpoint is %+v instead of block %d (saved: %v)", test.ackedBlock, cp, test.expectedSaved, test.expectedExists)
+		}
+	}
+}
+
+// Fails to save the checkpoints of the given channel
+type failingCheckpointer struct {
+	memoryCheckpointer
+	channelId string
+}
+
+func (f failingCheckpointer) Save(cp *checkpoint.Checkpoint) error {
+	if cp.ChannelId == f.channelId {
+		return fmt.Errorf("checkpoint store of channel %s is unavailable", cp.ChannelId)
+	}
+	return f.memoryCheckpointer.Save(cp)
+}
+
+func TestFlushCheckpoints(t *testing.T) {
+	bt, _, _ := newTestBeater(t)
+	bt.config.CheckpointBatchSize = 10
+	checkpointer := failingCheckpointer{memoryCheckpointer: memoryCheckpointer{}, channelId: "otherchannel"}
+	bt.checkpointer = checkpointer
+	bt.pendingBlocks = 5
+
+	bt.ackEvents([]interface{}{
+		&checkpoint.Checkpoint{ChannelId: "mychannel", BlockNumber: 0},
+		&checkpoint.Checkpoint{ChannelId: "otherchannel", BlockNumber: 0},
+	})
+	bt.flushCheckpoints(false)
+	if cp, _ := checkpointer.Load("mychannel"); cp != nil {
+		t.Errorf("checkpoint %+v saved before the batch is full", cp)
+	}
+
+	// Stopping saves every acknowledged block, even if blocks are still pending
+	bt.flushCheckpoints(true)
+	if cp, _ := checkpointer.Load("mychannel"); cp == nil || cp.BlockNumber != 0 {
+		t.Errorf("checkpoint of mychannel is %+v instead of block 0", cp)
+	}
+	acked, ok := bt.ackedBlocks["otherchannel"]
+	if !ok || acked.checkpoint.BlockNumber != 0 || acked.count != 1 {
+		t.Errorf("failed checkpoint of otherchannel is not kept for the next flush: %+v", acked)
+	}
+	if _, ok := bt.ackedBlocks["mychannel"]; ok {
+		t.Error("saved checkpoint of mychannel is kept")
+	}
+
+	// The failed checkpoint is retried with the next acknowledged block
+	checkpointer.channelId = ""
+	bt.checkpointer = checkpointer
+	bt.ackEvents([]interface{}{&checkpoint.Checkpoint{ChannelId: "otherchannel", BlockNumber: 1}})
+	bt.flushCheckpoints(true)
+	if cp, _ := checkpointer.Load("otherchannel"); cp == nil || cp.BlockNumber != 1 {
+		t.Errorf("checkpoint of otherchannel is %+v instead of block 1", cp)
+	}
+}
+
+// Adds fabcar blocks, a config update and more fabcar blocks to the test chain
+func newLongTestChain() *blocktest.Chain {
+	chain := newTestChain()
+	for i := 0; i < 10; i++ {
+		chain.AddBlock(&blocktest.Tx{
+			Chaincode: "fabcar",
+			Version:   "1.0",
+			Function:  "createCar",
+			Writes:    []*kvrwset.KVWrite{{Key: fmt.Sprintf("CAR%d", i+10), Value: []byte(`{"owner":"Tom"}`)}},
+		})
+		if i == 4 {
+			chain.AddConfigBlock(&common.Config{Sequence: 2, ChannelGroup: &common.ConfigGroup{}})
+		}
+	}
+	return chain
+}
+
+func TestProcessNewBlocksInParallel(t *testing.T) {
+	chain := newLongTestChain()
+	height := uint64(len(chain.Blocks))
+
+	// The parallel pipeline has to publish the same events in the same order as the sequential processing
+	var sequentialIds []string
+	for _, workers := range []int{1, 2, 4, 16} {
+		source := newTestSource(t, chain)
+		bt, client, b := newTestBeater(t, source)
+		bt.config.FetchWorkers = workers
+
+		err := bt.ProcessNewBlocks(b, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bt.lastBlockNums["mychannel"] != height {
+			t.Errorf("%d workers: last block number is %d instead of %d", workers, bt.lastBlockNums["mychannel"], height)
+		}
+		for i, event := range client.eventsOf(bt.config.BlockIndexName) {
+			if event.Fields["block_number"] != uint64(i) {
+				t.Errorf("%d workers: block %v published as block %d", workers, event.Fields["block_number"], i)
+			}
+		}
+		if configEvents := client.eventsOf(bt.config.ConfigIndexName); len(configEvents) != 2 {
+			t.Errorf("%d workers: %d config events instead of 2", workers, len(configEvents))
+		}
+
+		ids := []string{}
+		for _, event := range client.events {
+			ids = append(ids, fmt.Sprint(event.Meta["id"]))
+		}
+		if sequentialIds == nil {
+			sequentialIds = ids
+			continue
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(sequentialIds) {
+			t.Errorf("%d workers: events %v instead of %v", workers, ids, sequentialIds)
+		}
+	}
+}
+
+func TestRampUpChannelsInParallel(t *testing.T) {
+	chains := []*blocktest.Chain{newLongTestChain(), blocktest.NewChain("otherchannel")}
+	chains[1].AddConfigBlock(&common.Config{Sequence: 1, ChannelGroup: &common.ConfigGroup{}})
+	chains[1].AddBlock(&blocktest.Tx{Chaincode: "fabcar", Function: "initLedger"})
+
+	sources := []blocksource.BlockSource{}
+	for _, chain := range chains {
+		sources = append(sources, newTestSource(t, chain))
+	}
+	bt, client, b := newTestBeater(t, sources...)
+	err := bt.rampUp(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chain := range chains {
+		height := uint64(len(chain.Blocks))
+		if bt.lastBlockNums[chain.ChannelId] != height {
+			t.Errorf("last block number of %s is %d instead of %d", chain.ChannelId, bt.lastBlockNums[chain.ChannelId], height)
+		}
+		// The blocks of each channel are published in order
+		var next uint64
+		for _, event := range client.eventsOf(bt.config.BlockIndexName) {
+			if event.Fields["channel_id"] != chain.ChannelId {
+				continue
+			}
+			if event.Fields["block_number"] != next {
+				t.Errorf("block %v of %s published instead of block %d", event.Fields["block_number"], chain.ChannelId, next)
+			}
+			next++
+		}
+		if next != height {
+			t.Errorf("%d blocks of %s published instead of %d", next, chain.ChannelId, height)
+		}
+	}
+}
+
+// A block source whose height cannot be queried for the first failures attempts, like a peer that is restarting
+type flakySource struct {
+	blocksource.BlockSource
+	mutex    sync.Mutex
+	failures int
+	attempts int
+}
+
+func (s *flakySource) Height() (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attempts++
+	if s.attempts <= s.failures {
+		return 0, errors.New("peer unavailable")
+	}
+	return s.BlockSource.Height()
+}
+
+func TestQuarantinePoisonBlock(t *testing.T) {
+	chain := newTestChain()
+	// The transaction of the block is replaced with data that is not an envelope once the source is created, the block cannot be decoded
+	poisonBlock := chain.AddBlock(&blocktest.Tx{
+		Chaincode: "fabcar",
+		Version:   "1.0",
+		Function:  "createCar",
+		Writes:    []*kvrwset.KVWrite{{Key: "CAR2", Value: []byte(`{"owner":"Tom"}`)}},
+	})
+	envelope := poisonBlock.Data.Data[0]
+	chain.AddBlock(&blocktest.Tx{
+		Chaincode: "fabcar",
+		Version:   "1.0",
+		Function:  "createCar",
+		Writes:    []*kvrwset.KVWrite{{Key: "CAR3", Value: []byte(`{"owner":"Anna"}`)}},
+	})
+
+	for _, workers := range []int{1, 4} {
+		poisonBlock.Data.Data[0] = envelope
+		source := newTestSource(t, chain)
+		poisonBlock.Data.Data[0] = []byte("not an envelope")
+		bt, client, b := newTestBeater(t, source)
+		bt.config.FetchWorkers = workers
+
+		err := bt.ProcessNewBlocks(b, source)
+		if err != nil {
+			t.Fatalf("%d workers: %s", workers, err)
+		}
+		deadLetters := client.eventsOf(bt.config.DeadLetterIndexName)
+		if len(deadLetters) != 1 {
+			t.Fatalf("%d workers: %d dead-letter events instead of 1", workers, len(deadLetters))
+		}
+		if deadLetters[0].Fields["block_number"] != uint64(2) || deadLetters[0].Fields["error"] == "" || deadLetters[0].Fields["block"] == nil {
+			t.Errorf("%d workers: unexpected dead-letter event %v", workers, deadLetters[0].Fields)
+		}
+		if _, ok := deadLetters[0].Private.(*checkpoint.Checkpoint); !ok {
+			t.Errorf("%d workers: the dead-letter event does not advance the checkpoint", workers)
+		}
+		// The channel continues with the block after the poison block
+		if blockEvents := client.eventsOf(bt.config.BlockIndexName); len(blockEvents) != 3 {
+			t.Errorf("%d workers: %d block events instead of 3", workers, len(blockEvents))
+		}
+		if bt.lastBlockNums["mychannel"] != 4 {
+			t.Errorf("%d workers: last block number is %d instead of 4", workers, bt.lastBlockNums["mychannel"])
+		}
+	}
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	tests := []struct {
+		name             string
+		ingestion        string
+		failures         int
+		expectError      bool
+		expectedAttempts int
+	}{
+		{"recovers after retries", config.IngestionPolling, 3, false, 4},
+		{"offline channel given up", config.IngestionBlocks, 10, true, offlineRetryAttempts + 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flaky := &flakySource{BlockSource: newTestSource(t, newTestChain()), failures: test.failures}
+			otherChain := blocktest.NewChain("otherchannel")
+			otherChain.AddConfigBlock(&common.Config{Sequence: 1, ChannelGroup: &common.ConfigGroup{}})
+			bt, client, b := newTestBeater(t, flaky, newTestSource(t, otherChain))
+			bt.config.Ingestion = test.ingestion
+			bt.config.RetryInitialBackoff = time.Millisecond
+			bt.config.RetryMaxBackoff = 4 * time.Millisecond
+
+			err := bt.rampUp(b)
+			if test.expectError != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if flaky.attempts != test.expectedAttempts {
+				t.Errorf("%d attempts instead of %d", flaky.attempts, test.expectedAttempts)
+			}
+			// The errors of a channel do not stop the other channels
+			if bt.lastBlockNums["otherchannel"] != 1 {
+				t.Errorf("last block number of otherchannel is %d instead of 1", bt.lastBlockNums["otherchannel"])
+			}
+			expectedBlocks := 3
+			if test.expectError {
+				expectedBlocks = 1
+			}
+			if blockEvents := client.eventsOf(bt.config.BlockIndexName); len(blockEvents) != expectedBlocks {
+				t.Errorf("%d block events instead of %d", len(blockEvents), expectedBlocks)
+			}
+		})
+	}
+}
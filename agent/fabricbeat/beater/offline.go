@@ -0,0 +1,33 @@
+package beater
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Sends the data of every block of the block sources that do not need a running peer (block files of a peer ledger, .block files),
+// the channels in parallel. Blocks up to the checkpoint of a channel are skipped. Returns when every block has been acknowledged by the output,
+// with the first error that stopped a channel, if any.
+func (bt *Fabricbeat) runOffline(b *beat.Beat) error {
+	err := bt.rampUp(b)
+	if err != nil {
+		logp.Warn("The ingestion has stopped on some channels, waiting for the events of the other channels to be acknowledged")
+	} else {
+		logp.Info("Every block has been read, waiting for the events to be acknowledged")
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&bt.pendingBlocks) > 0 {
+		select {
+		case <-bt.done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+	bt.flushCheckpoints(true)
+	logp.Info("Offline ingestion finished")
+	return err
+}
@@ -0,0 +1,96 @@
+package beater
+
+import (
+	"github.com/elastic/beats/libbeat/beat"
+
+	protoCommon "github.com/hyperledger/fabric-protos-go/common"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/ledgerutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/retry"
+	"github.com/blockchain-analyzer/agent/agentmodules/transform"
+)
+
+// A block of the pipeline. The records are set by the worker that fetched and decoded the block, done is closed when the worker is finished.
+type pipelineBlock struct {
+	number   uint64
+	block    *protoCommon.Block
+	typeInfo string
+	records  *transform.Records
+	err      error
+	done     chan struct{}
+}
+
+// Gets the blocks from the last known block up to (but not including) the specified block number with fetchWorkers workers,
+// which fetch and decode the blocks in parallel, and sends their data to Elasticsearch in block order.
+// The blocks of sequential sources (block files) are fetched by a single goroutine and only decoded in parallel.
+// Config blocks are decoded when they are published, since their records depend on the previous config of the channel.
+func (bt *Fabricbeat) processBlockRangeParallel(b *beat.Beat, source blocksource.BlockSource, endBlockNumber uint64) error {
+	workers := bt.config.FetchWorkers
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// Every block is queued for publishing first, then handed to a worker. The size of the queue bounds the number of blocks in memory.
+	queue := make(chan *pipelineBlock, 2*workers)
+	jobs := make(chan *pipelineBlock, workers)
+	go func() {
+		defer close(queue)
+		defer close(jobs)
+		sequential := blocksource.IsSequential(source)
+		for blockNumber := bt.lastBlockNum(source.ChannelID()); blockNumber < endBlockNumber; blockNumber++ {
+			pb := &pipelineBlock{number: blockNumber, done: make(chan struct{})}
+			if sequential {
+				pb.block, pb.err = source.Block(blockNumber)
+			}
+			select {
+			case queue <- pb:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- pb:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for pb := range jobs {
+				if pb.block == nil && pb.err == nil {
+					pb.block, pb.err = source.Block(pb.number)
+				}
+				if pb.err == nil {
+					pb.typeInfo, _, _, pb.err = ledgerutils.ProcessBlockData(pb.block)
+					pb.err = retry.Permanent(pb.err)
+				}
+				if pb.err == nil && pb.typeInfo == transform.EndorserTransaction {
+					pb.records, pb.err = bt.transformBlock(source, pb.block, pb.typeInfo)
+				}
+				close(pb.done)
+			}
+		}()
+	}
+
+	for pb := range queue {
+		select {
+		case <-pb.done:
+		case <-bt.done:
+			return nil
+		}
+		if pb.err == nil && pb.records == nil {
+			pb.records, pb.err = bt.transformBlock(source, pb.block, pb.typeInfo)
+		}
+		// Blocks that cannot be decoded are sent to the dead-letter index, the channel continues with the next block
+		if retry.IsPermanent(pb.err) {
+			bt.quarantineBlock(b, source, pb.block, pb.err)
+			continue
+		}
+		if pb.err != nil {
+			return pb.err
+		}
+		bt.publishRecords(b, source, pb.records)
+	}
+	return nil
+}
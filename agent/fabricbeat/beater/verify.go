@@ -0,0 +1,102 @@
+package beater
+
+import (
+	"time"
+
+	"github.com/blockchain-analyzer/agent/fabricbeat/config"
+
+	"github.com/elastic/beats/libbeat/beat"
+	libbeatCommon "github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+
+	"github.com/pkg/errors"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/fabricbeat/modules/elastic"
+	"github.com/blockchain-analyzer/agent/fabricbeat/modules/verify"
+)
+
+// Verifies the indexed blocks of the channels of the peer (or only the specified channel if channelId is not empty),
+// comparing sampleSize blocks of each channel against the ledger. Used by the verify command.
+func VerifyChannels(c config.Config, channelId string, sampleSize int) ([]*verify.Report, error) {
+	fSetup := newFabricSetup(c)
+	err := fSetup.Initialize()
+	if err != nil {
+		return nil, err
+	}
+	defer fSetup.CloseSDK()
+
+	reports := []*verify.Report{}
+	for _, ledgerClient := range fSetup.LedgerClients {
+		if channelId != "" && fSetup.Channels[ledgerClient] != channelId {
+			continue
+		}
+		report, err := verifyChannel(c, blocksource.NewLedgerSource(fSetup.Channels[ledgerClient], ledgerClient), sampleSize)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	if channelId != "" && len(reports) == 0 {
+		return nil, errors.Errorf("peer %s is not a member of channel %s", c.Peer, channelId)
+	}
+	return reports, nil
+}
+
+// Gets the indexed blocks of a channel from Elasticsearch and verifies them against the block source.
+func verifyChannel(c config.Config, source blocksource.BlockSource, sampleSize int) (*verify.Report, error) {
+	channelId := source.ChannelID()
+	blocks, err := elastic.GetBlocks(c.ElasticURL, c.BlockIndexName, c.Organization, c.Peer, channelId)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to get the indexed blocks of channel "+channelId)
+	}
+	return verify.VerifyChannel(channelId, c.Peer, blocks, source, sampleSize), nil
+}
+
+// Verifies the indexed blocks of every channel periodically, and sends the reports to the "verification" index.
+func (bt *Fabricbeat) runVerification(b *beat.Beat) {
+	ticker := time.NewTicker(bt.config.VerifyPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bt.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, source := range bt.sources {
+			channelId := source.ChannelID()
+			report, err := verifyChannel(bt.config, source, bt.config.VerifySampleSize)
+			if err != nil {
+				logp.Warn("Verification of channel %s failed: %s", channelId, err.Error())
+				continue
+			}
+			if report.OK() {
+				logp.Info("Verification of channel %s found no problems in %d blocks", channelId, report.BlockCount)
+			} else {
+				logp.Warn("Verification of channel %s found %d gaps, %d mismatches and %d errors", channelId, len(report.Gaps), len(report.Mismatches), len(report.Errors))
+			}
+
+			event := beat.Event{
+				Timestamp: time.Now(),
+				Fields: libbeatCommon.MapStr{
+					"type":             b.Info.Name,
+					"channel_id":       channelId,
+					"index_name":       bt.config.VerificationIndexName,
+					"peer":             bt.config.Peer,
+					"verified_at":      report.VerifiedAt,
+					"ok":               report.OK(),
+					"block_count":      report.BlockCount,
+					"first_block":      report.FirstBlock,
+					"last_block":       report.LastBlock,
+					"sampled_blocks":   report.SampledBlocks,
+					"gaps":             report.Gaps,
+					"mismatches":       report.Mismatches,
+					"divergent_ranges": report.DivergentRanges,
+					"errors":           report.Errors,
+				},
+			}
+			bt.client.Publish(event)
+		}
+	}
+}
@@ -10,5 +10,11 @@ import (
 // Name of this beat
 var Name = "fabricbeat"
 
+var settings = instance.Settings{Name: Name}
+
 // RootCmd to handle beats cli
-var RootCmd = cmd.GenRootCmdWithSettings(beater.New, instance.Settings{Name: Name})
+var RootCmd = cmd.GenRootCmdWithSettings(beater.New, settings)
+
+func init() {
+	RootCmd.AddCommand(genVerifyCmd(settings))
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/blockchain-analyzer/agent/fabricbeat/beater"
+	"github.com/blockchain-analyzer/agent/fabricbeat/config"
+
+	"github.com/elastic/beats/libbeat/cmd/instance"
+)
+
+// Generates the verify command, which walks the indexed blocks of the channels and writes a json report
+// of the gaps, mismatches and divergent ranges found. Problems found in the index do not make the command fail.
+func genVerifyCmd(settings instance.Settings) *cobra.Command {
+	var channelId, output string
+	var sampleSize int
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the indexed blocks against each other and the ledger",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := runVerify(settings, channelId, sampleSize, output)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Verification failed: %s\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	verifyCmd.Flags().StringVar(&channelId, "channel", "", "Channel to verify (defaults to every channel of the peer)")
+	verifyCmd.Flags().IntVar(&sampleSize, "sample", config.DefaultConfig.VerifySampleSize, "Number of blocks per channel compared against the ledger")
+	verifyCmd.Flags().StringVar(&output, "output", "", "File to write the report to (defaults to stdout)")
+	return verifyCmd
+}
+
+func runVerify(settings instance.Settings, channelId string, sampleSize int, output string) error {
+	b, err := instance.NewInitializedBeat(settings)
+	if err != nil {
+		return err
+	}
+	cfg, err := b.BeatConfig()
+	if err != nil {
+		return err
+	}
+	c := config.DefaultConfig
+	err = cfg.Unpack(&c)
+	if err != nil {
+		return fmt.Errorf("Error reading config file: %v", err)
+	}
+
+	reports, err := beater.VerifyChannels(c, channelId, sampleSize)
+	if err != nil {
+		return err
+	}
+	report, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		fmt.Println(string(report))
+		return nil
+	}
+	return ioutil.WriteFile(output, report, 0644)
+}
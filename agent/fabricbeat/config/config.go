@@ -5,40 +5,88 @@ package config
 
 import (
 	"time"
+
 	"github.com/blockchain-analyzer/agent/agentmodules/fabricsetup"
 )
 
+// Ingestion modes: polling queries the block height of the channels periodically,
+// deliver receives the new blocks from the Deliver service of the peers,
+// blockfile reads the blocks from a copy of the block files of a peer ledger without connecting to the network,
+// blocks reads .block files (e.g. the output of peer channel fetch) from a directory or from the standard input.
+const (
+	IngestionPolling   = "polling"
+	IngestionDeliver   = "deliver"
+	IngestionBlockfile = "blockfile"
+	IngestionBlocks    = "blocks"
+)
+
+// Checkpoint stores: the last processed block of each channel is kept either in Elasticsearch
+// or in a local file, which does not depend on the output of the agent.
+const (
+	CheckpointElasticsearch = "elasticsearch"
+	CheckpointFile          = "file"
+)
+
 type Config struct {
-	Period               time.Duration `config:"period"`
-	Organization         string        `config:"organization"`
-	Peer                 string        `config:"peer"`
-	ConnectionProfile    string        `config:"connectionProfile"`
-	AdminCertPath        string        `config:"adminCertPath"`
-	AdminKeyPath         string        `config:"adminKeyPath"`
-	ElasticURL           string        `config:"elasticURL"`
-	KibanaURL            string        `config:"kibanaURL"`
-	BlockIndexName       string        `config:"blockIndexName"`
-	TransactionIndexName string        `config:"transactionIndexName"`
-	KeyIndexName         string        `config:"keyIndexName"`
-	DashboardDirectory   string        `config:"dashboardDirectory"`
-	TemplateDirectory    string        `config:"templateDirectory"`
-	Chaincodes           []fabricsetup.Chaincode   `config:"chaincodes"`
+	Ingestion             string                  `config:"ingestion"`
+	Period                time.Duration           `config:"period"`
+	Organization          string                  `config:"organization"`
+	Peer                  string                  `config:"peer"`
+	ConnectionProfile     string                  `config:"connectionProfile"`
+	AdminCertPath         string                  `config:"adminCertPath"`
+	AdminKeyPath          string                  `config:"adminKeyPath"`
+	ElasticURL            string                  `config:"elasticURL"`
+	KibanaURL             string                  `config:"kibanaURL"`
+	BlockIndexName        string                  `config:"blockIndexName"`
+	TransactionIndexName  string                  `config:"transactionIndexName"`
+	KeyIndexName          string                  `config:"keyIndexName"`
+	ConfigIndexName       string                  `config:"configIndexName"`
+	EventIndexName        string                  `config:"eventIndexName"`
+	VerificationIndexName string                  `config:"verificationIndexName"`
+	DivergenceIndexName   string                  `config:"divergenceIndexName"`
+	DeadLetterIndexName   string                  `config:"deadLetterIndexName"`
+	DashboardDirectory    string                  `config:"dashboardDirectory"`
+	TemplateDirectory     string                  `config:"templateDirectory"`
+	Chaincodes            []fabricsetup.Chaincode `config:"chaincodes"`
+	SkipInvalidWrites     bool                    `config:"skipInvalidWrites"`
+	MaxArgSize            int                     `config:"maxArgSize"`
+	MaxResponseSize       int                     `config:"maxResponseSize"`
+	PrivateData           bool                    `config:"privateData"`
+	BlockfilePath         string                  `config:"blockfilePath"`
+	BlocksPath            string                  `config:"blocksPath"`
+	CheckpointType        string                  `config:"checkpointType"`
+	CheckpointPath        string                  `config:"checkpointPath"`
+	VerifyPeriod          time.Duration           `config:"verifyPeriod"`
+	VerifySampleSize      int                     `config:"verifySampleSize"`
+	CrossCheckPeers       []string                `config:"crossCheckPeers"`
+	CrossCheckPeriod      time.Duration           `config:"crossCheckPeriod"`
+	MaxPeerLag            uint64                  `config:"maxPeerLag"`
+	FetchWorkers          int                     `config:"fetchWorkers"`
+	CheckpointBatchSize   int                     `config:"checkpointBatchSize"`
+	RetryInitialBackoff   time.Duration           `config:"retryInitialBackoff"`
+	RetryMaxBackoff       time.Duration           `config:"retryMaxBackoff"`
 }
 
 var DefaultConfig = Config{
-	Period:               1 * time.Second,
-	Organization:         "org1",
-	Peer:                 "peer0.org1.el-network.com",
-	ConnectionProfile:    "connection.yaml",
-	AdminCertPath:        "/home/prehi/internship/testNetwork/blockchain-analyzer/network/crypto-config/peerOrganizations/org1.el-network.com/users/Admin@org1.el-network.com/msp/signcerts/Admin@org1.el-network.com-cert.pem",
-	AdminKeyPath:         "/home/prehi/internship/testNetwork/blockchain-analyzer/network/crypto-config/peerOrganizations/org1.el-network.com/users/Admin@org1.el-network.com/msp/keystore/adminKey1",
-	ElasticURL:           "http://localhost:9200",
-	KibanaURL:            "http://localhost:5601",
-	BlockIndexName:       "block",
-	TransactionIndexName: "transaction",
-	KeyIndexName:         "key",
-	DashboardDirectory:   "/home/prehi/internship/testNetwork/blockchain-analyzer/dashboards",
-	TemplateDirectory:    "/home/prehi/internship/testNetwork/blockchain-analyzer/agent/kibana_templates",
+	Ingestion:             IngestionPolling,
+	Period:                1 * time.Second,
+	Organization:          "org1",
+	Peer:                  "peer0.org1.el-network.com",
+	ConnectionProfile:     "connection.yaml",
+	AdminCertPath:         "/home/prehi/internship/testNetwork/blockchain-analyzer/network/crypto-config/peerOrganizations/org1.el-network.com/users/Admin@org1.el-network.com/msp/signcerts/Admin@org1.el-network.com-cert.pem",
+	AdminKeyPath:          "/home/prehi/internship/testNetwork/blockchain-analyzer/network/crypto-config/peerOrganizations/org1.el-network.com/users/Admin@org1.el-network.com/msp/keystore/adminKey1",
+	ElasticURL:            "http://localhost:9200",
+	KibanaURL:             "http://localhost:5601",
+	BlockIndexName:        "block",
+	TransactionIndexName:  "transaction",
+	KeyIndexName:          "key",
+	ConfigIndexName:       "config",
+	EventIndexName:        "event",
+	VerificationIndexName: "verification",
+	DivergenceIndexName:   "divergence",
+	DeadLetterIndexName:   "dead_letter",
+	DashboardDirectory:    "/home/prehi/internship/testNetwork/blockchain-analyzer/dashboards",
+	TemplateDirectory:     "/home/prehi/internship/testNetwork/blockchain-analyzer/agent/kibana_templates",
 	Chaincodes: []fabricsetup.Chaincode{
 		fabricsetup.Chaincode{
 			Name:       "mycc",
@@ -46,4 +94,21 @@ var DefaultConfig = Config{
 			Values:     []string{"myvalue"},
 		},
 	},
+	SkipInvalidWrites:   false,
+	MaxArgSize:          1024,
+	MaxResponseSize:     0,
+	PrivateData:         false,
+	BlockfilePath:       "",
+	BlocksPath:          "",
+	CheckpointType:      CheckpointElasticsearch,
+	CheckpointPath:      "",
+	VerifyPeriod:        0,
+	VerifySampleSize:    10,
+	CrossCheckPeers:     []string{},
+	CrossCheckPeriod:    1 * time.Minute,
+	MaxPeerLag:          10,
+	FetchWorkers:        4,
+	CheckpointBatchSize: 100,
+	RetryInitialBackoff: 1 * time.Second,
+	RetryMaxBackoff:     1 * time.Minute,
 }
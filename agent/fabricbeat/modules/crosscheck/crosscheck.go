@@ -0,0 +1,135 @@
+package crosscheck
+
+import (
+	"github.com/blockchain-analyzer/agent/agentmodules/ledgerutils"
+
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
+)
+
+// Types of the divergences between the peers of a channel
+const (
+	// The peer could not be queried
+	Unreachable = "unreachable"
+	// The block height of the peer is behind the highest block height by more than the allowed lag
+	Lag = "lag"
+	// The peer has a different block at the same height than the reference peer
+	HashMismatch = "hash_mismatch"
+)
+
+// Queries the ledgers of the peers of a channel
+type PeerLedger interface {
+	// Gets the block height of the peer (the name of the peer in the connection profile)
+	BlockHeight(peer string) (uint64, error)
+	// Gets the hash of the specified block from the peer
+	BlockHash(blockNumber uint64, peer string) (string, error)
+}
+
+// Queries the peers with the ledger client of the channel
+type LedgerClientPeers struct {
+	Client *ledger.Client
+}
+
+func (peers LedgerClientPeers) BlockHeight(peer string) (uint64, error) {
+	return ledgerutils.GetBlockHeightFromPeer(peers.Client, peer)
+}
+
+func (peers LedgerClientPeers) BlockHash(blockNumber uint64, peer string) (string, error) {
+	return ledgerutils.GetBlockHashFromPeer(blockNumber, peers.Client, peer)
+}
+
+type Divergence struct {
+	Type            string `json:"type"`
+	ChannelId       string `json:"channelId"`
+	Peer            string `json:"peer"`
+	ReferencePeer   string `json:"referencePeer"`
+	BlockNumber     uint64 `json:"blockNumber"`
+	Hash            string `json:"hash"`
+	ReferenceHash   string `json:"referenceHash"`
+	Height          uint64 `json:"height"`
+	ReferenceHeight uint64 `json:"referenceHeight"`
+	Lag             uint64 `json:"lag"`
+	Error           string `json:"error"`
+}
+
+// Compares the peers of a channel. The reference peer is the peer the agent reads the ledger from.
+// Checks that no peer lags behind the highest block height by more than maxLag blocks, and compares the block hashes
+// of the peers with the reference peer from block fromBlock up to the lowest block height of the reachable peers,
+// comparing at most maxBlocks blocks (0 means no limit), so a long chain is walked over several checks.
+// Returns the divergences found and the block number to continue the hash comparison from in the next check.
+func CheckChannel(channelId string, peerLedger PeerLedger, referencePeer string, peers []string, maxLag, fromBlock, maxBlocks uint64) ([]*Divergence, uint64) {
+	divergences := []*Divergence{}
+
+	heights := map[string]uint64{}
+	reachablePeers := []string{}
+	for _, peer := range append([]string{referencePeer}, peers...) {
+		height, err := peerLedger.BlockHeight(peer)
+		if err != nil {
+			divergences = append(divergences, &Divergence{Type: Unreachable, ChannelId: channelId, Peer: peer, ReferencePeer: referencePeer, Error: err.Error()})
+			continue
+		}
+		heights[peer] = height
+		reachablePeers = append(reachablePeers, peer)
+	}
+	if _, ok := heights[referencePeer]; !ok || len(reachablePeers) < 2 {
+		return divergences, fromBlock
+	}
+
+	var maxHeight uint64
+	commonHeight := heights[referencePeer]
+	for _, peer := range reachablePeers {
+		if heights[peer] > maxHeight {
+			maxHeight = heights[peer]
+		}
+		if heights[peer] < commonHeight {
+			commonHeight = heights[peer]
+		}
+	}
+	for _, peer := range reachablePeers {
+		if maxHeight-heights[peer] > maxLag {
+			divergences = append(divergences, &Divergence{
+				Type:            Lag,
+				ChannelId:       channelId,
+				Peer:            peer,
+				ReferencePeer:   referencePeer,
+				Height:          heights[peer],
+				ReferenceHeight: maxHeight,
+				Lag:             maxHeight - heights[peer],
+			})
+		}
+	}
+
+	// Comparing the blocks that every reachable peer has
+	toBlock := commonHeight
+	if maxBlocks > 0 && fromBlock+maxBlocks < toBlock {
+		toBlock = fromBlock + maxBlocks
+	}
+	for blockNumber := fromBlock; blockNumber < toBlock; blockNumber++ {
+		referenceHash, err := peerLedger.BlockHash(blockNumber, referencePeer)
+		if err != nil {
+			divergences = append(divergences, &Divergence{Type: Unreachable, ChannelId: channelId, Peer: referencePeer, ReferencePeer: referencePeer, BlockNumber: blockNumber, Error: err.Error()})
+			return divergences, blockNumber
+		}
+		for _, peer := range reachablePeers[1:] {
+			hash, err := peerLedger.BlockHash(blockNumber, peer)
+			if err != nil {
+				divergences = append(divergences, &Divergence{Type: Unreachable, ChannelId: channelId, Peer: peer, ReferencePeer: referencePeer, BlockNumber: blockNumber, Error: err.Error()})
+				return divergences, blockNumber
+			}
+			if hash != referenceHash {
+				divergences = append(divergences, &Divergence{
+					Type:          HashMismatch,
+					ChannelId:     channelId,
+					Peer:          peer,
+					ReferencePeer: referencePeer,
+					BlockNumber:   blockNumber,
+					Hash:          hash,
+					ReferenceHash: referenceHash,
+				})
+			}
+		}
+	}
+	if toBlock > fromBlock {
+		return divergences, toBlock
+	}
+	return divergences, fromBlock
+}
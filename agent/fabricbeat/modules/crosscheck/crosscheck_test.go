@@ -0,0 +1,139 @@
+package crosscheck
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Ledgers of the peers of a channel kept in memory
+type fakeLedger struct {
+	heights     map[string]uint64
+	unreachable map[string]bool
+	// Blocks from which the hashes of a peer differ from the other peers
+	forks   map[string]uint64
+	queried []uint64
+}
+
+func (ledger *fakeLedger) BlockHeight(peer string) (uint64, error) {
+	if ledger.unreachable[peer] {
+		return 0, errors.New("connection refused")
+	}
+	return ledger.heights[peer], nil
+}
+
+func (ledger *fakeLedger) BlockHash(blockNumber uint64, peer string) (string, error) {
+	if ledger.unreachable[peer] || blockNumber >= ledger.heights[peer] {
+		return "", errors.New("block not found")
+	}
+	if peer == "peer0" {
+		ledger.queried = append(ledger.queried, blockNumber)
+	}
+	if fork, ok := ledger.forks[peer]; ok && blockNumber >= fork {
+		return fmt.Sprintf("%s-%d", peer, blockNumber), nil
+	}
+	return fmt.Sprintf("%d", blockNumber), nil
+}
+
+func TestCheckChannel(t *testing.T) {
+	tests := []struct {
+		name        string
+		ledger      *fakeLedger
+		maxLag      uint64
+		fromBlock   uint64
+		maxBlocks   uint64
+		divergences []string
+		nextBlock   uint64
+		queried     []uint64
+	}{
+		{
+			"matching peers",
+			&fakeLedger{heights: map[string]uint64{"peer0": 3, "peer1": 3}},
+			0, 0, 0,
+			[]string{},
+			3,
+			[]uint64{0, 1, 2},
+		},
+		{
+			"lagging peer",
+			&fakeLedger{heights: map[string]uint64{"peer0": 10, "peer1": 4}},
+			5, 0, 0,
+			[]string{"lag peer1 0"},
+			4,
+			[]uint64{0, 1, 2, 3},
+		},
+		{
+			"lag within the limit",
+			&fakeLedger{heights: map[string]uint64{"peer0": 10, "peer1": 6}},
+			5, 4, 0,
+			[]string{},
+			6,
+			[]uint64{4, 5},
+		},
+		{
+			"unreachable peer",
+			&fakeLedger{heights: map[string]uint64{"peer0": 3, "peer1": 3}, unreachable: map[string]bool{"peer1": true}},
+			0, 1, 0,
+			[]string{"unreachable peer1 0"},
+			1,
+			nil,
+		},
+		{
+			"hash mismatch",
+			&fakeLedger{heights: map[string]uint64{"peer0": 4, "peer1": 4}, forks: map[string]uint64{"peer1": 2}},
+			0, 0, 0,
+			[]string{"hash_mismatch peer1 2", "hash_mismatch peer1 3"},
+			4,
+			[]uint64{0, 1, 2, 3},
+		},
+		{
+			"capped first check",
+			&fakeLedger{heights: map[string]uint64{"peer0": 1000, "peer1": 1000}},
+			0, 0, 3,
+			[]string{},
+			3,
+			[]uint64{0, 1, 2},
+		},
+		{
+			"capped check carried over",
+			&fakeLedger{heights: map[string]uint64{"peer0": 1000, "peer1": 1000}, forks: map[string]uint64{"peer1": 4}},
+			0, 3, 3,
+			[]string{"hash_mismatch peer1 4", "hash_mismatch peer1 5"},
+			6,
+			[]uint64{3, 4, 5},
+		},
+		{
+			"cap above the common height",
+			&fakeLedger{heights: map[string]uint64{"peer0": 7, "peer1": 7}},
+			0, 5, 100,
+			[]string{},
+			7,
+			[]uint64{5, 6},
+		},
+		{
+			"nothing new",
+			&fakeLedger{heights: map[string]uint64{"peer0": 7, "peer1": 7}},
+			0, 7, 100,
+			[]string{},
+			7,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		divergences, nextBlock := CheckChannel("mychannel", test.ledger, "peer0", []string{"peer1"}, test.maxLag, test.fromBlock, test.maxBlocks)
+		found := []string{}
+		for _, divergence := range divergences {
+			found = append(found, fmt.Sprintf("%s %s %d", divergence.Type, divergence.Peer, divergence.BlockNumber))
+		}
+		if !reflect.DeepEqual(found, test.divergences) {
+			t.Errorf("%s: divergences %v instead of %v", test.name, found, test.divergences)
+		}
+		if nextBlock != test.nextBlock {
+			t.Errorf("%s: next block %d instead of %d", test.name, nextBlock, test.nextBlock)
+		}
+		if !reflect.DeepEqual(test.ledger.queried, test.queried) {
+			t.Errorf("%s: queried blocks %v instead of %v", test.name, test.ledger.queried, test.queried)
+		}
+	}
+}
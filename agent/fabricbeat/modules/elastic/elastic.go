@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/blockchain-analyzer/agent/agentmodules/checkpoint"
+
 	"github.com/elastic/beats/libbeat/logp"
 )
 
@@ -27,6 +29,7 @@ type BlockIndexFilterResponse struct {
 type BlockNumber struct {
 	BlockNumber uint64 `json:"blockNumber"`
 	ChannelId   string `json:"channelId"`
+	BlockHash   string `json:"blockHash"`
 }
 
 // This struct is for parsing the block number response from Elasticsearch.
@@ -40,19 +43,10 @@ type BlockNumberResponse struct {
 // Returns the hash of the specified block from the specified index.
 func GetBlockHash(elasticURL, blockIndexName, organization, peerName, channelId string, blockNumber uint64) (string, error) {
 	// Get the index from which we want to get the last known block
-	resp, err := http.Get(fmt.Sprintf(elasticURL+"/_cat/indices/fabricbeat-*%s*%s*", blockIndexName, organization))
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	blockIndex, err := getBlockIndex(elasticURL, blockIndexName, organization)
+	if err != nil || blockIndex == "" {
 		return "", err
 	}
-	defer resp.Body.Close()
-	// [2] is the name of the index
-	stringFields := strings.Fields(string(body))
-	logp.Info("Length of response: %d", len(stringFields))
-	if len(stringFields) < 3 {
-		return "", err
-	}
-	blockIndex := stringFields[2]
 
 	logp.Info("Index to get last known block from: %s", blockIndex)
 	// Retrieve the last known block from Elasticsearch
@@ -94,11 +88,11 @@ func GetBlockHash(elasticURL, blockIndexName, organization, peerName, channelId
 		return "", err
 	}
 	request.Header.Add("Content-Type", "application/json")
-	resp, err = httpClient.Do(request)
+	resp, err := httpClient.Do(request)
 	if err != nil {
 		return "", err
 	}
-	body, err = ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
 	}
@@ -123,7 +117,110 @@ func GetBlockHash(elasticURL, blockIndexName, organization, peerName, channelId
 	return blockHashFromElastic, nil
 }
 
+// Block data stored in the block index
+type IndexedBlock struct {
+	BlockNumber  uint64   `json:"block_number"`
+	ChannelId    string   `json:"channel_id"`
+	BlockHash    string   `json:"block_hash"`
+	PreviousHash string   `json:"previous_hash"`
+	DataHash     string   `json:"data_hash"`
+	Transactions []string `json:"transactions"`
+}
+
+// This struct is for parsing the block search response from Elasticsearch.
+type blockSearchResponse struct {
+	Hits struct {
+		Hits []struct {
+			Source IndexedBlock  `json:"_source"`
+			Sort   []interface{} `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// Returns every block of a channel from the block index ordered by block number. Pages through the index with search_after.
+func GetBlocks(elasticURL, blockIndexName, organization, peerName, channelId string) ([]*IndexedBlock, error) {
+	blocks := []*IndexedBlock{}
+	blockIndex, err := getBlockIndex(elasticURL, blockIndexName, organization)
+	if err != nil || blockIndex == "" {
+		return blocks, err
+	}
+
+	httpClient := &http.Client{}
+	url := fmt.Sprintf("%s/%s/_search", elasticURL, blockIndex)
+	searchAfter := ""
+	for {
+		requestBody := fmt.Sprintf(`{
+			"size": 1000,
+			"query": {
+			  "bool": {
+				"filter": [
+				  { "term": { "peer": { "value": "%s" } } },
+				  { "term": { "channel_id": { "value": "%s" } } }
+				]
+			  }
+			},
+			"sort": [ { "block_number": "asc" }, { "_id": "asc" } ]%s
+		}`, peerName, channelId, searchAfter)
+		request, err := http.NewRequest("GET", url, bytes.NewBufferString(requestBody))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Add("Content-Type", "application/json")
+		resp, err := httpClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 200 {
+			return nil, errors.New("Failed to get blocks from Elasticsearch: " + string(body))
+		}
+		var searchResponse blockSearchResponse
+		err = json.Unmarshal(body, &searchResponse)
+		if err != nil {
+			return nil, err
+		}
+		hits := searchResponse.Hits.Hits
+		if len(hits) == 0 {
+			return blocks, nil
+		}
+		for _, hit := range hits {
+			block := hit.Source
+			blocks = append(blocks, &block)
+		}
+		sortValues, err := json.Marshal(hits[len(hits)-1].Sort)
+		if err != nil {
+			return nil, err
+		}
+		searchAfter = fmt.Sprintf(`, "search_after": %s`, string(sortValues))
+	}
+}
+
+// Returns the name of the block index of the organization, or an empty string if it does not exist yet.
+func getBlockIndex(elasticURL, blockIndexName, organization string) (string, error) {
+	resp, err := http.Get(fmt.Sprintf(elasticURL+"/_cat/indices/fabricbeat-*%s*%s*", blockIndexName, organization))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	// [2] is the name of the index
+	stringFields := strings.Fields(string(body))
+	logp.Info("Length of response: %d", len(stringFields))
+	if len(stringFields) < 3 {
+		return "", nil
+	}
+	return stringFields[2], nil
+}
+
 // Sends a GET Http request to the sepcified URL, parses the response and returns the block number.
+// Returns nil if there is no block number document yet.
 func GetBlockNumber(url string) (*BlockNumber, error) {
 	var lastBlockNumber BlockNumber
 	resp, err := http.Get(url)
@@ -136,8 +233,8 @@ func GetBlockNumber(url string) (*BlockNumber, error) {
 	}
 	if resp.StatusCode == 404 {
 		// It is the very first start of the agent, there is no last block yet.
-		lastBlockNumber.BlockNumber = 0
-		logp.Info("Last known block number not found, setting to 0")
+		logp.Info("Last known block number not found")
+		return nil, nil
 	} else {
 		// Get the block number info from the response body
 		body, err := ioutil.ReadAll(resp.Body)
@@ -171,3 +268,43 @@ func SendBlockNumber(url string, lastBlockNumber BlockNumber) error {
 	}
 	return nil
 }
+
+// This implementation of the Checkpointer interface stores the last processed block of each channel
+// in the last_block_<peer>_<channel> documents of Elasticsearch.
+type Checkpointer struct {
+	ElasticURL     string
+	BlockIndexName string
+	Organization   string
+	Peer           string
+}
+
+func (ec *Checkpointer) Load(channelId string) (*checkpoint.Checkpoint, error) {
+	lastBlockNumber, err := GetBlockNumber(ec.url(channelId))
+	if err != nil || lastBlockNumber == nil {
+		return nil, err
+	}
+	// Documents written by earlier versions do not contain the block hash, it is taken from the block index instead
+	if lastBlockNumber.BlockHash == "" {
+		lastBlockNumber.BlockHash, err = GetBlockHash(ec.ElasticURL, ec.BlockIndexName, ec.Organization, ec.Peer, channelId, lastBlockNumber.BlockNumber)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &checkpoint.Checkpoint{
+		ChannelId:   channelId,
+		BlockNumber: lastBlockNumber.BlockNumber,
+		BlockHash:   lastBlockNumber.BlockHash,
+	}, nil
+}
+
+func (ec *Checkpointer) Save(cp *checkpoint.Checkpoint) error {
+	return SendBlockNumber(ec.url(cp.ChannelId), BlockNumber{
+		BlockNumber: cp.BlockNumber,
+		ChannelId:   cp.ChannelId,
+		BlockHash:   cp.BlockHash,
+	})
+}
+
+func (ec *Checkpointer) url(channelId string) string {
+	return fmt.Sprintf(ec.ElasticURL+"/last_block_%s_%s/_doc/1", ec.Peer, channelId)
+}
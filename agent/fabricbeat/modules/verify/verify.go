@@ -0,0 +1,205 @@
+package verify
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+	"github.com/blockchain-analyzer/agent/fabricbeat/modules/elastic"
+
+	"github.com/hyperledger/fabric/protoutil"
+)
+
+// Types of the mismatches found during the verification
+const (
+	// The stored block hash is not the hash of the stored header (number, previous hash, data hash)
+	BlockHashMismatch = "block_hash"
+	// The stored previous hash is not the stored hash of the previous block
+	PreviousHashMismatch = "previous_hash"
+	// The same block is stored more than once with different hashes
+	DuplicateMismatch = "duplicate"
+	// The data hash recomputed from the transactions of the block on the ledger does not match the stored data hash
+	DataHashMismatch = "data_hash"
+	// The data hash recomputed from the transactions of the block on the ledger does not match the header on the ledger
+	LedgerDataHashMismatch = "ledger_data_hash"
+	// The hash of the block on the ledger does not match the stored block hash
+	LedgerBlockHashMismatch = "ledger_block_hash"
+)
+
+// Range of block numbers, both ends included
+type Range struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+type Mismatch struct {
+	Type        string `json:"type"`
+	BlockNumber uint64 `json:"blockNumber"`
+	Expected    string `json:"expected"`
+	Actual      string `json:"actual"`
+}
+
+// Result of the verification of the indexed blocks of a channel
+type Report struct {
+	ChannelId       string      `json:"channelId"`
+	Peer            string      `json:"peer"`
+	VerifiedAt      time.Time   `json:"verifiedAt"`
+	BlockCount      int         `json:"blockCount"`
+	FirstBlock      uint64      `json:"firstBlock"`
+	LastBlock       uint64      `json:"lastBlock"`
+	SampledBlocks   []uint64    `json:"sampledBlocks"`
+	Gaps            []Range     `json:"gaps"`
+	Mismatches      []*Mismatch `json:"mismatches"`
+	DivergentRanges []Range     `json:"divergentRanges"`
+	Errors          []string    `json:"errors"`
+}
+
+// Returns true if no gaps, mismatches or errors were found
+func (report *Report) OK() bool {
+	return len(report.Gaps) == 0 && len(report.Mismatches) == 0 && len(report.Errors) == 0
+}
+
+// Verifies the indexed blocks of a channel: walks the blocks ordered by block number, checks that each stored block hash
+// matches the stored header and that each previous hash matches the hash of the previous block, then compares
+// sampleSize evenly spaced blocks against the ledger, recomputing their data hash from the transactions.
+// Problems are collected in the report instead of stopping the verification.
+func VerifyChannel(channelId, peer string, blocks []*elastic.IndexedBlock, source blocksource.BlockSource, sampleSize int) *Report {
+	report := &Report{
+		ChannelId:       channelId,
+		Peer:            peer,
+		VerifiedAt:      time.Now(),
+		SampledBlocks:   []uint64{},
+		Gaps:            []Range{},
+		Mismatches:      []*Mismatch{},
+		DivergentRanges: []Range{},
+		Errors:          []string{},
+	}
+
+	// Removing duplicates, the same block may have been indexed more than once
+	unique := []*elastic.IndexedBlock{}
+	for _, block := range blocks {
+		if len(unique) > 0 && unique[len(unique)-1].BlockNumber == block.BlockNumber {
+			if unique[len(unique)-1].BlockHash != block.BlockHash {
+				report.addMismatch(DuplicateMismatch, block.BlockNumber, unique[len(unique)-1].BlockHash, block.BlockHash)
+			}
+			continue
+		}
+		unique = append(unique, block)
+	}
+	report.BlockCount = len(unique)
+	if len(unique) == 0 {
+		return report
+	}
+	report.FirstBlock = unique[0].BlockNumber
+	report.LastBlock = unique[len(unique)-1].BlockNumber
+	if report.FirstBlock > 0 {
+		report.Gaps = append(report.Gaps, Range{From: 0, To: report.FirstBlock - 1})
+	}
+
+	for i, block := range unique {
+		previousHash, err1 := hex.DecodeString(block.PreviousHash)
+		dataHash, err2 := hex.DecodeString(block.DataHash)
+		if err1 != nil || err2 != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Block %d contains invalid hashes", block.BlockNumber))
+		} else if blockHash := fabricutils.GenerateBlockHash(previousHash, dataHash, block.BlockNumber); blockHash != block.BlockHash {
+			report.addMismatch(BlockHashMismatch, block.BlockNumber, blockHash, block.BlockHash)
+		}
+
+		if i == 0 {
+			continue
+		}
+		previous := unique[i-1]
+		if block.BlockNumber != previous.BlockNumber+1 {
+			report.Gaps = append(report.Gaps, Range{From: previous.BlockNumber + 1, To: block.BlockNumber - 1})
+		} else if block.PreviousHash != previous.BlockHash {
+			report.addMismatch(PreviousHashMismatch, block.BlockNumber, previous.BlockHash, block.PreviousHash)
+		}
+	}
+
+	if source != nil {
+		for _, index := range sampleIndices(len(unique), sampleSize) {
+			report.compareWithLedger(unique[index], source)
+		}
+	}
+
+	report.DivergentRanges = divergentRanges(report.Mismatches)
+	return report
+}
+
+// Compares a stored block with the same block on the ledger
+func (report *Report) compareWithLedger(block *elastic.IndexedBlock, source blocksource.BlockSource) {
+	report.SampledBlocks = append(report.SampledBlocks, block.BlockNumber)
+	ledgerBlock, err := source.Block(block.BlockNumber)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("Querying block %d from the ledger failed: %s", block.BlockNumber, err.Error()))
+		return
+	}
+	recomputedDataHash := hex.EncodeToString(protoutil.BlockDataHash(ledgerBlock.Data))
+	if headerDataHash := hex.EncodeToString(ledgerBlock.Header.DataHash); recomputedDataHash != headerDataHash {
+		report.addMismatch(LedgerDataHashMismatch, block.BlockNumber, recomputedDataHash, headerDataHash)
+	}
+	if recomputedDataHash != block.DataHash {
+		report.addMismatch(DataHashMismatch, block.BlockNumber, recomputedDataHash, block.DataHash)
+	}
+	ledgerBlockHash := fabricutils.GenerateBlockHash(ledgerBlock.Header.PreviousHash, ledgerBlock.Header.DataHash, ledgerBlock.Header.Number)
+	if ledgerBlockHash != block.BlockHash {
+		report.addMismatch(LedgerBlockHashMismatch, block.BlockNumber, ledgerBlockHash, block.BlockHash)
+	}
+}
+
+func (report *Report) addMismatch(mismatchType string, blockNumber uint64, expected, actual string) {
+	report.Mismatches = append(report.Mismatches, &Mismatch{
+		Type:        mismatchType,
+		BlockNumber: blockNumber,
+		Expected:    expected,
+		Actual:      actual,
+	})
+}
+
+// Returns the indices of sampleSize evenly spaced blocks, including the first and the last one.
+func sampleIndices(count, sampleSize int) []int {
+	if sampleSize <= 0 || count == 0 {
+		return []int{}
+	}
+	if sampleSize >= count {
+		sampleSize = count
+	}
+	indices := []int{}
+	for i := 0; i < sampleSize; i++ {
+		index := 0
+		if sampleSize > 1 {
+			index = i * (count - 1) / (sampleSize - 1)
+		}
+		if len(indices) == 0 || indices[len(indices)-1] != index {
+			indices = append(indices, index)
+		}
+	}
+	return indices
+}
+
+// Merges the block numbers of the mismatches into ranges of consecutive blocks.
+func divergentRanges(mismatches []*Mismatch) []Range {
+	seen := map[uint64]bool{}
+	blockNumbers := []uint64{}
+	for _, mismatch := range mismatches {
+		if !seen[mismatch.BlockNumber] {
+			seen[mismatch.BlockNumber] = true
+			blockNumbers = append(blockNumbers, mismatch.BlockNumber)
+		}
+	}
+	sort.Slice(blockNumbers, func(i, j int) bool {
+		return blockNumbers[i] < blockNumbers[j]
+	})
+	ranges := []Range{}
+	for _, blockNumber := range blockNumbers {
+		if len(ranges) > 0 && ranges[len(ranges)-1].To+1 == blockNumber {
+			ranges[len(ranges)-1].To = blockNumber
+		} else {
+			ranges = append(ranges, Range{From: blockNumber, To: blockNumber})
+		}
+	}
+	return ranges
+}
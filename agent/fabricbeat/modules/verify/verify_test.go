@@ -0,0 +1,286 @@
+package verify
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/blocktest"
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+	"github.com/blockchain-analyzer/agent/fabricbeat/modules/elastic"
+)
+
+// Builds a chain of indexed blocks with consistent hashes
+func indexedChain(count int) []*elastic.IndexedBlock {
+	blocks := []*elastic.IndexedBlock{}
+	previousHash := ""
+	for i := 0; i < count; i++ {
+		dataHash := hex.EncodeToString([]byte{byte(i), 0xda, 0x7a})
+		blocks = append(blocks, indexedBlock(uint64(i), previousHash, dataHash))
+		previousHash = blocks[i].BlockHash
+	}
+	return blocks
+}
+
+func indexedBlock(blockNumber uint64, previousHash, dataHash string) *elastic.IndexedBlock {
+	previous, _ := hex.DecodeString(previousHash)
+	data, _ := hex.DecodeString(dataHash)
+	return &elastic.IndexedBlock{
+		BlockNumber:  blockNumber,
+		ChannelId:    "mychannel",
+		BlockHash:    fabricutils.GenerateBlockHash(previous, data, blockNumber),
+		PreviousHash: previousHash,
+		DataHash:     dataHash,
+	}
+}
+
+func TestVerifyChannel(t *testing.T) {
+	tests := []struct {
+		name       string
+		blocks     func() []*elastic.IndexedBlock
+		mismatches map[uint64]string
+		gaps       []Range
+		divergent  []Range
+	}{
+		{
+			"matching chain",
+			func() []*elastic.IndexedBlock { return indexedChain(5) },
+			map[uint64]string{},
+			[]Range{},
+			[]Range{},
+		},
+		{
+			"changed data hash",
+			func() []*elastic.IndexedBlock {
+				blocks := indexedChain(5)
+				blocks[2].DataHash = hex.EncodeToString([]byte("changed"))
+				return blocks
+			},
+			map[uint64]string{2: BlockHashMismatch},
+			[]Range{},
+			[]Range{{From: 2, To: 2}},
+		},
+		{
+			"broken previous hash link",
+			func() []*elastic.IndexedBlock {
+				blocks := indexedChain(5)
+				blocks[3] = indexedBlock(3, hex.EncodeToString([]byte("other")), blocks[3].DataHash)
+				return blocks
+			},
+			map[uint64]string{3: PreviousHashMismatch, 4: PreviousHashMismatch},
+			[]Range{},
+			[]Range{{From: 3, To: 4}},
+		},
+		{
+			"duplicate with another hash",
+			func() []*elastic.IndexedBlock {
+				blocks := indexedChain(3)
+				duplicate := indexedBlock(1, blocks[0].BlockHash, hex.EncodeToString([]byte("duplicate")))
+				return []*elastic.IndexedBlock{blocks[0], blocks[1], duplicate, blocks[2]}
+			},
+			map[uint64]string{1: DuplicateMismatch},
+			[]Range{},
+			[]Range{{From: 1, To: 1}},
+		},
+		{
+			"gaps",
+			func() []*elastic.IndexedBlock {
+				blocks := indexedChain(6)
+				return []*elastic.IndexedBlock{blocks[2], blocks[5]}
+			},
+			map[uint64]string{},
+			[]Range{{From: 0, To: 1}, {From: 3, To: 4}},
+			[]Range{},
+		},
+		{
+			"contiguous divergent blocks",
+			func() []*elastic.IndexedBlock {
+				blocks := indexedChain(8)
+				for _, i := range []int{2, 3, 6} {
+					blocks[i].BlockHash = hex.EncodeToString([]byte("tampered"))
+				}
+				return blocks
+			},
+			map[uint64]string{2: BlockHashMismatch, 3: BlockHashMismatch, 4: PreviousHashMismatch, 6: BlockHashMismatch, 7: PreviousHashMismatch},
+			[]Range{},
+			[]Range{{From: 2, To: 4}, {From: 6, To: 7}},
+		},
+	}
+	for _, test := range tests {
+		report := VerifyChannel("mychannel", "peer0", test.blocks(), nil, 0)
+		found := map[uint64]string{}
+		for _, mismatch := range report.Mismatches {
+			if _, ok := found[mismatch.BlockNumber]; !ok {
+				found[mismatch.BlockNumber] = mismatch.Type
+			}
+		}
+		if !reflect.DeepEqual(found, test.mismatches) {
+			t.Errorf("%s: mismatches %v instead of %v", test.name, found, test.mismatches)
+		}
+		if !reflect.DeepEqual(report.Gaps, test.gaps) {
+			t.Errorf("%s: gaps %v instead of %v", test.name, report.Gaps, test.gaps)
+		}
+		if !reflect.DeepEqual(report.DivergentRanges, test.divergent) {
+			t.Errorf("%s: divergent ranges %v instead of %v", test.name, report.DivergentRanges, test.divergent)
+		}
+		if report.OK() != (len(test.mismatches) == 0 && len(test.gaps) == 0) {
+			t.Errorf("%s: OK is %t", test.name, report.OK())
+		}
+	}
+}
+
+// Builds the indexed blocks of the blocks of a chain
+func indexedBlocksOf(chain *blocktest.Chain) []*elastic.IndexedBlock {
+	blocks := []*elastic.IndexedBlock{}
+	for _, block := range chain.Blocks {
+		blocks = append(blocks, indexedBlock(block.Header.Number, hex.EncodeToString(block.Header.PreviousHash), hex.EncodeToString(block.Header.DataHash)))
+	}
+	return blocks
+}
+
+func TestVerifyChannelWithLedger(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleSize int
+		// Changes the blocks on the ledger
+		ledger func(chain *blocktest.Chain)
+		// Changes the indexed blocks
+		indexed    func(blocks []*elastic.IndexedBlock) []*elastic.IndexedBlock
+		sampled    []uint64
+		mismatches []string
+	}{
+		{
+			"matching chain",
+			10,
+			func(chain *blocktest.Chain) {},
+			func(blocks []*elastic.IndexedBlock) []*elastic.IndexedBlock { return blocks },
+			[]uint64{0, 1, 2, 3},
+			[]string{},
+		},
+		{
+			"no sample",
+			0,
+			func(chain *blocktest.Chain) {},
+			func(blocks []*elastic.IndexedBlock) []*elastic.IndexedBlock { return blocks },
+			[]uint64{},
+			[]string{},
+		},
+		{
+			"single sample",
+			1,
+			func(chain *blocktest.Chain) {},
+			func(blocks []*elastic.IndexedBlock) []*elastic.IndexedBlock { return blocks },
+			[]uint64{0},
+			[]string{},
+		},
+		{
+			"changed data hash",
+			4,
+			func(chain *blocktest.Chain) {},
+			func(blocks []*elastic.IndexedBlock) []*elastic.IndexedBlock {
+				blocks[2] = indexedBlock(2, blocks[2].PreviousHash, hex.EncodeToString([]byte("changed")))
+				return blocks
+			},
+			[]uint64{0, 1, 2, 3},
+			[]string{"previous_hash 3", "data_hash 2", "ledger_block_hash 2"},
+		},
+		{
+			"changed transactions on the ledger",
+			4,
+			func(chain *blocktest.Chain) {
+				chain.Blocks[1].Data.Data = chain.Blocks[1].Data.Data[:1]
+			},
+			func(blocks []*elastic.IndexedBlock) []*elastic.IndexedBlock { return blocks },
+			[]uint64{0, 1, 2, 3},
+			[]string{"ledger_data_hash 1", "data_hash 1"},
+		},
+		{
+			"broken previous hash link",
+			2,
+			func(chain *blocktest.Chain) {},
+			func(blocks []*elastic.IndexedBlock) []*elastic.IndexedBlock {
+				blocks[3] = indexedBlock(3, hex.EncodeToString([]byte("other")), blocks[3].DataHash)
+				return blocks
+			},
+			[]uint64{0, 3},
+			[]string{"previous_hash 3", "ledger_block_hash 3"},
+		},
+	}
+	for _, test := range tests {
+		chain := blocktest.NewChain("mychannel")
+		chain.AddBlock(&blocktest.Tx{Chaincode: "basic", Function: "init"})
+		chain.AddBlock(&blocktest.Tx{Chaincode: "basic", Function: "set", Args: []string{"a", "1"}}, &blocktest.Tx{Chaincode: "basic", Function: "set", Args: []string{"b", "2"}})
+		chain.AddBlock(&blocktest.Tx{Chaincode: "basic", Function: "set", Args: []string{"a", "3"}})
+		chain.AddBlock(&blocktest.Tx{Chaincode: "basic", Function: "delete", Args: []string{"b"}})
+		blocks := test.indexed(indexedBlocksOf(chain))
+		test.ledger(chain)
+		source, err := blocksource.NewMemorySource(chain.Blocks...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report := VerifyChannel("mychannel", "peer0", blocks, source, test.sampleSize)
+		found := []string{}
+		for _, mismatch := range report.Mismatches {
+			found = append(found, fmt.Sprintf("%s %d", mismatch.Type, mismatch.BlockNumber))
+		}
+		if !reflect.DeepEqual(found, test.mismatches) {
+			t.Errorf("%s: mismatches %v instead of %v", test.name, found, test.mismatches)
+		}
+		if !reflect.DeepEqual(report.SampledBlocks, test.sampled) {
+			t.Errorf("%s: sampled blocks %v instead of %v", test.name, report.SampledBlocks, test.sampled)
+		}
+		if len(report.Errors) > 0 {
+			t.Errorf("%s: %v", test.name, report.Errors)
+		}
+	}
+}
+
+func TestSampleIndices(t *testing.T) {
+	tests := []struct {
+		name       string
+		count      int
+		sampleSize int
+		expected   []int
+	}{
+		{"no sample", 10, 0, []int{}},
+		{"negative sample", 10, -1, []int{}},
+		{"no blocks", 0, 5, []int{}},
+		{"one", 10, 1, []int{0}},
+		{"first and last", 10, 2, []int{0, 9}},
+		{"evenly spaced", 10, 4, []int{0, 3, 6, 9}},
+		{"equal to the height", 5, 5, []int{0, 1, 2, 3, 4}},
+		{"above the height", 3, 10, []int{0, 1, 2}},
+	}
+	for _, test := range tests {
+		indices := sampleIndices(test.count, test.sampleSize)
+		if !reflect.DeepEqual(indices, test.expected) {
+			t.Errorf("%s: %v instead of %v", test.name, indices, test.expected)
+		}
+	}
+}
+
+func TestDivergentRanges(t *testing.T) {
+	tests := []struct {
+		name         string
+		blockNumbers []uint64
+		expected     []Range
+	}{
+		{"none", []uint64{}, []Range{}},
+		{"single", []uint64{4}, []Range{{From: 4, To: 4}}},
+		{"contiguous", []uint64{4, 5, 6}, []Range{{From: 4, To: 6}}},
+		{"unordered with duplicates", []uint64{9, 5, 4, 5, 1}, []Range{{From: 1, To: 1}, {From: 4, To: 5}, {From: 9, To: 9}}},
+	}
+	for _, test := range tests {
+		mismatches := []*Mismatch{}
+		for _, blockNumber := range test.blockNumbers {
+			mismatches = append(mismatches, &Mismatch{Type: BlockHashMismatch, BlockNumber: blockNumber})
+		}
+		ranges := divergentRanges(mismatches)
+		if !reflect.DeepEqual(ranges, test.expected) {
+			t.Errorf("%s: %v instead of %v", test.name, ranges, test.expected)
+		}
+	}
+}
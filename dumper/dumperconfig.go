@@ -3,14 +3,40 @@ package main
 import (
 	"time"
 
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/checkpoint"
 	"github.com/blockchain-analyzer/agent/agentmodules/fabricsetup"
-	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
+	"github.com/blockchain-analyzer/agent/agentmodules/retry"
+	"github.com/blockchain-analyzer/agent/agentmodules/transform"
 )
 
-// Defines the setup and the persistence interface, keeps track of the last known blocks for each channel
+// Defines the setup, the block sources (one per channel) and the persistence interface, keeps track of the last known blocks for each channel (keyed by channel ID).
+// The Transformer turns the blocks into the records to persist, it is set up with the chaincode and size settings.
+// The last persisted block of each channel is saved to the Checkpointer, so the dumper continues where it left off after a restart.
+// If PrivateData is true, the cleartext private data is fetched from the peer and persisted with the hashed private writes.
+// StartBlock and EndBlock limit the dumped blocks of every channel (-1 if not set), StartBlock overrides the checkpoints.
+// Channels keeps the retry state of each channel (keyed by channel ID), a failing channel does not stop the others.
 type DumperConfig struct {
 	Period        time.Duration
 	FabricSetup   *fabricsetup.FabricSetup
-	LastBlockNums map[*ledger.Client]uint64
+	Sources       []blocksource.BlockSource
+	LastBlockNums map[string]uint64
+	StartBlock    int64
+	EndBlock      int64
+	Transformer   *transform.Transformer
 	Persistence   Persistent
+	Checkpointer  checkpoint.Checkpointer
+	PrivateData   bool
+	Channels      map[string]*ChannelState
+}
+
+// Retry state of a channel. Transient errors are retried after the delay of the Backoff (from RetryAt),
+// channels with a permanent error or too many failed attempts are Stopped. Loaded is true once the checkpoint of the channel is loaded.
+// Pending is the checkpoint of the last persisted block while the backend has not completed its records (see Committer).
+type ChannelState struct {
+	Backoff *retry.Backoff
+	RetryAt time.Time
+	Stopped bool
+	Loaded  bool
+	Pending *checkpoint.Checkpoint
 }
@@ -1,243 +1,453 @@
 package main
 
 import (
-	"encoding/hex"
-	"encoding/json"
-	"path/filepath"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
-	"fmt"
-
-	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
+	"github.com/gogo/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
 
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/checkpoint"
 	"github.com/blockchain-analyzer/agent/agentmodules/fabricsetup"
 	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
 	"github.com/blockchain-analyzer/agent/agentmodules/ledgerutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/retry"
+	"github.com/blockchain-analyzer/agent/agentmodules/transform"
+	"github.com/blockchain-analyzer/agent/agentmodules/valuedecoders"
 )
 
 func main() {
 	fmt.Println("Standalone dumper program started running")
 
-	network := os.Getenv("NETWORK")
-	if (network == "") {
-		network = "basic"
+	options, err := parseOptions(os.Args[1:])
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(2)
 	}
-	dirpath, _ := filepath.Abs("../network")
-	fullpath := dirpath + "/" + network + "/"
-
-	ConfigFile := fullpath + "connection-profile-1.yaml"
-	Peer := "peer0.org1.el-network.com"
-	AdminCertPath := fullpath + "crypto-config/peerOrganizations/org1.el-network.com/users/Admin@org1.el-network.com/msp/signcerts/Admin@org1.el-network.com-cert.pem"
-	AdminKeyPath := fullpath + "crypto-config/peerOrganizations/org1.el-network.com/users/Admin@org1.el-network.com/msp/keystore/adminKey1"
 
 	fbSetup := &fabricsetup.FabricSetup{
-		OrgName:       "org1",
-		ConfigFile:    ConfigFile,
-		Peer:          Peer,
-		AdminCertPath: AdminCertPath,
-		AdminKeyPath:  AdminKeyPath,
+		OrgName:       options.Organization,
+		ConfigFile:    options.ConnectionProfile,
+		Peer:          options.Peer,
+		AdminCertPath: options.AdminCertPath,
+		AdminKeyPath:  options.AdminKeyPath,
+		Chaincodes:    options.Chaincodes,
 	}
 
-	err := fbSetup.Initialize()
+	// Reading the blocks from the block files of a peer ledger or from .block files instead of the network
+	var allSources []blocksource.BlockSource
+	switch {
+	case options.Blockfiles != "":
+		allSources, err = blocksource.NewBlockfileSources(options.Blockfiles)
+	case options.Blocks != "":
+		allSources, err = blocksource.Open(options.Blocks)
+	default:
+		err = fbSetup.Initialize()
+		for _, ledgerClient := range fbSetup.LedgerClients {
+			allSources = append(allSources, blocksource.NewLedgerSource(fbSetup.Channels[ledgerClient], ledgerClient))
+		}
+	}
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
+	var sources []blocksource.BlockSource
+	for _, source := range allSources {
+		if options.DumpsChannel(source.ChannelID()) {
+			sources = append(sources, source)
+		}
+	}
 
-	dumper := &DumperConfig{
-		Period:        1 * time.Second,
-		FabricSetup:   fbSetup,
-		LastBlockNums: make(map[*ledger.Client]uint64),
-		Persistence:   DefaultConfig,
+	decoders, err := valuedecoders.ForChaincodes(fbSetup.Chaincodes)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
 	}
 
-	// Ramp-up phase
-	fmt.Println("Fetching existing data from ledger")
-	err = fetchNewData(dumper)
+	persistence, err := newPersistence(options)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	checkpointer, err := checkpoint.NewFileCheckpointer(filepath.Join(options.OutputDir, "checkpoints.json"))
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
 
-	// Periodic querying for new data
+	transformer := transform.New(transform.Options{
+		Chaincodes:        fbSetup.Chaincodes,
+		Decoders:          decoders,
+		SkipInvalidWrites: options.SkipInvalidWrites,
+		MaxArgSize:        options.MaxArgSize,
+		MaxResponseSize:   options.MaxResponseSize,
+	})
+
+	dumper := &DumperConfig{
+		Period:        options.Period,
+		FabricSetup:   fbSetup,
+		Sources:       sources,
+		LastBlockNums: make(map[string]uint64),
+		StartBlock:    options.StartBlock,
+		EndBlock:      options.EndBlock,
+		Transformer:   transformer,
+		Persistence:   persistence,
+		Checkpointer:  checkpointer,
+		PrivateData:   options.PrivateData,
+		Channels:      make(map[string]*ChannelState),
+	}
+	for _, source := range sources {
+		backoff := &retry.Backoff{Initial: 1 * time.Second, Max: 1 * time.Minute}
+		// Block files and .block files do not change, retrying them a few times is enough
+		if options.Offline() {
+			backoff.MaxAttempts = 3
+		}
+		dumper.Channels[source.ChannelID()] = &ChannelState{Backoff: backoff}
+	}
+
+	// Ramp-up phase, continuing from the last persisted block of each channel
+	fmt.Println("Fetching existing data from ledger")
+	waiting := fetchNewData(dumper)
+
+	// Periodic querying for new data. In one-shot mode (and for block files and .block files, which do not change)
+	// there is no new data to wait for, only the channels waiting for a retry.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 	ticker := time.NewTicker(dumper.Period)
-	for _ = range ticker.C {
+	for !options.OneShot() || waiting {
+		if len(dumper.Sources) > 0 && stoppedChannels(dumper) == len(dumper.Sources) {
+			fmt.Println("The dumping has stopped on every channel")
+			closePersistence(dumper)
+			os.Exit(1)
+		}
+		select {
+		case <-signals:
+			fmt.Println("Stopping the dumper")
+			closePersistence(dumper)
+			return
+		case <-ticker.C:
+		}
 		fmt.Println("Fetching new data")
-		err = fetchNewData(dumper)
+		waiting = fetchNewData(dumper)
+	}
+
+	closePersistence(dumper)
+	if stoppedChannels(dumper) > 0 {
+		fmt.Println(fmt.Sprintf("The dumping has stopped on %d channels", stoppedChannels(dumper)))
+		os.Exit(1)
+	}
+	fmt.Println("Every block has been read")
+}
+
+// Closes the output backend, the records of the blocks persisted so far are complete afterwards. The checkpoints that were waiting
+// for the records to be completed are saved then.
+func closePersistence(dumper *DumperConfig) {
+	err := dumper.Persistence.Close()
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Error closing the output: %s", err.Error()))
+		return
+	}
+	for _, state := range dumper.Channels {
+		if state.Pending == nil {
+			continue
+		}
+		err = dumper.Checkpointer.Save(state.Pending)
 		if err != nil {
-			fmt.Println(err.Error())
-			os.Exit(1)
+			fmt.Println(fmt.Sprintf("Error saving the checkpoint of channel %s: %s", state.Pending.ChannelId, err.Error()))
+		}
+		state.Pending = nil
+	}
+}
+
+// Creates the output backend selected in the options.
+func newPersistence(options *Options) (Persistent, error) {
+	switch options.Output {
+	case OutputJSON:
+		fd, err := NewFileDumper(options.OutputDir)
+		if err != nil {
+			return nil, err
+		}
+		fd.RotateSize = options.RotateSize
+		fd.RotateBlocks = options.RotateBlocks
+		fd.Gzip = options.Gzip
+		return fd, nil
+	case OutputParquet:
+		pd, err := NewParquetDumper(options.OutputDir, options.MaxRows)
+		if err != nil {
+			return nil, err
+		}
+		pd.MaxBlocks = options.RotateBlocks
+		return pd, nil
+	case OutputSQL:
+		dsn := options.SQLDSN
+		if dsn == "" {
+			dsn = filepath.Join(options.OutputDir, "dumper.db")
+		}
+		return NewSQLDumper(options.SQLDriver, dsn)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown output backend %q", options.Output))
+	}
+}
+
+// Fetches the new blocks of every channel that is not stopped or waiting for a retry. The errors of a channel do not stop the others:
+// transient errors are retried with backoff, permanent errors stop the channel. Returns true if a channel is waiting for a retry.
+func fetchNewData(dumper *DumperConfig) bool {
+	waiting := false
+	for _, source := range dumper.Sources {
+		channelId := source.ChannelID()
+		state := dumper.Channels[channelId]
+		if state.Stopped {
+			continue
+		}
+		if time.Now().Before(state.RetryAt) {
+			waiting = true
+			continue
+		}
+
+		err := fetchChannel(dumper, source)
+		if err == nil {
+			state.Backoff.Reset()
+			continue
+		}
+		if retry.IsPermanent(err) {
+			fmt.Println(fmt.Sprintf("Stopping the dumping of channel %s: %s", channelId, err.Error()))
+			state.Stopped = true
+			continue
+		}
+		delay, ok := state.Backoff.Next()
+		if !ok {
+			fmt.Println(fmt.Sprintf("Stopping the dumping of channel %s after %d failed attempts: %s", channelId, state.Backoff.Attempts(), err.Error()))
+			state.Stopped = true
+			continue
+		}
+		fmt.Println(fmt.Sprintf("Error on channel %s, retrying in %s: %s", channelId, delay, err.Error()))
+		state.RetryAt = time.Now().Add(delay)
+		waiting = true
+	}
+	return waiting
+}
+
+// Gets the number of channels stopped because of an error.
+func stoppedChannels(dumper *DumperConfig) int {
+	stopped := 0
+	for _, state := range dumper.Channels {
+		if state.Stopped {
+			stopped++
+		}
+	}
+	return stopped
+}
+
+// Fetches and persists the new blocks of a channel, after loading its checkpoint on the first call.
+func fetchChannel(dumper *DumperConfig, source blocksource.BlockSource) error {
+	state := dumper.Channels[source.ChannelID()]
+	if !state.Loaded {
+		err := loadCheckpoint(dumper, source)
+		if err != nil {
+			return err
+		}
+		state.Loaded = true
+	}
+
+	blockHeight, err := ledgerutils.GetBlockHeight(source)
+	if err != nil {
+		return err
+	}
+	// Blocks after the end of the range are not dumped
+	if dumper.EndBlock >= 0 && uint64(dumper.EndBlock)+1 < blockHeight {
+		blockHeight = uint64(dumper.EndBlock) + 1
+	}
+	for dumper.LastBlockNums[source.ChannelID()] < blockHeight {
+		block, err := source.Block(dumper.LastBlockNums[source.ChannelID()])
+		if err != nil {
+			return err
+		}
+		err = dumpBlock(dumper, source, block)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func fetchNewData(dumper *DumperConfig) error {
+// Persists the records of a block, then saves the checkpoint of the channel. Blocks that cannot be decoded are persisted as dead letters.
+func dumpBlock(dumper *DumperConfig, source blocksource.BlockSource, block *common.Block) error {
+	typeInfo, _, _, err := ledgerutils.ProcessBlockData(block)
+	if err != nil {
+		return quarantineBlock(dumper, source, block, err)
+	}
+
+	// Fetching the cleartext private data of the block, only available for collections the organization is a member of
+	var privateData map[uint64]*rwset.TxPvtReadWriteSet
+	if dumper.PrivateData && blocksource.LedgerClientOf(source) != nil && typeInfo == transform.EndorserTransaction {
+		privateData, err = dumper.FabricSetup.GetBlockPrivateData(source.ChannelID(), block.Header.Number)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Error fetching private data of block %d: %s", block.Header.Number, err.Error()))
+		}
+	}
+
+	records, err := dumper.Transformer.Transform(block, source, privateData)
+	if retry.IsPermanent(err) {
+		return quarantineBlock(dumper, source, block, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range records.Transactions {
+		if tx.IsEndorserTx() {
+			err = dumper.Persistence.PersistEndorserTx(tx)
+		} else {
+			err = dumper.Persistence.PersistNonEndorserTx(tx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Println(fmt.Sprintf("%d transactions persisted", len(records.Transactions)))
 
-	// var channelIdPtr *string
+	for _, write := range records.Writes {
+		if write.DecodeError != "" {
+			fmt.Println(fmt.Sprintf("Error decoding value with the %s decoder: %s", write.ValueDecoder, write.DecodeError))
+		}
+		err = dumper.Persistence.PersistWrite(write)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Println(fmt.Sprintf("%d writes persisted", len(records.Writes)))
 
-	var channelIdWrapper struct {
-		channelId string
+	for _, read := range records.Reads {
+		err = dumper.Persistence.PersistRead(read)
+		if err != nil {
+			return err
+		}
 	}
+	fmt.Println(fmt.Sprintf("%d reads persisted", len(records.Reads)))
 
-	for _, ledgerClient := range dumper.FabricSetup.LedgerClients {
-		blockHeight, err := ledgerutils.GetBlockHeight(ledgerClient)
+	for _, config := range records.Configs {
+		err = dumper.Persistence.PersistConfig(config)
 		if err != nil {
 			return err
 		}
+		fmt.Println("Config persisted")
+	}
 
-		for dumper.LastBlockNums[ledgerClient] < blockHeight {
-			var transactions []string
-			block, typeInfo, createdAt, _, err := ledgerutils.ProcessBlock(dumper.LastBlockNums[ledgerClient], ledgerClient)
-			if err != nil {
-				return err
-			}
-
-			for _, d := range block.Data.Data {
-				if typeInfo != "ENDORSER_TRANSACTION" {
-					_, channelId, creator, creatorOrg, _, err := ledgerutils.ProcessTx(d)
-					if err != nil {
-						return err
-					}
-					channelIdWrapper.channelId = channelId
-					// *channelIdPtr = channelId
-
-					dumper.Persistence.PersistNonEndorserTx(
-						NonEndorserTx{
-							BlockNumber: dumper.LastBlockNums[ledgerClient],
-							ChannelID:   channelId,
-							CreatedAt:   createdAt,
-							Creator:     creator,
-							CreatorOrg:  creatorOrg,
-							TxType:      typeInfo,
-						},
-					)
-					fmt.Println("Non-endorser transaction persisted")
-
-				} else {
-					txId, channelId, creator, creatorOrg, txRWSet, chaincodeName, chaincodeVersion, err := ledgerutils.ProcessEndorserTx(d)
-					if err != nil {
-						return err
-					}
-					channelIdWrapper.channelId = channelId
-					readset := []*fabricutils.Readset{}
-					writeset := []*fabricutils.Writeset{}
-					// Getting read-write set
-					// For every namespace
-					for _, ns := range txRWSet.NsRwSets {
-
-						if len(ns.KvRwSet.Writes) > 0 {
-							// Getting the writes
-							for writeIndex, w := range ns.KvRwSet.Writes {
-								writeset = append(writeset, &fabricutils.Writeset{})
-								writeset[writeIndex].Namespace = ns.NameSpace
-								writeset[writeIndex].Key = w.Key
-
-								err = json.Unmarshal(w.Value, &writeset[writeIndex].Value)
-								if err != nil {
-									fmt.Println(fmt.Sprintf("Error unmarshaling value into writeset: %s", err.Error()))
-								}
-								// With this map, we can obtain the top level fields of the value.
-								var valueMap map[string]interface{}
-								err = json.Unmarshal(w.Value, &valueMap)
-								if err != nil {
-									fmt.Println(fmt.Sprintf("Error unmarshaling value into map: %s", err.Error()))
-								}
-
-								writeset[writeIndex].IsDelete = w.IsDelete
-
-								// fmt.Println(fmt.Sprintf("len(bt.Fsetup.Chaincodes) = %d", len(bt.Fsetup.Chaincodes)))
-
-								// //fmt.Println("Chaincode name: " + bt.Fsetup.Chaincodes[chaincodeName].Name + "\n\n\n")
-
-								// //fmt.Println("Linking key: " + bt.Fsetup.Chaincodes[chaincodeName].Linkingkey + "\n\n\n")
-								// for _, chaincode := range bt.config.Chaincodes {
-								// 	fmt.Println(fmt.Sprintf("Chaincode name: %s, linking key: %s, values length: %d", chaincode.Name, chaincode.Linkingkey, len(chaincode.Values)))
-								// }
-
-								// var LinkingkeyString string
-								// ccIndex := fabricutils.IndexOfChaincode(bt.Fsetup.Chaincodes, chaincodeName)
-								// if ccIndex < 0 || valueMap[bt.config.Chaincodes[ccIndex].Linkingkey] == nil {
-								// 	LinkingkeyString = ""
-								// } else {
-								// 	if str, ok := valueMap[bt.config.Chaincodes[ccIndex].Linkingkey].(string); ok {
-								// 		LinkingkeyString = str
-								// 	} else {
-								// 		return errors.New(fmt.Sprintf("valueMap contains interface{} value instead of string with key %s", bt.config.Chaincodes[ccIndex].Linkingkey))
-								// 	}
-								// }
-
-								// Sending a new event to the "key" index with the write data
-
-								dumper.Persistence.PersistWrite(
-									Write{
-										TxID:             txId,
-										ChannelID:        channelId,
-										ChaincodeName:    chaincodeName,
-										ChaincodeVersion: chaincodeVersion,
-										Write:            writeset[writeIndex],
-										Key:              w.Key,
-										//Linkingkey:       string
-										Value:      writeset[writeIndex].Value,
-										CreatedAt:  createdAt,
-										Creator:    creator,
-										CreatorOrg: creatorOrg,
-									},
-								)
-								fmt.Println("Write persisted")
-							}
-						}
-
-						if len(ns.KvRwSet.Reads) > 0 {
-							// Getting the reads
-							for readIndex, w := range ns.KvRwSet.Reads {
-								readset = append(readset, &fabricutils.Readset{})
-								readset[readIndex].Namespace = ns.NameSpace
-								readset[readIndex].Key = w.Key
-							}
-						}
-					}
-
-					transactions = append(transactions, txId)
-
-					dumper.Persistence.PersistEndorserTx(
-						EndorserTx{
-							BlockNumber:      dumper.LastBlockNums[ledgerClient],
-							TxID:             txId,
-							ChannelID:        channelId,
-							ChaincodeName:    chaincodeName,
-							ChaincodeVersion: chaincodeVersion,
-							CreatedAt:        createdAt,
-							Creator:          creator,
-							CreatorOrg:       creatorOrg,
-							Readset:          readset,
-							Writeset:         writeset,
-							TxType:           typeInfo,
-						},
-					)
-					fmt.Println("Endorser transaction persisted")
-				}
-			}
-			prevHash := hex.EncodeToString(block.Header.PreviousHash)
-			dataHash := hex.EncodeToString(block.Header.DataHash)
-			blockHash := fabricutils.GenerateBlockHash(block.Header.PreviousHash, block.Header.DataHash, block.Header.Number)
-
-			dumper.Persistence.PersistBlock(
-				Block{
-					BlockNumber: dumper.LastBlockNums[ledgerClient],
-					ChannelID:   channelIdWrapper.channelId,
-					// ChannelID:    *channelIdPtr,
-					BlockHash:    blockHash,
-					PreviousHash: prevHash,
-					DataHash:     dataHash,
-					CreatedAt:    createdAt,
-					transactions: transactions,
-				},
-			)
-			fmt.Println("Block persisted")
-
-			dumper.LastBlockNums[ledgerClient] += 1
+	for _, chaincodeEvent := range records.Events {
+		err = dumper.Persistence.PersistChaincodeEvent(chaincodeEvent)
+		if err != nil {
+			return err
 		}
+		fmt.Println("Chaincode event persisted")
+	}
+
+	err = dumper.Persistence.PersistBlock(records.Block)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Block persisted")
+
+	return saveCheckpoint(dumper, source, records.Block.BlockNumber, records.Block.BlockHash)
+}
+
+// Persists a block that cannot be decoded as a dead letter together with the error, then continues with the next block of the channel.
+func quarantineBlock(dumper *DumperConfig, source blocksource.BlockSource, block *common.Block, blockErr error) error {
+	deadLetter := &DeadLetter{
+		ChannelId:   source.ChannelID(),
+		BlockNumber: dumper.LastBlockNums[source.ChannelID()],
+		Error:       blockErr.Error(),
+	}
+	if block.GetHeader() != nil {
+		deadLetter.BlockNumber = block.Header.Number
+		deadLetter.BlockHash = fabricutils.GenerateBlockHash(block.Header.PreviousHash, block.Header.DataHash, block.Header.Number)
+	}
+	fmt.Println(fmt.Sprintf("Block %d of channel %s cannot be decoded: %s", deadLetter.BlockNumber, deadLetter.ChannelId, deadLetter.Error))
+
+	rawBlock, err := proto.Marshal(block)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Error marshaling block %d: %s", deadLetter.BlockNumber, err.Error()))
+	}
+	deadLetter.Block = rawBlock
+
+	err = dumper.Persistence.PersistDeadLetter(deadLetter)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Dead letter persisted")
+
+	return saveCheckpoint(dumper, source, deadLetter.BlockNumber, deadLetter.BlockHash)
+}
+
+// Saves the last persisted block of the channel, and continues with the next block. If the backend has not completed the records
+// of the channel yet (see Committer), the checkpoint is only saved once they are.
+func saveCheckpoint(dumper *DumperConfig, source blocksource.BlockSource, blockNumber uint64, blockHash string) error {
+	lastCheckpoint := &checkpoint.Checkpoint{
+		ChannelId:   source.ChannelID(),
+		BlockNumber: blockNumber,
+		BlockHash:   blockHash,
+	}
+	state := dumper.Channels[source.ChannelID()]
+	if committer, ok := dumper.Persistence.(Committer); ok && !committer.Committed(source.ChannelID()) {
+		state.Pending = lastCheckpoint
+	} else {
+		err := dumper.Checkpointer.Save(lastCheckpoint)
+		if err != nil {
+			return err
+		}
+		state.Pending = nil
+	}
+
+	dumper.LastBlockNums[source.ChannelID()] = blockNumber + 1
+	return nil
+}
+
+// Sets the next block to fetch for the channel from its checkpoint. The hash of the last persisted block
+// has to match the same block of the block source, otherwise a permanent error is returned.
+func loadCheckpoint(dumper *DumperConfig, source blocksource.BlockSource) error {
+	channelId := source.ChannelID()
+	firstBlockNumber, err := source.First()
+	if err != nil {
+		return err
+	}
+	dumper.LastBlockNums[channelId] = firstBlockNumber
+
+	// The start of the range overrides the checkpoint
+	if dumper.StartBlock >= 0 {
+		if uint64(dumper.StartBlock) > firstBlockNumber {
+			dumper.LastBlockNums[channelId] = uint64(dumper.StartBlock)
+		}
+		fmt.Println(fmt.Sprintf("Starting channel %s from block %d", channelId, dumper.LastBlockNums[channelId]))
+		return nil
+	}
+
+	lastCheckpoint, err := dumper.Checkpointer.Load(channelId)
+	if err != nil {
+		return err
+	}
+	if lastCheckpoint == nil {
+		fmt.Println(fmt.Sprintf("No checkpoint found for channel %s, starting from block %d", channelId, firstBlockNumber))
+		return nil
+	}
+	if lastCheckpoint.BlockNumber < firstBlockNumber {
+		fmt.Println(fmt.Sprintf("The last persisted block of channel %s (block number: %d) is not available, starting from block %d", channelId, lastCheckpoint.BlockNumber, firstBlockNumber))
+		return nil
+	}
+	blockHashFromLedger, err := ledgerutils.GetBlockHash(lastCheckpoint.BlockNumber, source)
+	if err != nil {
+		return err
+	}
+	if blockHashFromLedger != lastCheckpoint.BlockHash {
+		return retry.Permanent(errors.New(fmt.Sprintf("The hash of the last persisted block (block number: %d) and the same block on the ledger do not match! Hash from checkpoint: %s, hash from ledger: %s", lastCheckpoint.BlockNumber, lastCheckpoint.BlockHash, blockHashFromLedger)))
 	}
+	dumper.LastBlockNums[channelId] = lastCheckpoint.BlockNumber + 1
+	fmt.Println(fmt.Sprintf("Continuing channel %s from block %d", channelId, dumper.LastBlockNums[channelId]))
 	return nil
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/blocksource"
+	"github.com/blockchain-analyzer/agent/agentmodules/blocktest"
+	"github.com/blockchain-analyzer/agent/agentmodules/checkpoint"
+	"github.com/blockchain-analyzer/agent/agentmodules/retry"
+	"github.com/blockchain-analyzer/agent/agentmodules/transform"
+)
+
+// Creates a dumper writing Parquet files with 2 rows per file to dir
+func newTestParquetDumper(t *testing.T, dir string, source blocksource.BlockSource) *DumperConfig {
+	pd, err := NewParquetDumper(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpointer, err := checkpoint.NewFileCheckpointer(filepath.Join(dir, "checkpoints.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DumperConfig{
+		Sources:       []blocksource.BlockSource{source},
+		LastBlockNums: make(map[string]uint64),
+		StartBlock:    -1,
+		EndBlock:      -1,
+		Transformer:   transform.New(transform.Options{}),
+		Persistence:   pd,
+		Checkpointer:  checkpointer,
+		Channels:      map[string]*ChannelState{source.ChannelID(): {Backoff: &retry.Backoff{}}},
+	}
+}
+
+func checkSavedBlock(t *testing.T, dumper *DumperConfig, expected uint64) {
+	lastCheckpoint, err := dumper.Checkpointer.Load("mychannel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastCheckpoint == nil || lastCheckpoint.BlockNumber != expected {
+		t.Errorf("checkpoint %+v instead of block %d", lastCheckpoint, expected)
+	}
+}
+
+func TestParquetCheckpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	chain := blocktest.NewChain("mychannel")
+	for i := 0; i < 3; i++ {
+		chain.AddBlock(&blocktest.Tx{Chaincode: "fabcar", Version: "1.0", Function: "createCar", Args: []string{"CAR1"}})
+	}
+	source, err := blocksource.NewMemorySource(chain.Blocks...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks 0 and 1 fill the first files, block 2 is in open files: the checkpoint stays at block 1
+	dumper := newTestParquetDumper(t, dir, source)
+	err = fetchChannel(dumper, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSavedBlock(t, dumper, 1)
+
+	// After a crash the open files are deleted, and block 2 is dumped again
+	dumper = newTestParquetDumper(t, dir, source)
+	if tmpFiles, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*", "*.tmp")); len(tmpFiles) != 0 {
+		t.Errorf("incomplete files %v are not deleted", tmpFiles)
+	}
+	err = fetchChannel(dumper, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dumper.LastBlockNums["mychannel"] != 3 {
+		t.Errorf("next block is %d instead of 3", dumper.LastBlockNums["mychannel"])
+	}
+	checkSavedBlock(t, dumper, 1)
+
+	// Closing completes the files, then the checkpoint is saved
+	closePersistence(dumper)
+	checkSavedBlock(t, dumper, 2)
+	files, _ := filepath.Glob(filepath.Join(dir, blockTable, "*", "*", "*"))
+	if len(files) != 2 {
+		t.Errorf("Block files %v instead of 2 files", files)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A JSON Lines file, optionally gzip compressed. The lines of a block are written at once, and compressed as a separate
+// gzip member, so the file is a complete (multi-member) gzip stream after every block.
+type ndjsonFile struct {
+	name      string
+	file      *os.File
+	compress  bool
+	size      int64
+	committed int64
+}
+
+// Creates the file with the next free sequence number in the directory (000000.ndjson, 000001.ndjson, ... or .ndjson.gz if compressed).
+func createNdjsonFile(dir string, compress bool) (*ndjsonFile, error) {
+	extension := ".ndjson"
+	if compress {
+		extension += ".gz"
+	}
+	var file *os.File
+	var err error
+	for seqNum := 0; ; seqNum++ {
+		file, err = os.OpenFile(filepath.Join(dir, fmt.Sprintf("%06d%s", seqNum, extension)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0664)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonFile{name: filepath.Base(file.Name()), file: file, compress: compress}, nil
+}
+
+// Appends the lines of a block to the file, and syncs the file to disk.
+func (f *ndjsonFile) WriteBlock(lines []byte) error {
+	data := lines
+	if f.compress {
+		var compressed bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressed)
+		_, err := gzipWriter.Write(lines)
+		if err == nil {
+			err = gzipWriter.Close()
+		}
+		if err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Marks the lines written so far as complete, Rollback returns the file to this point.
+func (f *ndjsonFile) Commit() {
+	f.committed = f.size
+}
+
+// Removes the lines written since the last Commit.
+func (f *ndjsonFile) Rollback() error {
+	if f.size == f.committed {
+		return nil
+	}
+	err := f.file.Truncate(f.committed)
+	if err != nil {
+		return err
+	}
+	_, err = f.file.Seek(f.committed, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	f.size = f.committed
+	return nil
+}
+
+// Gets the size of the file on disk.
+func (f *ndjsonFile) Size() int64 {
+	return f.size
+}
+
+// Syncs the file to disk and closes it.
+func (f *ndjsonFile) Close() error {
+	err := f.file.Sync()
+	closeErr := f.file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Gets the names of the JSON Lines files of the directory, ordered by sequence number.
+func ndjsonFiles(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.ndjson*"))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, p := range paths {
+		names = append(names, filepath.Base(p))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Truncates the file of the directory to the given size, and removes the files of the directory created after it
+// (the files with a higher sequence number). If file is empty, every file of the directory is removed.
+func truncateNdjsonFiles(dir, file string, size int64) error {
+	names, err := ndjsonFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == file {
+			err = os.Truncate(filepath.Join(dir, name), size)
+		} else if file == "" || sequenceNumber(name) >= sequenceNumber(file) {
+			fmt.Println(fmt.Sprintf("Removing %s, it was written after the last complete block", filepath.Join(dir, name)))
+			err = os.Remove(filepath.Join(dir, name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gets the sequence number part of the name of a file (000001 of 000001.ndjson.gz).
+func sequenceNumber(name string) string {
+	return strings.SplitN(name, ".", 2)[0]
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricsetup"
+)
+
+// Output backends of the dumper
+const (
+	OutputJSON    = "json"
+	OutputParquet = "parquet"
+	OutputSQL     = "sql"
+)
+
+// Settings of the dumper. They are read from the YAML config file given with -config, and every setting except Chaincodes can be overridden
+// by the command line flag of the same name. StartBlock and EndBlock are -1 if not set. Chaincodes configures the linking keys, the redacted
+// arguments and the value decoders of the chaincodes, the same way as in fabricbeat.yml.
+type Options struct {
+	ConnectionProfile string                  `yaml:"connectionProfile"`
+	Organization      string                  `yaml:"organization"`
+	Peer              string                  `yaml:"peer"`
+	AdminCertPath     string                  `yaml:"adminCertPath"`
+	AdminKeyPath      string                  `yaml:"adminKeyPath"`
+	Channels          channelList             `yaml:"channels"`
+	StartBlock        int64                   `yaml:"startBlock"`
+	EndBlock          int64                   `yaml:"endBlock"`
+	Period            time.Duration           `yaml:"period"`
+	Once              bool                    `yaml:"once"`
+	Output            string                  `yaml:"output"`
+	OutputDir         string                  `yaml:"outputDir"`
+	RotateSize        int64                   `yaml:"rotateSize"`
+	RotateBlocks      int                     `yaml:"rotateBlocks"`
+	Gzip              bool                    `yaml:"gzip"`
+	MaxRows           int64                   `yaml:"maxRows"`
+	SQLDriver         string                  `yaml:"sqlDriver"`
+	SQLDSN            string                  `yaml:"sqlDSN"`
+	Blockfiles        string                  `yaml:"blockfiles"`
+	Blocks            string                  `yaml:"blocks"`
+	PrivateData       bool                    `yaml:"privateData"`
+	SkipInvalidWrites bool                    `yaml:"skipInvalidWrites"`
+	MaxArgSize        int                     `yaml:"maxArgSize"`
+	MaxResponseSize   int                     `yaml:"maxResponseSize"`
+	Chaincodes        []fabricsetup.Chaincode `yaml:"chaincodes"`
+}
+
+// Comma separated list of channel IDs
+type channelList []string
+
+func (c *channelList) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *channelList) Set(value string) error {
+	*c = nil
+	for _, channel := range strings.Split(value, ",") {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			*c = append(*c, channel)
+		}
+	}
+	return nil
+}
+
+// Gets the default settings: the org1 admin of the network in ../network/<NETWORK> (basic if NETWORK is not set).
+func defaultOptions() Options {
+	network := os.Getenv("NETWORK")
+	if network == "" {
+		network = "basic"
+	}
+	dirpath, _ := filepath.Abs("../network")
+	fullpath := dirpath + "/" + network + "/"
+
+	return Options{
+		ConnectionProfile: fullpath + "connection-profile-1.yaml",
+		Organization:      "org1",
+		Peer:              "peer0.org1.el-network.com",
+		AdminCertPath:     fullpath + "crypto-config/peerOrganizations/org1.el-network.com/users/Admin@org1.el-network.com/msp/signcerts/Admin@org1.el-network.com-cert.pem",
+		AdminKeyPath:      fullpath + "crypto-config/peerOrganizations/org1.el-network.com/users/Admin@org1.el-network.com/msp/keystore/adminKey1",
+		Channels:          nil,
+		StartBlock:        -1,
+		EndBlock:          -1,
+		Period:            1 * time.Second,
+		Once:              false,
+		Output:            OutputJSON,
+		OutputDir:         ".",
+		RotateSize:        0,
+		RotateBlocks:      0,
+		Gzip:              false,
+		MaxRows:           1000000,
+		SQLDriver:         DriverSQLite,
+		SQLDSN:            "",
+		Blockfiles:        os.Getenv("BLOCKFILES"),
+		Blocks:            os.Getenv("BLOCKS"),
+		PrivateData:       false,
+		SkipInvalidWrites: false,
+		MaxArgSize:        1024,
+		MaxResponseSize:   0,
+		Chaincodes:        nil,
+	}
+}
+
+// Defines the flags of the settings on the flag set, with the current values of the options as defaults.
+func defineFlags(fs *flag.FlagSet, o *Options) {
+	fs.StringVar(&o.ConnectionProfile, "connectionProfile", o.ConnectionProfile, "path of the connection profile of the network")
+	fs.StringVar(&o.Organization, "organization", o.Organization, "name of the organization in the connection profile")
+	fs.StringVar(&o.Peer, "peer", o.Peer, "name of the peer to query in the connection profile")
+	fs.StringVar(&o.AdminCertPath, "adminCertPath", o.AdminCertPath, "path of the certificate of the identity used to query the peer")
+	fs.StringVar(&o.AdminKeyPath, "adminKeyPath", o.AdminKeyPath, "path of the private key of the identity used to query the peer")
+	fs.Var(&o.Channels, "channels", "comma separated list of the channels to dump (defaults to every channel)")
+	fs.Int64Var(&o.StartBlock, "startBlock", o.StartBlock, "number of the first block to dump, overrides the checkpoints (-1 continues from the checkpoints)")
+	fs.Int64Var(&o.EndBlock, "endBlock", o.EndBlock, "number of the last block to dump, implies -once (-1 means no limit)")
+	fs.DurationVar(&o.Period, "period", o.Period, "how often the peer is queried for new blocks")
+	fs.BoolVar(&o.Once, "once", o.Once, "dump the blocks up to the current height (or -endBlock) and exit instead of polling for new blocks")
+	fs.StringVar(&o.Output, "output", o.Output, "output backend: "+OutputJSON+", "+OutputParquet+" or "+OutputSQL)
+	fs.StringVar(&o.OutputDir, "outputDir", o.OutputDir, "directory of the output and the checkpoints")
+	fs.Int64Var(&o.RotateSize, "rotateSize", o.RotateSize, "start a new output file when a file reaches this size in bytes (0 disables the size-based rotation)")
+	fs.IntVar(&o.RotateBlocks, "rotateBlocks", o.RotateBlocks, "start new output files after this many blocks (0 disables the block-count-based rotation)")
+	fs.BoolVar(&o.Gzip, "gzip", o.Gzip, "gzip compress the output files")
+	fs.Int64Var(&o.MaxRows, "maxRows", o.MaxRows, "start new Parquet files after the block in which a file reaches this many rows (0 means no limit)")
+	fs.StringVar(&o.SQLDriver, "sqlDriver", o.SQLDriver, "database driver of the sql output: "+DriverPostgres+" or "+DriverSQLite)
+	fs.StringVar(&o.SQLDSN, "sqlDSN", o.SQLDSN, "data source name of the database of the sql output (defaults to dumper.db in the output directory for "+DriverSQLite+")")
+	fs.StringVar(&o.Blockfiles, "blockfiles", o.Blockfiles, "read the blocks from the block files of a peer ledger in this directory instead of the network (env: BLOCKFILES)")
+	fs.StringVar(&o.Blocks, "blocks", o.Blocks, "read the blocks from the .block files in this directory, or from the standard input if -, instead of the network (env: BLOCKS)")
+	fs.BoolVar(&o.PrivateData, "privateData", o.PrivateData, "fetch the cleartext private data of the collections the organization is a member of")
+	fs.BoolVar(&o.SkipInvalidWrites, "skipInvalidWrites", o.SkipInvalidWrites, "skip the writes of invalid transactions instead of dumping them with is_valid false")
+	fs.IntVar(&o.MaxArgSize, "maxArgSize", o.MaxArgSize, "truncate the chaincode invocation arguments longer than this many bytes (0 means no limit)")
+	fs.IntVar(&o.MaxResponseSize, "maxResponseSize", o.MaxResponseSize, "keep the chaincode response payloads up to this many bytes (0 means the payload is omitted)")
+}
+
+// Parses the command line arguments. The settings of the config file override the defaults, the flags that are set override the config file.
+func parseOptions(args []string) (*Options, error) {
+	fs := flag.NewFlagSet("dumper", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path of the YAML config file")
+	flagOptions := defaultOptions()
+	defineFlags(fs, &flagOptions)
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, errors.New(fmt.Sprintf("Unexpected arguments: %v", fs.Args()))
+	}
+
+	options := defaultOptions()
+	if *configFile != "" {
+		content, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.UnmarshalStrict(content, &options)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error reading config file %s: %s", *configFile, err.Error()))
+		}
+	}
+
+	// Apply the flags that are set on the command line
+	optionFlags := flag.NewFlagSet("dumper", flag.ContinueOnError)
+	defineFlags(optionFlags, &options)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && err == nil {
+			err = optionFlags.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &options, options.validate()
+}
+
+// Checks the settings.
+func (o *Options) validate() error {
+	if o.Output != OutputJSON && o.Output != OutputParquet && o.Output != OutputSQL {
+		return errors.New(fmt.Sprintf("Unknown output backend %q", o.Output))
+	}
+	if o.Blockfiles != "" && o.Blocks != "" {
+		return errors.New("Only one of blockfiles and blocks can be set")
+	}
+	if o.StartBlock < -1 || o.EndBlock < -1 {
+		return errors.New("startBlock and endBlock cannot be negative")
+	}
+	if o.StartBlock >= 0 && o.EndBlock >= 0 && o.StartBlock > o.EndBlock {
+		return errors.New(fmt.Sprintf("startBlock (%d) is after endBlock (%d)", o.StartBlock, o.EndBlock))
+	}
+	if o.RotateSize < 0 || o.RotateBlocks < 0 || o.MaxRows < 0 {
+		return errors.New("rotateSize, rotateBlocks and maxRows cannot be negative")
+	}
+	if o.Output == OutputSQL && o.SQLDriver != DriverPostgres && o.SQLDriver != DriverSQLite {
+		return errors.New(fmt.Sprintf("Unsupported database driver %q", o.SQLDriver))
+	}
+	if o.Output == OutputSQL && o.SQLDriver == DriverPostgres && o.SQLDSN == "" {
+		return errors.New("sqlDSN has to be set for the postgres driver")
+	}
+	if o.Period <= 0 {
+		return errors.New("period has to be positive")
+	}
+	if o.MaxArgSize < 0 || o.MaxResponseSize < 0 {
+		return errors.New("maxArgSize and maxResponseSize cannot be negative")
+	}
+	return nil
+}
+
+// Returns true if the blocks are read from files instead of the network.
+func (o *Options) Offline() bool {
+	return o.Blockfiles != "" || o.Blocks != ""
+}
+
+// Returns true if the dumper exits after dumping the available blocks (or the blocks up to EndBlock) instead of polling for new blocks.
+func (o *Options) OneShot() bool {
+	return o.Once || o.EndBlock >= 0 || o.Offline()
+}
+
+// Returns true if the channel should be dumped.
+func (o *Options) DumpsChannel(channelId string) bool {
+	if len(o.Channels) == 0 {
+		return true
+	}
+	for _, channel := range o.Channels {
+		if channel == channelId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "dumper.yml")
+	err = ioutil.WriteFile(configFile, []byte("peer: peer1.org2.example.com\nchannels: [mychannel, otherchannel]\nperiod: 5s\nendBlock: 20\nmaxArgSize: 64\n"+
+		"chaincodes:\n  - name: fabcar\n    linkingkey: owner\n    values: [make, model]\n    redactArgs: [1]\n  - name: sacc\n    decoder: varint\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := parseOptions([]string{"-config", configFile, "-endBlock", "30", "-organization", "org2", "-skipInvalidWrites", "-maxResponseSize", "256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The flags override the config file, the config file overrides the defaults
+	if options.Peer != "peer1.org2.example.com" || options.Organization != "org2" || options.Period != 5*time.Second || options.EndBlock != 30 {
+		t.Errorf("unexpected options %+v", options)
+	}
+	if !options.SkipInvalidWrites || options.MaxArgSize != 64 || options.MaxResponseSize != 256 {
+		t.Errorf("unexpected transform settings %+v", options)
+	}
+	if options.StartBlock != -1 || options.Output != OutputJSON {
+		t.Errorf("defaults not kept: %+v", options)
+	}
+	if !options.DumpsChannel("otherchannel") || options.DumpsChannel("thirdchannel") {
+		t.Errorf("unexpected channels %v", options.Channels)
+	}
+	if len(options.Chaincodes) != 2 || options.Chaincodes[0].Linkingkey != "owner" || len(options.Chaincodes[0].Values) != 2 ||
+		len(options.Chaincodes[0].RedactArgs) != 1 || options.Chaincodes[1].Decoder != "varint" {
+		t.Errorf("unexpected chaincodes %+v", options.Chaincodes)
+	}
+	if !options.OneShot() {
+		t.Error("setting endBlock has to imply one-shot mode")
+	}
+
+	for _, args := range [][]string{
+		{"-output", "csv"},
+		{"-startBlock", "10", "-endBlock", "5"},
+		{"-config", filepath.Join(dir, "missing.yml")},
+		{"-maxArgSize", "-1"},
+		{"-unknown"},
+	} {
+		if _, err := parseOptions(args); err == nil {
+			t.Errorf("no error for %v", args)
+		}
+	}
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/transform"
+)
+
+// Tables of the Parquet backend
+const (
+	blockTable          = "Block"
+	endorserTxTable     = "EndorserTx"
+	nonEndorserTxTable  = "NonEndorserTx"
+	writeTable          = "Write"
+	readTable           = "Read"
+	configTable         = "Config"
+	chaincodeEventTable = "ChaincodeEvent"
+	deadLetterTable     = "DeadLetter"
+)
+
+// This implementation of the Persistent interface writes every record type to Parquet files for analytics, one table per record type.
+// The files are partitioned by channel and by the date of the block: <Dir>/<table>/channel=<channel ID>/date=<YYYY-MM-DD>/part-<n>.parquet.
+// The readset and the writeset of the endorser transactions are repeated groups, dead letters are written to the DeadLetter table.
+// A file is only readable after it is completed: the open files are named .parquet.tmp until they are completed. The files of a channel
+// are completed together, when the date changes, at the end of the block in which one of them reaches MaxRows rows, or after MaxBlocks
+// blocks, so the completed files only contain whole blocks. The dumper saves the checkpoint of a channel once Committed returns true for it.
+type ParquetDumper struct {
+	Dir       string
+	MaxRows   int64
+	MaxBlocks int
+	files     map[string]*parquetFile
+	// Number of blocks of each channel in the open files
+	blocks map[string]int
+}
+
+// An open Parquet file of a table and channel
+type parquetFile struct {
+	path      string
+	file      *os.File
+	writer    *writer.ParquetWriter
+	channelId string
+	date      string
+	rows      int64
+}
+
+// Creates a ParquetDumper that writes the files under dir. The open files left behind by a previous run that did not exit cleanly
+// are deleted: they are not covered by the checkpoints, so their blocks are dumped again.
+func NewParquetDumper(dir string, maxRows int64) (*ParquetDumper, error) {
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*", "channel=*", "date=*", "*.parquet.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmpFile := range tmpFiles {
+		fmt.Println(fmt.Sprintf("Deleting incomplete file %s", tmpFile))
+		err = os.Remove(tmpFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ParquetDumper{
+		Dir:     dir,
+		MaxRows: maxRows,
+		files:   make(map[string]*parquetFile),
+		blocks:  make(map[string]int),
+	}, nil
+}
+
+// Columns of the Block table. The commit hash is not set if the peer does not compute it.
+type blockRow struct {
+	ChannelId       string              `parquet:"name=channel_id, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	BlockNumber     int64               `parquet:"name=block_number, type=INT64"`
+	BlockHash       string              `parquet:"name=block_hash, type=UTF8"`
+	PreviousHash    string              `parquet:"name=previous_hash, type=UTF8"`
+	DataHash        string              `parquet:"name=data_hash, type=UTF8"`
+	CreatedAt       int64               `parquet:"name=created_at, type=TIMESTAMP_MILLIS"`
+	TxType          string              `parquet:"name=tx_type, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	ValidTxCount    int32               `parquet:"name=valid_tx_count, type=INT32"`
+	InvalidTxCount  int32               `parquet:"name=invalid_tx_count, type=INT32"`
+	Transactions    []string            `parquet:"name=transactions, type=UTF8, repetitiontype=REPEATED"`
+	Txs             []blockTxRow        `parquet:"name=txs, repetitiontype=REPEATED"`
+	Signatures      []blockSignatureRow `parquet:"name=signatures, repetitiontype=REPEATED"`
+	LastConfigIndex int64               `parquet:"name=last_config_index, type=INT64"`
+	CommitHash      *string             `parquet:"name=commit_hash, type=UTF8, repetitiontype=OPTIONAL"`
+}
+
+// A transaction of a block
+type blockTxRow struct {
+	TxIndex        int32  `parquet:"name=tx_index, type=INT32"`
+	TxId           string `parquet:"name=tx_id, type=UTF8"`
+	TxType         string `parquet:"name=tx_type, type=UTF8"`
+	ValidationCode string `parquet:"name=validation_code, type=UTF8"`
+}
+
+// A signature of the block metadata
+type blockSignatureRow struct {
+	MSPID       string `parquet:"name=msp_id, type=UTF8"`
+	Subject     string `parquet:"name=subject, type=UTF8"`
+	Fingerprint string `parquet:"name=fingerprint, type=UTF8"`
+	Signature   string `parquet:"name=signature, type=UTF8"`
+}
+
+// Columns of the NonEndorserTx table, also the first columns of the EndorserTx table
+type nonEndorserTxRow struct {
+	ChannelId      string `parquet:"name=channel_id, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	BlockNumber    int64  `parquet:"name=block_number, type=INT64"`
+	TxIndex        int32  `parquet:"name=tx_index, type=INT32"`
+	TxId           string `parquet:"name=tx_id, type=UTF8"`
+	CreatedAt      int64  `parquet:"name=created_at, type=TIMESTAMP_MILLIS"`
+	Creator        string `parquet:"name=creator, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	CreatorOrg     string `parquet:"name=creator_org, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	TxType         string `parquet:"name=tx_type, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	ValidationCode string `parquet:"name=validation_code, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	IsValid        bool   `parquet:"name=is_valid, type=BOOLEAN"`
+}
+
+// Columns of the EndorserTx table, one row per action
+type endorserTxRow struct {
+	ChannelId        string        `parquet:"name=channel_id, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	BlockNumber      int64         `parquet:"name=block_number, type=INT64"`
+	TxIndex          int32         `parquet:"name=tx_index, type=INT32"`
+	TxId             string        `parquet:"name=tx_id, type=UTF8"`
+	CreatedAt        int64         `parquet:"name=created_at, type=TIMESTAMP_MILLIS"`
+	Creator          string        `parquet:"name=creator, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	CreatorOrg       string        `parquet:"name=creator_org, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	TxType           string        `parquet:"name=tx_type, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	ValidationCode   string        `parquet:"name=validation_code, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	IsValid          bool          `parquet:"name=is_valid, type=BOOLEAN"`
+	ActionIndex      int32         `parquet:"name=action_index, type=INT32"`
+	ActionCount      int32         `parquet:"name=action_count, type=INT32"`
+	ChaincodeName    string        `parquet:"name=chaincode_name, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	ChaincodeVersion string        `parquet:"name=chaincode_version, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Function         string        `parquet:"name=function, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Args             []string      `parquet:"name=args, type=UTF8, repetitiontype=REPEATED"`
+	Readset          []readsetRow  `parquet:"name=readset, repetitiontype=REPEATED"`
+	Writeset         []writesetRow `parquet:"name=writeset, repetitiontype=REPEATED"`
+	Collections      []string      `parquet:"name=collections, type=UTF8, repetitiontype=REPEATED"`
+	EndorserOrgs     []string      `parquet:"name=endorser_orgs, type=UTF8, repetitiontype=REPEATED"`
+	EndorsementCount int32         `parquet:"name=endorsement_count, type=INT32"`
+	ResponseStatus   int32         `parquet:"name=response_status, type=INT32"`
+	ResponseMessage  string        `parquet:"name=response_message, type=UTF8"`
+}
+
+// A key read by an endorser transaction. The version is not set if the key did not exist.
+type readsetRow struct {
+	Namespace       string `parquet:"name=namespace, type=UTF8"`
+	Key             string `parquet:"name=key, type=UTF8"`
+	VersionBlockNum *int64 `parquet:"name=version_block_num, type=INT64, repetitiontype=OPTIONAL"`
+	VersionTxNum    *int64 `parquet:"name=version_tx_num, type=INT64, repetitiontype=OPTIONAL"`
+}
+
+// A key written by an endorser transaction. The value is JSON encoded.
+type writesetRow struct {
+	Namespace string `parquet:"name=namespace, type=UTF8"`
+	Key       string `parquet:"name=key, type=UTF8"`
+	Value     string `parquet:"name=value, type=UTF8"`
+	IsDelete  bool   `parquet:"name=is_delete, type=BOOLEAN"`
+}
+
+// Columns of the Write table. The value is JSON encoded.
+type writeRow struct {
+	ChannelId        string `parquet:"name=channel_id, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	BlockNumber      int64  `parquet:"name=block_number, type=INT64"`
+	TxIndex          int32  `parquet:"name=tx_index, type=INT32"`
+	TxId             string `parquet:"name=tx_id, type=UTF8"`
+	CreatedAt        int64  `parquet:"name=created_at, type=TIMESTAMP_MILLIS"`
+	IsValid          bool   `parquet:"name=is_valid, type=BOOLEAN"`
+	ActionIndex      int32  `parquet:"name=action_index, type=INT32"`
+	WriteIndex       int32  `parquet:"name=write_index, type=INT32"`
+	WriteType        string `parquet:"name=write_type, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Namespace        string `parquet:"name=namespace, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	ChaincodeName    string `parquet:"name=chaincode_name, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	ChaincodeVersion string `parquet:"name=chaincode_version, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Collection       string `parquet:"name=collection, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	KeyHash          string `parquet:"name=key_hash, type=UTF8"`
+	ValueHash        string `parquet:"name=value_hash, type=UTF8"`
+	Key              string `parquet:"name=key, type=UTF8"`
+	IsDelete         bool   `parquet:"name=is_delete, type=BOOLEAN"`
+	LinkingKey       string `parquet:"name=linking_key, type=UTF8"`
+	Value            string `parquet:"name=value, type=UTF8"`
+	ValueDecoder     string `parquet:"name=value_decoder, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	DecodeError      string `parquet:"name=decode_error, type=UTF8"`
+}
+
+// Columns of the Read table
+type readRow struct {
+	ChannelId       string `parquet:"name=channel_id, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	BlockNumber     int64  `parquet:"name=block_number, type=INT64"`
+	TxIndex         int32  `parquet:"name=tx_index, type=INT32"`
+	TxId            string `parquet:"name=tx_id, type=UTF8"`
+	CreatedAt       int64  `parquet:"name=created_at, type=TIMESTAMP_MILLIS"`
+	IsValid         bool   `parquet:"name=is_valid, type=BOOLEAN"`
+	ActionIndex     int32  `parquet:"name=action_index, type=INT32"`
+	ReadIndex       int32  `parquet:"name=read_index, type=INT32"`
+	Namespace       string `parquet:"name=namespace, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	ChaincodeName   string `parquet:"name=chaincode_name, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Key             string `parquet:"name=key, type=UTF8"`
+	VersionBlockNum *int64 `parquet:"name=version_block_num, type=INT64, repetitiontype=OPTIONAL"`
+	VersionTxNum    *int64 `parquet:"name=version_tx_num, type=INT64, repetitiontype=OPTIONAL"`
+}
+
+// Columns of the Config table. The config and its changes are JSON encoded.
+type configRow struct {
+	ChannelId      string   `parquet:"name=channel_id, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	BlockNumber    int64    `parquet:"name=block_number, type=INT64"`
+	TxIndex        int32    `parquet:"name=tx_index, type=INT32"`
+	TxId           string   `parquet:"name=tx_id, type=UTF8"`
+	CreatedAt      int64    `parquet:"name=created_at, type=TIMESTAMP_MILLIS"`
+	Creator        string   `parquet:"name=creator, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	CreatorOrg     string   `parquet:"name=creator_org, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	ValidationCode string   `parquet:"name=validation_code, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	IsValid        bool     `parquet:"name=is_valid, type=BOOLEAN"`
+	Config         string   `parquet:"name=config, type=UTF8"`
+	Changes        string   `parquet:"name=changes, type=UTF8"`
+	Signers        []string `parquet:"name=signers, type=UTF8, repetitiontype=REPEATED"`
+}
+
+// Columns of the ChaincodeEvent table. The payload is JSON encoded.
+type chaincodeEventRow struct {
+	ChannelId     string `parquet:"name=channel_id, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	BlockNumber   int64  `parquet:"name=block_number, type=INT64"`
+	TxIndex       int32  `parquet:"name=tx_index, type=INT32"`
+	TxId          string `parquet:"name=tx_id, type=UTF8"`
+	CreatedAt     int64  `parquet:"name=created_at, type=TIMESTAMP_MILLIS"`
+	IsValid       bool   `parquet:"name=is_valid, type=BOOLEAN"`
+	ActionIndex   int32  `parquet:"name=action_index, type=INT32"`
+	ChaincodeName string `parquet:"name=chaincode_name, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	EventName     string `parquet:"name=event_name, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Payload       string `parquet:"name=payload, type=UTF8"`
+}
+
+// Columns of the DeadLetter table
+type deadLetterRow struct {
+	ChannelId   string `parquet:"name=channel_id, type=UTF8"`
+	BlockNumber int64  `parquet:"name=block_number, type=INT64"`
+	BlockHash   string `parquet:"name=block_hash, type=UTF8"`
+	Error       string `parquet:"name=error, type=UTF8"`
+	Block       string `parquet:"name=block, type=BYTE_ARRAY"`
+}
+
+// Writes non-endorser transaction data to the NonEndorserTx table.
+func (pd *ParquetDumper) PersistNonEndorserTx(tx *transform.Transaction) error {
+	row := nonEndorserTxRow{
+		ChannelId:      tx.ChannelId,
+		BlockNumber:    int64(tx.BlockNumber),
+		TxIndex:        int32(tx.TxIndex),
+		TxId:           tx.TxId,
+		CreatedAt:      timestampMillis(tx.CreatedAt),
+		Creator:        tx.Creator,
+		CreatorOrg:     tx.CreatorOrg,
+		TxType:         tx.TxType,
+		ValidationCode: tx.ValidationCode,
+		IsValid:        tx.IsValid,
+	}
+	return pd.write(nonEndorserTxTable, tx.ChannelId, tx.CreatedAt, new(nonEndorserTxRow), row)
+}
+
+// Writes endorser transaction data to the EndorserTx table, with the readset and the writeset of the action.
+func (pd *ParquetDumper) PersistEndorserTx(tx *transform.Transaction) error {
+	row := endorserTxRow{
+		ChannelId:        tx.ChannelId,
+		BlockNumber:      int64(tx.BlockNumber),
+		TxIndex:          int32(tx.TxIndex),
+		TxId:             tx.TxId,
+		CreatedAt:        timestampMillis(tx.CreatedAt),
+		Creator:          tx.Creator,
+		CreatorOrg:       tx.CreatorOrg,
+		TxType:           tx.TxType,
+		ValidationCode:   tx.ValidationCode,
+		IsValid:          tx.IsValid,
+		ActionIndex:      int32(tx.ActionIndex),
+		ActionCount:      int32(tx.ActionCount),
+		ChaincodeName:    tx.ChaincodeName,
+		ChaincodeVersion: tx.ChaincodeVersion,
+		Function:         tx.Function,
+		Args:             tx.Args,
+		Collections:      tx.Collections,
+		EndorserOrgs:     tx.EndorserOrgs,
+		EndorsementCount: int32(tx.EndorsementCount),
+		ResponseStatus:   tx.ResponseStatus,
+		ResponseMessage:  tx.ResponseMessage,
+	}
+	for _, read := range tx.Readset {
+		readset := readsetRow{Namespace: read.Namespace, Key: read.Key}
+		if read.Version != nil {
+			blockNum, txNum := int64(read.Version.BlockNum), int64(read.Version.TxNum)
+			readset.VersionBlockNum, readset.VersionTxNum = &blockNum, &txNum
+		}
+		row.Readset = append(row.Readset, readset)
+	}
+	for _, write := range tx.Writeset {
+		value, err := jsonString(write.Value)
+		if err != nil {
+			return err
+		}
+		row.Writeset = append(row.Writeset, writesetRow{Namespace: write.Namespace, Key: write.Key, Value: value, IsDelete: write.IsDelete})
+	}
+	return pd.write(endorserTxTable, tx.ChannelId, tx.CreatedAt, new(endorserTxRow), row)
+}
+
+// Writes write data to the Write table.
+func (pd *ParquetDumper) PersistWrite(w *transform.Write) error {
+	value, err := jsonString(w.Value)
+	if err != nil {
+		return err
+	}
+	row := writeRow{
+		ChannelId:        w.ChannelId,
+		BlockNumber:      int64(w.BlockNumber),
+		TxIndex:          int32(w.TxIndex),
+		TxId:             w.TxId,
+		CreatedAt:        timestampMillis(w.CreatedAt),
+		IsValid:          w.IsValid,
+		ActionIndex:      int32(w.ActionIndex),
+		WriteIndex:       int32(w.WriteIndex),
+		WriteType:        w.WriteType,
+		Namespace:        w.Namespace,
+		ChaincodeName:    w.ChaincodeName,
+		ChaincodeVersion: w.ChaincodeVersion,
+		Collection:       w.Collection,
+		KeyHash:          w.KeyHash,
+		ValueHash:        w.ValueHash,
+		Key:              w.Key,
+		IsDelete:         w.IsDelete,
+		LinkingKey:       w.LinkingKey,
+		Value:            value,
+		ValueDecoder:     w.ValueDecoder,
+		DecodeError:      w.DecodeError,
+	}
+	return pd.write(writeTable, w.ChannelId, w.CreatedAt, new(writeRow), row)
+}
+
+// Writes read data to the Read table. The version is not set if the key did not exist.
+func (pd *ParquetDumper) PersistRead(r *transform.Read) error {
+	row := readRow{
+		ChannelId:     r.ChannelId,
+		BlockNumber:   int64(r.BlockNumber),
+		TxIndex:       int32(r.TxIndex),
+		TxId:          r.TxId,
+		CreatedAt:     timestampMillis(r.CreatedAt),
+		IsValid:       r.IsValid,
+		ActionIndex:   int32(r.ActionIndex),
+		ReadIndex:     int32(r.ReadIndex),
+		Namespace:     r.Namespace,
+		ChaincodeName: r.ChaincodeName,
+		Key:           r.Key,
+	}
+	if r.Version != nil {
+		blockNum, txNum := int64(r.Version.BlockNum), int64(r.Version.TxNum)
+		row.VersionBlockNum, row.VersionTxNum = &blockNum, &txNum
+	}
+	return pd.write(readTable, r.ChannelId, r.CreatedAt, new(readRow), row)
+}
+
+// Writes block data to the Block table.
+func (pd *ParquetDumper) PersistBlock(b *transform.Block) error {
+	row := blockRow{
+		ChannelId:       b.ChannelId,
+		BlockNumber:     int64(b.BlockNumber),
+		BlockHash:       b.BlockHash,
+		PreviousHash:    b.PreviousHash,
+		DataHash:        b.DataHash,
+		CreatedAt:       timestampMillis(b.CreatedAt),
+		TxType:          b.TxType,
+		ValidTxCount:    int32(b.ValidTxCount),
+		InvalidTxCount:  int32(b.InvalidTxCount),
+		Transactions:    b.Transactions,
+		LastConfigIndex: int64(b.LastConfigIndex),
+	}
+	for _, tx := range b.Txs {
+		row.Txs = append(row.Txs, blockTxRow{TxIndex: int32(tx.TxIndex), TxId: tx.TxId, TxType: tx.TxType, ValidationCode: tx.ValidationCode})
+	}
+	for _, signature := range b.Signatures {
+		row.Signatures = append(row.Signatures, blockSignatureRow{MSPID: signature.MSPID, Subject: signature.Subject, Fingerprint: signature.Fingerprint, Signature: signature.Signature})
+	}
+	if b.CommitHash != "" {
+		commitHash := b.CommitHash
+		row.CommitHash = &commitHash
+	}
+	err := pd.write(blockTable, b.ChannelId, b.CreatedAt, new(blockRow), row)
+	if err != nil {
+		return err
+	}
+	return pd.endBlock(b.ChannelId)
+}
+
+// Writes config data to the Config table.
+func (pd *ParquetDumper) PersistConfig(c *transform.Config) error {
+	config, err := jsonString(c.Config)
+	if err != nil {
+		return err
+	}
+	changes, err := jsonString(c.Changes)
+	if err != nil {
+		return err
+	}
+	row := configRow{
+		ChannelId:      c.ChannelId,
+		BlockNumber:    int64(c.BlockNumber),
+		TxIndex:        int32(c.TxIndex),
+		TxId:           c.TxId,
+		CreatedAt:      timestampMillis(c.CreatedAt),
+		Creator:        c.Creator,
+		CreatorOrg:     c.CreatorOrg,
+		ValidationCode: c.ValidationCode,
+		IsValid:        c.IsValid,
+		Config:         config,
+		Changes:        changes,
+		Signers:        c.Signers,
+	}
+	return pd.write(configTable, c.ChannelId, c.CreatedAt, new(configRow), row)
+}
+
+// Writes chaincode event data to the ChaincodeEvent table.
+func (pd *ParquetDumper) PersistChaincodeEvent(e *transform.Event) error {
+	payload, err := jsonString(e.Payload)
+	if err != nil {
+		return err
+	}
+	row := chaincodeEventRow{
+		ChannelId:     e.ChannelId,
+		BlockNumber:   int64(e.BlockNumber),
+		TxIndex:       int32(e.TxIndex),
+		TxId:          e.TxId,
+		CreatedAt:     timestampMillis(e.CreatedAt),
+		IsValid:       e.IsValid,
+		ActionIndex:   int32(e.ActionIndex),
+		ChaincodeName: e.ChaincodeName,
+		EventName:     e.EventName,
+		Payload:       payload,
+	}
+	return pd.write(chaincodeEventTable, e.ChannelId, e.CreatedAt, new(chaincodeEventRow), row)
+}
+
+// Writes a block that cannot be decoded to the DeadLetter table, partitioned by the date it was dumped.
+func (pd *ParquetDumper) PersistDeadLetter(d *DeadLetter) error {
+	row := deadLetterRow{
+		ChannelId:   d.ChannelId,
+		BlockNumber: int64(d.BlockNumber),
+		BlockHash:   d.BlockHash,
+		Error:       d.Error,
+		Block:       string(d.Block),
+	}
+	err := pd.write(deadLetterTable, d.ChannelId, time.Now(), new(deadLetterRow), row)
+	if err != nil {
+		return err
+	}
+	return pd.endBlock(d.ChannelId)
+}
+
+// Returns true if the rows of the channel written so far are in completed files.
+func (pd *ParquetDumper) Committed(channelId string) bool {
+	for _, file := range pd.files {
+		if file.channelId == channelId {
+			return false
+		}
+	}
+	return true
+}
+
+// Completes the open files.
+func (pd *ParquetDumper) Close() error {
+	var firstErr error
+	for key, file := range pd.files {
+		err := file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(pd.files, key)
+	}
+	for channelId := range pd.blocks {
+		delete(pd.blocks, channelId)
+	}
+	return firstErr
+}
+
+// Completes the files of the channel at the end of a block if one of them has MaxRows rows, or if they have MaxBlocks blocks.
+func (pd *ParquetDumper) endBlock(channelId string) error {
+	pd.blocks[channelId]++
+	if pd.MaxBlocks > 0 && pd.blocks[channelId] >= pd.MaxBlocks {
+		return pd.completeChannel(channelId)
+	}
+	for _, file := range pd.files {
+		if file.channelId == channelId && pd.MaxRows > 0 && file.rows >= pd.MaxRows {
+			return pd.completeChannel(channelId)
+		}
+	}
+	return nil
+}
+
+// Completes the open files of the channel.
+func (pd *ParquetDumper) completeChannel(channelId string) error {
+	var firstErr error
+	for key, file := range pd.files {
+		if file.channelId != channelId {
+			continue
+		}
+		err := file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(pd.files, key)
+	}
+	delete(pd.blocks, channelId)
+	return firstErr
+}
+
+// Appends a row to the open file of the table and channel. The rows of a block have the date of the block, so a row with a new date
+// starts a new block: the files of the channel are completed first, and the row goes to a new file in the partition of the new date.
+func (pd *ParquetDumper) write(table, channelId string, createdAt time.Time, schema interface{}, row interface{}) error {
+	date := createdAt.UTC().Format("2006-01-02")
+	for _, file := range pd.files {
+		if file.channelId == channelId && file.date != date {
+			err := pd.completeChannel(channelId)
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	key := table + "/" + channelId
+	file, ok := pd.files[key]
+	if !ok {
+		dir := filepath.Join(pd.Dir, table, "channel="+channelId, "date="+date)
+		var err error
+		file, err = createParquetFile(dir, schema)
+		if err != nil {
+			return err
+		}
+		file.channelId = channelId
+		file.date = date
+		pd.files[key] = file
+	}
+
+	err := file.writer.Write(row)
+	if err != nil {
+		return err
+	}
+	file.rows++
+	return nil
+}
+
+// Creates the file with the next free part number in the directory. It is named .parquet.tmp until it is closed.
+func createParquetFile(dir string, schema interface{}) (*parquetFile, error) {
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		return nil, err
+	}
+	var p string
+	for partNum := 0; ; partNum++ {
+		p = filepath.Join(dir, fmt.Sprintf("part-%06d.parquet", partNum))
+		_, err = os.Stat(p)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Create(p + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	pw, err := writer.NewParquetWriter(osFile{file}, schema, 1)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetFile{path: p, file: file, writer: pw}, nil
+}
+
+// Adapts a file to the ParquetFile interface of parquet-go. An empty name opens the same file again.
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = f.Name()
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{file}, nil
+}
+
+func (f osFile) Create(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = f.Name()
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{file}, nil
+}
+
+// Writes the footer of the file, closes it and gives it its final name.
+func (f *parquetFile) Close() error {
+	err := f.writer.WriteStop()
+	if err == nil {
+		err = f.file.Sync()
+	}
+	closeErr := f.file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(f.file.Name(), f.path)
+}
+
+// Converts a time to milliseconds since the epoch.
+func timestampMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// JSON encodes a decoded value, nil is an empty string.
+func jsonString(value interface{}) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	valueJSONBytes, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(valueJSONBytes), nil
+}
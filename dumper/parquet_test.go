@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/transform"
+)
+
+func TestParquetDumper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pd, err := NewParquetDumper(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2020, 1, 31, 23, 0, 0, 0, time.UTC)
+	for i, createdAt := range []time.Time{day, day, day, day.Add(2 * time.Hour)} {
+		header := transform.TxHeader{ChannelId: "mychannel", BlockNumber: uint64(i), TxId: "tx", CreatedAt: createdAt, TxType: transform.EndorserTransaction}
+		err = pd.PersistEndorserTx(&transform.Transaction{
+			TxHeader: header,
+			Readset:  []*fabricutils.Readset{{Namespace: "fabcar", Key: "CAR1", Version: &fabricutils.Version{BlockNum: 1}}, {Namespace: "fabcar", Key: "CAR2"}},
+			Writeset: []*fabricutils.Writeset{{Namespace: "fabcar", Key: "CAR1", Value: map[string]interface{}{"owner": "Tom"}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pd.PersistRead(&transform.Read{TxHeader: header, Namespace: "fabcar", Key: "CAR1", Version: &fabricutils.Version{BlockNum: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pd.PersistChaincodeEvent(&transform.Event{TxHeader: header, ChaincodeName: "fabcar", EventName: "created", Payload: map[string]interface{}{"car": "CAR1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pd.PersistConfig(&transform.Config{TxHeader: header, Signers: []string{"Org1MSP"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pd.PersistBlock(&transform.Block{ChannelId: "mychannel", BlockNumber: uint64(i), CreatedAt: createdAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The files are only renamed when they are completed
+	if tmpFiles, _ := filepath.Glob(filepath.Join(dir, "Block", "*", "*", "*.tmp")); len(tmpFiles) != 1 {
+		t.Errorf("%d open files instead of 1", len(tmpFiles))
+	}
+	if pd.Committed("mychannel") {
+		t.Error("the last block of the channel is committed before the files are completed")
+	}
+	err = pd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pd.Committed("mychannel") {
+		t.Error("the blocks of the channel are not committed after Close")
+	}
+
+	// 3 blocks on the first day, rolled over after 2 rows, and 1 block on the next day
+	expectedFiles := []string{
+		"channel=mychannel/date=2020-01-31/part-000000.parquet",
+		"channel=mychannel/date=2020-01-31/part-000001.parquet",
+		"channel=mychannel/date=2020-02-01/part-000000.parquet",
+	}
+	for _, table := range []string{blockTable, endorserTxTable, readTable, configTable, chaincodeEventTable} {
+		files, err := filepath.Glob(filepath.Join(dir, table, "*", "*", "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != len(expectedFiles) {
+			t.Fatalf("%s: files %v instead of %v", table, files, expectedFiles)
+		}
+		for i, file := range files {
+			if file != filepath.Join(dir, table, expectedFiles[i]) {
+				t.Errorf("%s: file %s instead of %s", table, file, expectedFiles[i])
+			}
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(content, []byte("PAR1")) || !bytes.HasSuffix(content, []byte("PAR1")) {
+				t.Errorf("%s is not a complete Parquet file", file)
+			}
+		}
+	}
+}
+
+func TestParquetDumperMaxBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pd, err := NewParquetDumper(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pd.MaxBlocks = 2
+	createdAt := time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+	committed := []bool{}
+	for i := 0; i < 5; i++ {
+		err = pd.PersistBlock(&transform.Block{ChannelId: "mychannel", BlockNumber: uint64(i), CreatedAt: createdAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		committed = append(committed, pd.Committed("mychannel"))
+	}
+
+	// The files are completed every 2 blocks, without a row limit
+	if !reflect.DeepEqual(committed, []bool{false, true, false, true, false}) {
+		t.Errorf("committed after each block %v", committed)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, blockTable, "*", "*", "*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("%d completed files instead of 2", len(files))
+	}
+	err = pd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,85 +1,410 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/transform"
 )
 
 // Implement this interface for custom persistence (e.g., writing the data into database instead of json), and use that instead of FileDumper. For example, see FileDumper.
+// The records are created by the transform module, PersistNonEndorserTx and PersistEndorserTx receive the non-endorser and the endorser transactions respectively.
+// PersistBlock is called after the other records of the block, and PersistDeadLetter instead of the records of a block that cannot be decoded,
+// so both mark the end of a block. Close is called when the dumper exits.
 type Persistent interface {
-	PersistNonEndorserTx(NonEndorserTx) error
-	PersistEndorserTx(EndorserTx) error
-	PersistWrite(Write) error
-	PersistBlock(Block) error
+	PersistNonEndorserTx(*transform.Transaction) error
+	PersistEndorserTx(*transform.Transaction) error
+	PersistWrite(*transform.Write) error
+	PersistRead(*transform.Read) error
+	PersistBlock(*transform.Block) error
+	PersistConfig(*transform.Config) error
+	PersistChaincodeEvent(*transform.Event) error
+	PersistDeadLetter(*DeadLetter) error
+	Close() error
+}
+
+// Implemented by the backends that complete the records of a block later than the end of the block, e.g. when a file is completed.
+// The dumper only saves the checkpoint of a channel when Committed returns true for it (and after Close), so that the checkpoint
+// never gets ahead of the completed records.
+type Committer interface {
+	Committed(channelId string) bool
 }
 
-// This implementation of the Persistent interface writes data to separate json files.
+// A block that cannot be decoded, together with the error. Block is the raw protobuf of the block (base64 encoded in json),
+// so that it can be examined and reprocessed later.
+type DeadLetter struct {
+	ChannelId   string `json:"channelId"`
+	BlockNumber uint64 `json:"blockNumber"`
+	BlockHash   string `json:"blockHash"`
+	Error       string `json:"error"`
+	Block       []byte `json:"block"`
+}
+
+// This implementation of the Persistent interface writes the records to JSON Lines files (one record per line), one directory per record type.
+// The records of a block are collected in memory and written at the end of the block, then the files are synced to disk and their sizes
+// are saved to OffsetsPath, which completes the block. If anything fails, the files are truncated back to the end of the previous block,
+// and on restart the files are truncated to the saved sizes, so a retried block is never written twice. The blocks that are already
+// in the files (e.g. after a crash before the checkpoint was saved) are skipped. A new file is started after RotateBlocks blocks or when
+// a file reaches RotateSize bytes (0 disables the rotation), the files of every run start with the next free sequence number.
+// If Gzip is true, the files are gzip compressed, every block as a separate gzip member. Close has to be called at the end.
 type FileDumper struct {
-	NonEndorserTxPath   string
-	NonEndorserTxSeqNum uint64
-	EndorserTxPath      string
-	WritePath           string
-	WriteSeqNum         uint64
-	BlockPath           string
+	NonEndorserTxPath  string
+	EndorserTxPath     string
+	WritePath          string
+	ReadPath           string
+	BlockPath          string
+	ConfigPath         string
+	ChaincodeEventPath string
+	DeadLetterPath     string
+	OffsetsPath        string
+	RotateSize         int64
+	RotateBlocks       int
+	Gzip               bool
+	files              map[string]*ndjsonFile
+	lines              map[string]*bytes.Buffer
+	offsets            *fileOffsets
+	blocks             int
+	// Set if the files could not be restored after an error, nothing is written afterwards
+	failed error
+}
+
+// The state of the files at the end of the last complete block, saved to OffsetsPath
+type fileOffsets struct {
+	// The last file of each directory (keyed by the name of the directory) and its size
+	Files map[string]*fileOffset `json:"files"`
+	// The next block of each channel
+	NextBlocks map[string]uint64 `json:"nextBlocks"`
+}
+
+type fileOffset struct {
+	File string `json:"file"`
+	Size int64  `json:"size"`
+}
+
+// Writes non-endorser transaction data to the NonEndorserTx files.
+func (fd *FileDumper) PersistNonEndorserTx(tx *transform.Transaction) error {
+	return fd.persist(fd.NonEndorserTxPath, tx)
+}
+
+// Writes endorser transaction data to the EndorserTx files.
+func (fd *FileDumper) PersistEndorserTx(tx *transform.Transaction) error {
+	return fd.persist(fd.EndorserTxPath, tx)
+}
+
+// Writes write data to the Write files.
+func (fd *FileDumper) PersistWrite(w *transform.Write) error {
+	return fd.persist(fd.WritePath, w)
+}
+
+// Writes read data to the Read files.
+func (fd *FileDumper) PersistRead(r *transform.Read) error {
+	return fd.persist(fd.ReadPath, r)
+}
+
+// Writes block data to the Block files. The block is the last record of a block, the records of the block are written afterwards.
+func (fd *FileDumper) PersistBlock(b *transform.Block) error {
+	err := fd.persist(fd.BlockPath, b)
+	if err != nil {
+		return err
+	}
+	return fd.endBlock(b.ChannelId, b.BlockNumber)
 }
 
-// Writes non-endorser transaction data to a json file. Uses an increasing sequence number for file naming.
-func (fd *FileDumper) PersistNonEndorserTx(tx NonEndorserTx) error {
-	err := fd.persistToFile(tx, path.Join(fd.NonEndorserTxPath, fmt.Sprintf("%d.json", fd.NonEndorserTxSeqNum)))
-	fd.NonEndorserTxSeqNum = fd.NonEndorserTxSeqNum + 1
-	return err
+// Writes config data to the Config files.
+func (fd *FileDumper) PersistConfig(c *transform.Config) error {
+	return fd.persist(fd.ConfigPath, c)
 }
 
-// Writes endorser transaction data to a json file. Uses the transaction ID for file naming.
-func (fd *FileDumper) PersistEndorserTx(tx EndorserTx) error {
-	return fd.persistToFile(tx, path.Join(fd.EndorserTxPath, fmt.Sprintf("%s.json", tx.TxID)))
+// Writes chaincode event data to the ChaincodeEvent files.
+func (fd *FileDumper) PersistChaincodeEvent(e *transform.Event) error {
+	return fd.persist(fd.ChaincodeEventPath, e)
 }
 
-// Writes write data to a json file. Uses an increasing sequence number for file naming.
-func (fd *FileDumper) PersistWrite(w Write) error {
-	err := fd.persistToFile(w, path.Join(fd.WritePath, fmt.Sprintf("%d.json", fd.WriteSeqNum)))
-	fd.WriteSeqNum = fd.WriteSeqNum + 1
-	return err
+// Writes a block that cannot be decoded to the DeadLetter files. It replaces the records of the block, which is written afterwards.
+func (fd *FileDumper) PersistDeadLetter(d *DeadLetter) error {
+	err := fd.persist(fd.DeadLetterPath, d)
+	if err != nil {
+		return err
+	}
+	return fd.endBlock(d.ChannelId, d.BlockNumber)
 }
 
-// Writes block data to a json file. Uses channel ID and block number for file naming.
-func (fd *FileDumper) PersistBlock(b Block) error {
-	return fd.persistToFile(b, path.Join(fd.BlockPath, fmt.Sprintf("%s-%d.json", b.ChannelID, b.BlockNumber)))
+// Returns true if every record persisted so far is in the files. The records of a block are only written at the end of the block.
+func (fd *FileDumper) Committed(channelId string) bool {
+	return len(fd.lines) == 0
+}
+
+// Closes the files. The records of an incomplete block are dropped, the block is dumped again after a restart.
+func (fd *FileDumper) Close() error {
+	fd.lines = nil
+	var firstErr error
+	for dir, file := range fd.files {
+		err := file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(fd.files, dir)
+	}
+	return firstErr
 }
 
-// Persists an object to a given json file. If the file does not exists, it creates.
-// If the file already exists, it appends the new json to the end. NOTE: This breaks the json syntax of the file (missing "[", "]" and "," characters).
-func (fd *FileDumper) persistToFile(object interface{}, file string) error {
+// Adds an object to the lines of the directory as a line of JSON. The lines are written at the end of the block.
+func (fd *FileDumper) persist(dir string, object interface{}) error {
+	if fd.failed != nil {
+		return fd.failed
+	}
 	objectJSONBytes, err := json.Marshal(object)
 	if err != nil {
-		fmt.Println(err)
+		// The block is persisted again from the start when it is retried
+		fd.lines = nil
 		return err
 	}
-	objectJSONString := string(objectJSONBytes)
 
-	f, err := os.OpenFile(file,
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if fd.lines == nil {
+		fd.lines = make(map[string]*bytes.Buffer)
+	}
+	lines, ok := fd.lines[dir]
+	if !ok {
+		lines = &bytes.Buffer{}
+		fd.lines[dir] = lines
+	}
+	lines.Write(objectJSONBytes)
+	lines.WriteByte('\n')
+	return nil
+}
+
+// Writes the lines of the block to the files and syncs them to disk, then saves the offsets of the files. If any of these fails,
+// the files are truncated back to the end of the previous block. Then rotates the files that are due.
+func (fd *FileDumper) endBlock(channelId string, blockNumber uint64) error {
+	lines := fd.lines
+	fd.lines = nil
+	offsets := fd.getOffsets()
+	if nextBlock, ok := offsets.NextBlocks[channelId]; ok && blockNumber < nextBlock {
+		fmt.Println(fmt.Sprintf("Block %d of channel %s is already in the files, skipping it", blockNumber, channelId))
+		return nil
+	}
+
+	dirs := []string{}
+	for dir := range lines {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		file, err := fd.openFile(dir)
+		if err == nil {
+			err = file.WriteBlock(lines[dir].Bytes())
+		}
+		if err != nil {
+			return fd.rollback(err)
+		}
+	}
+
+	newOffsets := &fileOffsets{Files: map[string]*fileOffset{}, NextBlocks: map[string]uint64{}}
+	for dir, offset := range offsets.Files {
+		newOffsets.Files[dir] = offset
+	}
+	for channel, nextBlock := range offsets.NextBlocks {
+		newOffsets.NextBlocks[channel] = nextBlock
+	}
+	for dir, file := range fd.files {
+		newOffsets.Files[filepath.Base(dir)] = &fileOffset{File: file.name, Size: file.Size()}
+	}
+	newOffsets.NextBlocks[channelId] = blockNumber + 1
+	err := fd.saveOffsets(newOffsets)
+	if err != nil {
+		return fd.rollback(err)
+	}
+	fd.offsets = newOffsets
+	for _, file := range fd.files {
+		file.Commit()
+	}
+
+	fd.blocks++
+	rotateAll := fd.RotateBlocks > 0 && fd.blocks >= fd.RotateBlocks
+	if rotateAll {
+		fd.blocks = 0
+	}
+	for dir, file := range fd.files {
+		if rotateAll || (fd.RotateSize > 0 && file.Size() >= fd.RotateSize) {
+			err := file.Close()
+			if err != nil {
+				return err
+			}
+			// The next record of the directory starts a new file
+			delete(fd.files, dir)
+		}
+	}
+	return nil
+}
+
+// Gets the open file of the directory, or creates a new one.
+func (fd *FileDumper) openFile(dir string) (*ndjsonFile, error) {
+	if fd.files == nil {
+		fd.files = make(map[string]*ndjsonFile)
+	}
+	file, ok := fd.files[dir]
+	if !ok {
+		var err error
+		file, err = createNdjsonFile(dir, fd.Gzip)
+		if err != nil {
+			return nil, err
+		}
+		fd.files[dir] = file
+	}
+	return file, nil
+}
+
+// Truncates the files back to the end of the previous block after the error of a block. If a file cannot be truncated,
+// nothing is written anymore: the files are truncated to the saved offsets when the dumper is restarted.
+func (fd *FileDumper) rollback(blockErr error) error {
+	for dir, file := range fd.files {
+		err := file.Rollback()
+		// Files created for the block are removed
+		if err == nil && file.Size() == 0 {
+			err = file.Close()
+			if err == nil {
+				err = os.Remove(filepath.Join(dir, file.name))
+			}
+			delete(fd.files, dir)
+		}
+		if err != nil {
+			fd.failed = errors.New(fmt.Sprintf("Error restoring %s after a failed block, restart the dumper: %s", file.name, err.Error()))
+			return fd.failed
+		}
+	}
+	return blockErr
+}
+
+func (fd *FileDumper) getOffsets() *fileOffsets {
+	if fd.offsets == nil {
+		fd.offsets = &fileOffsets{Files: map[string]*fileOffset{}, NextBlocks: map[string]uint64{}}
+	}
+	return fd.offsets
+}
+
+// Replaces the offsets file atomically. Nothing is saved if OffsetsPath is not set.
+func (fd *FileDumper) saveOffsets(offsets *fileOffsets) error {
+	if fd.OffsetsPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(offsets, "", "  ")
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
-	defer f.Close()
-	_, err = f.WriteString(objectJSONString)
+	// Writing to a temporary file first, then replacing the offsets file with it
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fd.OffsetsPath), filepath.Base(fd.OffsetsPath)+".tmp")
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), fd.OffsetsPath)
+}
+
+// Restores the files to the end of the last complete block: the last file of each directory is truncated to its saved size,
+// and the files created after it are removed. Without an offsets file, the files on disk are taken as complete.
+func (fd *FileDumper) recoverFiles() error {
+	data, err := ioutil.ReadFile(fd.OffsetsPath)
+	if os.IsNotExist(err) {
+		offsets := fd.getOffsets()
+		for _, dir := range fd.dirs() {
+			names, err := ndjsonFiles(dir)
+			if err != nil {
+				return err
+			}
+			if len(names) == 0 {
+				continue
+			}
+			last := names[len(names)-1]
+			info, err := os.Stat(filepath.Join(dir, last))
+			if err != nil {
+				return err
+			}
+			offsets.Files[filepath.Base(dir)] = &fileOffset{File: last, Size: info.Size()}
+		}
+		return fd.saveOffsets(offsets)
+	}
+	if err != nil {
+		return err
+	}
+
+	offsets := &fileOffsets{}
+	err = json.Unmarshal(data, offsets)
+	if err != nil {
+		return err
+	}
+	if offsets.Files == nil {
+		offsets.Files = map[string]*fileOffset{}
+	}
+	if offsets.NextBlocks == nil {
+		offsets.NextBlocks = map[string]uint64{}
+	}
+	for _, dir := range fd.dirs() {
+		file, size := "", int64(0)
+		if offset, ok := offsets.Files[filepath.Base(dir)]; ok {
+			file, size = offset.File, offset.Size
+		}
+		err = truncateNdjsonFiles(dir, file, size)
+		if err != nil {
+			return err
+		}
+	}
+	fd.offsets = offsets
 	return nil
 }
 
+// Gets the directories of the record types.
+func (fd *FileDumper) dirs() []string {
+	return []string{fd.NonEndorserTxPath, fd.EndorserTxPath, fd.WritePath, fd.ReadPath, fd.BlockPath, fd.ConfigPath, fd.ChaincodeEventPath, fd.DeadLetterPath}
+}
+
+// Creates a FileDumper that writes the files to the directories of DefaultConfig under dir, and creates the directories.
+// The files are restored to the end of the last complete block of the previous run.
+func NewFileDumper(dir string) (*FileDumper, error) {
+	fd := *DefaultConfig
+	for _, p := range []*string{&fd.NonEndorserTxPath, &fd.EndorserTxPath, &fd.WritePath, &fd.ReadPath, &fd.BlockPath, &fd.ConfigPath, &fd.ChaincodeEventPath, &fd.DeadLetterPath} {
+		*p = path.Join(dir, *p)
+		err := os.MkdirAll(*p, 0775)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fd.OffsetsPath = path.Join(dir, DefaultConfig.OffsetsPath)
+	err := fd.recoverFiles()
+	if err != nil {
+		return nil, err
+	}
+	return &fd, nil
+}
+
 // Default implementation of FileDumper
 var DefaultConfig = &FileDumper{
-	NonEndorserTxPath:   "NonEndorserTx",
-	NonEndorserTxSeqNum: 0,
-	EndorserTxPath:      "EndorserTx",
-	WritePath:           "Write",
-	WriteSeqNum:         0,
-	BlockPath:           "Block",
+	NonEndorserTxPath:  "NonEndorserTx",
+	EndorserTxPath:     "EndorserTx",
+	WritePath:          "Write",
+	ReadPath:           "Read",
+	BlockPath:          "Block",
+	ConfigPath:         "Config",
+	ChaincodeEventPath: "ChaincodeEvent",
+	DeadLetterPath:     "DeadLetter",
+	OffsetsPath:        "offsets.json",
+	RotateSize:         0,
+	RotateBlocks:       0,
+	Gzip:               false,
 }
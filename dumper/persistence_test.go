@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/transform"
+)
+
+// Reads the JSON lines of the files of a directory, in file order
+func readLines(t *testing.T, dir string) (files int, lines []map[string]interface{}) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.ndjson*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = f
+		if filepath.Ext(p) == ".gz" {
+			r, err = gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := map[string]interface{}{}
+			err = json.Unmarshal(scanner.Bytes(), &line)
+			if err != nil {
+				t.Fatalf("invalid line %q in %s: %s", scanner.Text(), p, err)
+			}
+			lines = append(lines, line)
+		}
+		if err = scanner.Err(); err != nil {
+			t.Fatalf("error reading %s: %s", p, err)
+		}
+		f.Close()
+	}
+	return len(paths), lines
+}
+
+func TestFileDumper(t *testing.T) {
+	tests := []struct {
+		name          string
+		rotateBlocks  int
+		rotateSize    int64
+		gzip          bool
+		expectedFiles int
+	}{
+		{"no rotation", 0, 0, false, 1},
+		{"rotation by block count", 2, 0, false, 3},
+		{"rotation by size", 0, 1, false, 5},
+		{"gzip", 2, 0, true, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dumper")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			fd, err := NewFileDumper(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd.RotateBlocks, fd.RotateSize, fd.Gzip = test.rotateBlocks, test.rotateSize, test.gzip
+			for i := uint64(0); i < 5; i++ {
+				err = fd.PersistWrite(&transform.Write{TxHeader: transform.TxHeader{ChannelId: "mychannel", BlockNumber: i}, Key: "CAR1"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = fd.PersistBlock(&transform.Block{ChannelId: "mychannel", BlockNumber: i})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = fd.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files, blocks := readLines(t, fd.BlockPath)
+			if files != test.expectedFiles {
+				t.Errorf("%d block files instead of %d", files, test.expectedFiles)
+			}
+			if len(blocks) != 5 {
+				t.Fatalf("%d blocks instead of 5", len(blocks))
+			}
+			for i, block := range blocks {
+				if block["blockNumber"] != float64(i) {
+					t.Errorf("block %v in line %d", block["blockNumber"], i)
+				}
+			}
+			if _, writes := readLines(t, fd.WritePath); len(writes) != 5 {
+				t.Errorf("%d writes instead of 5", len(writes))
+			}
+
+			// A new run continues with new files
+			fd, err = NewFileDumper(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd.Gzip = test.gzip
+			err = fd.PersistBlock(&transform.Block{ChannelId: "mychannel", BlockNumber: 5})
+			if err == nil {
+				err = fd.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files, blocks := readLines(t, fd.BlockPath); files != test.expectedFiles+1 || len(blocks) != 6 {
+				t.Errorf("%d files and %d blocks after the second run", files, len(blocks))
+			}
+		})
+	}
+}
+
+// Persists a write and the block record of a block
+func persistTestBlock(fd *FileDumper, blockNumber uint64) error {
+	err := fd.PersistWrite(&transform.Write{TxHeader: transform.TxHeader{ChannelId: "mychannel", BlockNumber: blockNumber}, Key: "CAR1"})
+	if err != nil {
+		return err
+	}
+	return fd.PersistBlock(&transform.Block{ChannelId: "mychannel", BlockNumber: blockNumber})
+}
+
+// Checks the block numbers of the lines of a directory
+func checkBlockNumbers(t *testing.T, name, dir string, expected []uint64) {
+	_, lines := readLines(t, dir)
+	blockNumbers := []uint64{}
+	for _, line := range lines {
+		blockNumbers = append(blockNumbers, uint64(line["blockNumber"].(float64)))
+	}
+	if fmt.Sprint(blockNumbers) != fmt.Sprint(expected) {
+		t.Errorf("%s: blocks %v in %s instead of %v", name, blockNumbers, filepath.Base(dir), expected)
+	}
+}
+
+func TestFileDumperRetry(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "dumper")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		fd, err := NewFileDumper(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every block in new files
+		fd.Gzip, fd.RotateBlocks = compress, 1
+
+		err = persistTestBlock(fd, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fd.Committed("mychannel") {
+			t.Error("block 0 is not committed")
+		}
+		// The block is retried after the checkpoint could not be saved
+		err = persistTestBlock(fd, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The write file cannot be created, the block file created for block 1 is removed
+		os.RemoveAll(fd.WritePath)
+		if err = persistTestBlock(fd, 1); err == nil {
+			t.Fatal("missing write directory is not reported")
+		}
+		if !fd.Committed("mychannel") {
+			t.Error("records of the failed block are kept")
+		}
+		// The files are complete after every block, also without closing them
+		checkBlockNumbers(t, "failed block", fd.BlockPath, []uint64{0})
+
+		os.MkdirAll(fd.WritePath, 0775)
+		err = persistTestBlock(fd, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkBlockNumbers(t, "retried block", fd.BlockPath, []uint64{0, 1})
+		checkBlockNumbers(t, "retried block", fd.WritePath, []uint64{1})
+	}
+}
+
+func TestFileDumperRestart(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "dumper")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		fd, err := NewFileDumper(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd.Gzip = compress
+		for i := uint64(0); i < 2; i++ {
+			err = persistTestBlock(fd, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Crash while writing block 2: a partial line in the block file and a new write file
+		blockFiles, _ := filepath.Glob(filepath.Join(fd.BlockPath, "*"))
+		f, err := os.OpenFile(blockFiles[0], os.O_APPEND|os.O_WRONLY, 0664)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(`{"channelId":"mychannel","blockNu`)
+		f.Close()
+		ioutil.WriteFile(filepath.Join(fd.WritePath, "000001.ndjson"), []byte(`{"channelId":"mychannel","blockNumber":2}`+"\n"), 0664)
+
+		fd, err = NewFileDumper(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd.Gzip = compress
+		checkBlockNumbers(t, "restart", fd.BlockPath, []uint64{0, 1})
+		checkBlockNumbers(t, "restart", fd.WritePath, []uint64{0, 1})
+
+		// Block 1 is already in the files (e.g. its checkpoint was not saved before the crash)
+		for i := uint64(1); i < 3; i++ {
+			err = persistTestBlock(fd, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = fd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkBlockNumbers(t, "second run", fd.BlockPath, []uint64{0, 1, 2})
+		checkBlockNumbers(t, "second run", fd.WritePath, []uint64{0, 1, 2})
+	}
+}
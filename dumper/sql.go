@@ -0,0 +1,484 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/transform"
+)
+
+// Supported database drivers of the SQL backend
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite3"
+)
+
+// Differences between the supported databases
+type sqlDialect struct {
+	// Type of the binary columns
+	blobType string
+	// Maximum number of placeholders in a statement
+	maxParams int
+	// Returns the placeholder of the nth parameter (starting from 1)
+	placeholder func(n int) string
+}
+
+var sqlDialects = map[string]*sqlDialect{
+	DriverPostgres: {
+		blobType:    "BYTEA",
+		maxParams:   65535,
+		placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	},
+	DriverSQLite: {
+		blobType:    "BLOB",
+		maxParams:   999,
+		placeholder: func(n int) string { return "?" },
+	},
+}
+
+// Schema versions of the SQL backend, applied in order. {blob} is replaced with the binary type of the database.
+// Never change a released migration, add a new one instead.
+var sqlMigrations = [][]string{
+	// 1: blocks, transactions (one row per action of the endorser transactions), reads, writes, chaincode events, config transactions
+	// and dead letters
+	{
+		`CREATE TABLE blocks (
+			channel_id TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			block_hash TEXT NOT NULL,
+			previous_hash TEXT NOT NULL,
+			data_hash TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			tx_type TEXT NOT NULL,
+			valid_tx_count INTEGER NOT NULL,
+			invalid_tx_count INTEGER NOT NULL,
+			PRIMARY KEY (channel_id, block_number)
+		)`,
+		`CREATE TABLE transactions (
+			channel_id TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			tx_index INTEGER NOT NULL,
+			action_index INTEGER NOT NULL,
+			tx_id TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			creator TEXT NOT NULL,
+			creator_org TEXT NOT NULL,
+			tx_type TEXT NOT NULL,
+			validation_code TEXT NOT NULL,
+			is_valid BOOLEAN NOT NULL,
+			chaincode_name TEXT NOT NULL,
+			chaincode_version TEXT NOT NULL,
+			function TEXT NOT NULL,
+			args TEXT NOT NULL,
+			response_status INTEGER NOT NULL,
+			response_message TEXT NOT NULL,
+			PRIMARY KEY (channel_id, block_number, tx_index, action_index),
+			FOREIGN KEY (channel_id, block_number) REFERENCES blocks (channel_id, block_number)
+		)`,
+		`CREATE INDEX transactions_tx_id ON transactions (tx_id)`,
+		`CREATE INDEX transactions_channel_id ON transactions (channel_id, chaincode_name)`,
+		`CREATE TABLE reads (
+			channel_id TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			tx_index INTEGER NOT NULL,
+			action_index INTEGER NOT NULL,
+			read_index INTEGER NOT NULL,
+			namespace TEXT NOT NULL,
+			key TEXT NOT NULL,
+			version_block_num BIGINT,
+			version_tx_num BIGINT,
+			PRIMARY KEY (channel_id, block_number, tx_index, action_index, read_index),
+			FOREIGN KEY (channel_id, block_number, tx_index, action_index) REFERENCES transactions (channel_id, block_number, tx_index, action_index)
+		)`,
+		`CREATE INDEX reads_key ON reads (key)`,
+		`CREATE INDEX reads_channel_id ON reads (channel_id, namespace)`,
+		`CREATE TABLE writes (
+			channel_id TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			tx_index INTEGER NOT NULL,
+			action_index INTEGER NOT NULL,
+			write_type TEXT NOT NULL,
+			write_index INTEGER NOT NULL,
+			namespace TEXT NOT NULL,
+			collection TEXT NOT NULL,
+			key TEXT NOT NULL,
+			key_hash TEXT NOT NULL,
+			value_hash TEXT NOT NULL,
+			value TEXT NOT NULL,
+			is_delete BOOLEAN NOT NULL,
+			linking_key TEXT NOT NULL,
+			value_decoder TEXT NOT NULL,
+			decode_error TEXT NOT NULL,
+			PRIMARY KEY (channel_id, block_number, tx_index, action_index, write_type, write_index),
+			FOREIGN KEY (channel_id, block_number, tx_index, action_index) REFERENCES transactions (channel_id, block_number, tx_index, action_index)
+		)`,
+		`CREATE INDEX writes_key ON writes (key)`,
+		`CREATE INDEX writes_linking_key ON writes (linking_key)`,
+		`CREATE INDEX writes_channel_id ON writes (channel_id, namespace)`,
+		`CREATE TABLE chaincode_events (
+			channel_id TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			tx_index INTEGER NOT NULL,
+			action_index INTEGER NOT NULL,
+			tx_id TEXT NOT NULL,
+			chaincode_name TEXT NOT NULL,
+			event_name TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			PRIMARY KEY (channel_id, block_number, tx_index, action_index),
+			FOREIGN KEY (channel_id, block_number, tx_index, action_index) REFERENCES transactions (channel_id, block_number, tx_index, action_index)
+		)`,
+		`CREATE INDEX chaincode_events_event_name ON chaincode_events (chaincode_name, event_name)`,
+		`CREATE TABLE config_txs (
+			channel_id TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			tx_index INTEGER NOT NULL,
+			config TEXT NOT NULL,
+			changes TEXT NOT NULL,
+			signers TEXT NOT NULL,
+			PRIMARY KEY (channel_id, block_number, tx_index),
+			FOREIGN KEY (channel_id, block_number) REFERENCES blocks (channel_id, block_number)
+		)`,
+		`CREATE TABLE dead_letters (
+			channel_id TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			block_hash TEXT NOT NULL,
+			error TEXT NOT NULL,
+			block {blob},
+			PRIMARY KEY (channel_id, block_number)
+		)`,
+	},
+	// 2: transaction list and metadata (signatures, last config index and commit hash) of the blocks
+	{
+		`ALTER TABLE blocks ADD COLUMN last_config_index BIGINT`,
+		`ALTER TABLE blocks ADD COLUMN commit_hash TEXT`,
+		`CREATE TABLE block_txs (
+			channel_id TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			tx_index INTEGER NOT NULL,
+			tx_id TEXT NOT NULL,
+			tx_type TEXT NOT NULL,
+			validation_code TEXT NOT NULL,
+			PRIMARY KEY (channel_id, block_number, tx_index),
+			FOREIGN KEY (channel_id, block_number) REFERENCES blocks (channel_id, block_number)
+		)`,
+		`CREATE INDEX block_txs_tx_id ON block_txs (tx_id)`,
+		`CREATE TABLE block_signatures (
+			channel_id TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			signature_index INTEGER NOT NULL,
+			msp_id TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			fingerprint TEXT NOT NULL,
+			signature TEXT NOT NULL,
+			PRIMARY KEY (channel_id, block_number, signature_index),
+			FOREIGN KEY (channel_id, block_number) REFERENCES blocks (channel_id, block_number)
+		)`,
+	},
+}
+
+// Tables of the records of a block, children first
+var sqlBlockTables = []string{"reads", "writes", "chaincode_events", "config_txs", "transactions", "block_txs", "block_signatures", "blocks", "dead_letters"}
+
+// This implementation of the Persistent interface writes the records to a relational database (PostgreSQL or SQLite) through database/sql.
+// The schema is created and upgraded by the migrations when the backend is opened. The records of a block are collected in memory and
+// inserted with batched statements in a single database transaction when the block record arrives, replacing the rows of the block if it
+// was persisted before. Values, arguments, event payloads and configs are JSON encoded.
+type SQLDumper struct {
+	db           *sql.DB
+	dialect      *sqlDialect
+	transactions [][]interface{}
+	reads        [][]interface{}
+	writes       [][]interface{}
+	events       [][]interface{}
+	configs      [][]interface{}
+}
+
+// Connects to the database with the driver (postgres or sqlite3) and the data source name, and applies the missing migrations.
+func NewSQLDumper(driver, dsn string) (*SQLDumper, error) {
+	dialect, ok := sqlDialects[driver]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unsupported database driver %q, it must be %q or %q", driver, DriverPostgres, DriverSQLite))
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == DriverSQLite {
+		// Foreign keys are enabled per connection, and an in-memory database only exists on its connection
+		db.SetMaxOpenConns(1)
+		_, err = db.Exec("PRAGMA foreign_keys = ON")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	sd := &SQLDumper{db: db, dialect: dialect}
+	err = sd.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sd, nil
+}
+
+// Applies the migrations that are newer than the version of the schema, each in its own database transaction.
+func (sd *SQLDumper) migrate() error {
+	_, err := sd.db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)")
+	if err != nil {
+		return err
+	}
+	var version int
+	err = sd.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(sqlMigrations); version++ {
+		tx, err := sd.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range sqlMigrations[version] {
+			_, err = tx.Exec(strings.Replace(statement, "{blob}", sd.dialect.blobType, -1))
+			if err != nil {
+				tx.Rollback()
+				return errors.New(fmt.Sprintf("Error applying migration %d: %s", version+1, err.Error()))
+			}
+		}
+		_, err = tx.Exec("INSERT INTO schema_migrations (version) VALUES ("+sd.dialect.placeholder(1)+")", version+1)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return nil
+}
+
+// Collects a non-endorser transaction, it is inserted with its block.
+func (sd *SQLDumper) PersistNonEndorserTx(tx *transform.Transaction) error {
+	return sd.addTransaction(tx)
+}
+
+// Collects an endorser transaction, it is inserted with its block.
+func (sd *SQLDumper) PersistEndorserTx(tx *transform.Transaction) error {
+	return sd.addTransaction(tx)
+}
+
+func (sd *SQLDumper) addTransaction(tx *transform.Transaction) error {
+	args, err := jsonString(tx.Args)
+	if err != nil {
+		return err
+	}
+	sd.transactions = append(sd.transactions, []interface{}{
+		tx.ChannelId, int64(tx.BlockNumber), tx.TxIndex, tx.ActionIndex, tx.TxId, tx.CreatedAt, tx.Creator, tx.CreatorOrg, tx.TxType,
+		tx.ValidationCode, tx.IsValid, tx.ChaincodeName, tx.ChaincodeVersion, tx.Function, args, tx.ResponseStatus, tx.ResponseMessage,
+	})
+	return nil
+}
+
+// Collects a write, it is inserted with its block.
+func (sd *SQLDumper) PersistWrite(w *transform.Write) error {
+	value, err := jsonString(w.Value)
+	if err != nil {
+		return err
+	}
+	sd.writes = append(sd.writes, []interface{}{
+		w.ChannelId, int64(w.BlockNumber), w.TxIndex, w.ActionIndex, w.WriteType, w.WriteIndex, w.Namespace, w.Collection, w.Key,
+		w.KeyHash, w.ValueHash, value, w.IsDelete, w.LinkingKey, w.ValueDecoder, w.DecodeError,
+	})
+	return nil
+}
+
+// Collects a read, it is inserted with its block.
+func (sd *SQLDumper) PersistRead(r *transform.Read) error {
+	var versionBlockNum, versionTxNum interface{}
+	if r.Version != nil {
+		versionBlockNum, versionTxNum = int64(r.Version.BlockNum), int64(r.Version.TxNum)
+	}
+	sd.reads = append(sd.reads, []interface{}{
+		r.ChannelId, int64(r.BlockNumber), r.TxIndex, r.ActionIndex, r.ReadIndex, r.Namespace, r.Key, versionBlockNum, versionTxNum,
+	})
+	return nil
+}
+
+// Collects a config transaction, it is inserted with its block.
+func (sd *SQLDumper) PersistConfig(c *transform.Config) error {
+	config, err := jsonString(c.Config)
+	if err != nil {
+		return err
+	}
+	changes, err := jsonString(c.Changes)
+	if err != nil {
+		return err
+	}
+	signers, err := jsonString(c.Signers)
+	if err != nil {
+		return err
+	}
+	sd.configs = append(sd.configs, []interface{}{c.ChannelId, int64(c.BlockNumber), c.TxIndex, config, changes, signers})
+	return nil
+}
+
+// Collects a chaincode event, it is inserted with its block.
+func (sd *SQLDumper) PersistChaincodeEvent(e *transform.Event) error {
+	payload, err := jsonString(e.Payload)
+	if err != nil {
+		return err
+	}
+	sd.events = append(sd.events, []interface{}{
+		e.ChannelId, int64(e.BlockNumber), e.TxIndex, e.ActionIndex, e.TxId, e.ChaincodeName, e.EventName, payload,
+	})
+	return nil
+}
+
+// Inserts the block with the records collected since the previous block in a single database transaction.
+func (sd *SQLDumper) PersistBlock(b *transform.Block) error {
+	// The collected records are dropped even if the insert fails, the block is processed again from the start
+	defer sd.reset()
+
+	tx, err := sd.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = sd.insertBlock(tx, b)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (sd *SQLDumper) insertBlock(tx *sql.Tx, b *transform.Block) error {
+	err := sd.deleteBlock(tx, b.ChannelId, b.BlockNumber)
+	if err != nil {
+		return err
+	}
+	var commitHash interface{}
+	if b.CommitHash != "" {
+		commitHash = b.CommitHash
+	}
+	err = sd.insert(tx, "blocks", []string{"channel_id", "block_number", "block_hash", "previous_hash", "data_hash", "created_at", "tx_type", "valid_tx_count", "invalid_tx_count",
+		"last_config_index", "commit_hash"},
+		[][]interface{}{{b.ChannelId, int64(b.BlockNumber), b.BlockHash, b.PreviousHash, b.DataHash, b.CreatedAt, b.TxType, b.ValidTxCount, b.InvalidTxCount,
+			int64(b.LastConfigIndex), commitHash}})
+	if err != nil {
+		return err
+	}
+	blockTxs := [][]interface{}{}
+	for _, blockTx := range b.Txs {
+		blockTxs = append(blockTxs, []interface{}{b.ChannelId, int64(b.BlockNumber), blockTx.TxIndex, blockTx.TxId, blockTx.TxType, blockTx.ValidationCode})
+	}
+	err = sd.insert(tx, "block_txs", []string{"channel_id", "block_number", "tx_index", "tx_id", "tx_type", "validation_code"}, blockTxs)
+	if err != nil {
+		return err
+	}
+	signatures := [][]interface{}{}
+	for i, signature := range b.Signatures {
+		signatures = append(signatures, []interface{}{b.ChannelId, int64(b.BlockNumber), i, signature.MSPID, signature.Subject, signature.Fingerprint, signature.Signature})
+	}
+	err = sd.insert(tx, "block_signatures", []string{"channel_id", "block_number", "signature_index", "msp_id", "subject", "fingerprint", "signature"}, signatures)
+	if err != nil {
+		return err
+	}
+	err = sd.insert(tx, "transactions", []string{"channel_id", "block_number", "tx_index", "action_index", "tx_id", "created_at", "creator", "creator_org", "tx_type",
+		"validation_code", "is_valid", "chaincode_name", "chaincode_version", "function", "args", "response_status", "response_message"}, sd.transactions)
+	if err != nil {
+		return err
+	}
+	err = sd.insert(tx, "reads", []string{"channel_id", "block_number", "tx_index", "action_index", "read_index", "namespace", "key", "version_block_num", "version_tx_num"}, sd.reads)
+	if err != nil {
+		return err
+	}
+	err = sd.insert(tx, "writes", []string{"channel_id", "block_number", "tx_index", "action_index", "write_type", "write_index", "namespace", "collection", "key",
+		"key_hash", "value_hash", "value", "is_delete", "linking_key", "value_decoder", "decode_error"}, sd.writes)
+	if err != nil {
+		return err
+	}
+	err = sd.insert(tx, "chaincode_events", []string{"channel_id", "block_number", "tx_index", "action_index", "tx_id", "chaincode_name", "event_name", "payload"}, sd.events)
+	if err != nil {
+		return err
+	}
+	return sd.insert(tx, "config_txs", []string{"channel_id", "block_number", "tx_index", "config", "changes", "signers"}, sd.configs)
+}
+
+// Inserts a block that cannot be decoded into the dead_letters table.
+func (sd *SQLDumper) PersistDeadLetter(d *DeadLetter) error {
+	defer sd.reset()
+
+	tx, err := sd.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = sd.deleteBlock(tx, d.ChannelId, d.BlockNumber)
+	if err == nil {
+		err = sd.insert(tx, "dead_letters", []string{"channel_id", "block_number", "block_hash", "error", "block"},
+			[][]interface{}{{d.ChannelId, int64(d.BlockNumber), d.BlockHash, d.Error, d.Block}})
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Closes the database.
+func (sd *SQLDumper) Close() error {
+	return sd.db.Close()
+}
+
+// Drops the records collected for the current block.
+func (sd *SQLDumper) reset() {
+	sd.transactions, sd.reads, sd.writes, sd.events, sd.configs = nil, nil, nil, nil, nil
+}
+
+// Deletes the rows of a block persisted before (e.g. before a crash, without saving the checkpoint), children first.
+func (sd *SQLDumper) deleteBlock(tx *sql.Tx, channelId string, blockNumber uint64) error {
+	for _, table := range sqlBlockTables {
+		_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE channel_id = %s AND block_number = %s", table, sd.dialect.placeholder(1), sd.dialect.placeholder(2)), channelId, int64(blockNumber))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Inserts the rows with multi-row INSERT statements, as many rows per statement as the number of placeholders of the database allows.
+func (sd *SQLDumper) insert(tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	batchSize := sd.dialect.maxParams / len(columns)
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var statement strings.Builder
+		statement.WriteString(fmt.Sprintf("INSERT INTO %s (%s) VALUES ", table, strings.Join(columns, ", ")))
+		params := make([]interface{}, 0, (end-start)*len(columns))
+		for i, row := range rows[start:end] {
+			if i > 0 {
+				statement.WriteString(", ")
+			}
+			placeholders := make([]string, len(row))
+			for j := range row {
+				placeholders[j] = sd.dialect.placeholder(len(params) + j + 1)
+			}
+			statement.WriteString("(" + strings.Join(placeholders, ", ") + ")")
+			params = append(params, row...)
+		}
+
+		_, err := tx.Exec(statement.String(), params...)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error inserting into %s: %s", table, err.Error()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analyzer/agent/agentmodules/fabricutils"
+	"github.com/blockchain-analyzer/agent/agentmodules/transform"
+)
+
+// Persists the records of a block with a fabcar transaction
+func persistSQLTestBlock(t *testing.T, sd *SQLDumper, blockNumber uint64) {
+	header := transform.TxHeader{ChannelId: "mychannel", BlockNumber: blockNumber, TxId: "tx1", CreatedAt: time.Now(), TxType: transform.EndorserTransaction, IsValid: true}
+	records := []error{
+		sd.PersistEndorserTx(&transform.Transaction{TxHeader: header, ChaincodeName: "fabcar", Function: "createCar", Args: []string{"CAR1"}}),
+		sd.PersistWrite(&transform.Write{TxHeader: header, WriteType: transform.WriteTypeValue, Namespace: "fabcar", Key: "CAR1", LinkingKey: "Tom", Value: map[string]interface{}{"owner": "Tom"}}),
+		sd.PersistRead(&transform.Read{TxHeader: header, Namespace: "fabcar", Key: "CAR1"}),
+		sd.PersistRead(&transform.Read{TxHeader: header, ReadIndex: 1, Namespace: "fabcar", Key: "CAR2", Version: &fabricutils.Version{BlockNum: 1}}),
+		sd.PersistChaincodeEvent(&transform.Event{TxHeader: header, ChaincodeName: "fabcar", EventName: "carCreated", Payload: map[string]interface{}{"car": "CAR1"}}),
+		sd.PersistBlock(&transform.Block{
+			ChannelId:       "mychannel",
+			BlockNumber:     blockNumber,
+			CreatedAt:       header.CreatedAt,
+			TxType:          transform.EndorserTransaction,
+			ValidTxCount:    1,
+			Txs:             []*transform.BlockTx{{TxId: "tx1", TxType: transform.EndorserTransaction, ValidationCode: "VALID"}},
+			Signatures:      []*transform.BlockSignature{{Endorser: fabricutils.Endorser{MSPID: "OrdererMSP"}, Signature: "0102"}},
+			LastConfigIndex: 0,
+			CommitHash:      "abcd",
+		}),
+	}
+	for _, err := range records {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func countRows(t *testing.T, sd *SQLDumper, table string) int {
+	var count int
+	err := sd.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestSQLDumper(t *testing.T) {
+	sd, err := NewSQLDumper(DriverSQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+
+	persistSQLTestBlock(t, sd, 0)
+	persistSQLTestBlock(t, sd, 1)
+	// A block dumped again replaces its rows
+	persistSQLTestBlock(t, sd, 1)
+	err = sd.PersistDeadLetter(&DeadLetter{ChannelId: "mychannel", BlockNumber: 2, Error: "cannot be decoded", Block: []byte{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedRows := map[string]int{"blocks": 2, "transactions": 2, "writes": 2, "reads": 4, "chaincode_events": 2, "config_txs": 0, "dead_letters": 1, "block_txs": 2, "block_signatures": 2}
+	for table, expected := range expectedRows {
+		if count := countRows(t, sd, table); count != expected {
+			t.Errorf("%d rows in %s instead of %d", count, table, expected)
+		}
+	}
+	var value, linkingKey string
+	err = sd.db.QueryRow("SELECT value, linking_key FROM writes WHERE block_number = 1").Scan(&value, &linkingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != `{"owner":"Tom"}` || linkingKey != "Tom" {
+		t.Errorf("unexpected write %s with linking key %s", value, linkingKey)
+	}
+	var eventName, payload string
+	err = sd.db.QueryRow("SELECT event_name, payload FROM chaincode_events WHERE block_number = 1").Scan(&eventName, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eventName != "carCreated" || payload != `{"car":"CAR1"}` {
+		t.Errorf("unexpected event %s with payload %s", eventName, payload)
+	}
+	var commitHash, txId string
+	err = sd.db.QueryRow("SELECT commit_hash, tx_id FROM blocks JOIN block_txs USING (channel_id, block_number) WHERE block_number = 1").Scan(&commitHash, &txId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commitHash != "abcd" || txId != "tx1" {
+		t.Errorf("unexpected commit hash %s or transaction %s of block 1", commitHash, txId)
+	}
+
+	// A write without its transaction violates the foreign key, the whole block is rolled back
+	sd.PersistWrite(&transform.Write{TxHeader: transform.TxHeader{ChannelId: "mychannel", BlockNumber: 3, TxIndex: 5}, Key: "CAR1"})
+	err = sd.PersistBlock(&transform.Block{ChannelId: "mychannel", BlockNumber: 3})
+	if err == nil {
+		t.Error("no error for a write without its transaction")
+	}
+	if count := countRows(t, sd, "blocks"); count != 2 {
+		t.Errorf("%d blocks after the rollback instead of 2", count)
+	}
+
+	// The migrations are only applied once
+	err = sd.migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := countRows(t, sd, "schema_migrations"); count != len(sqlMigrations) {
+		t.Errorf("%d applied migrations instead of %d", count, len(sqlMigrations))
+	}
+}
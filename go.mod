@@ -9,10 +9,14 @@ require (
 	github.com/golang/protobuf v1.3.2 // indirect
 	github.com/google/certificate-transparency-go v1.0.21 // indirect
 	github.com/hyperledger/fabric-sdk-go v1.0.0-beta
+	github.com/jhump/protoreflect v1.5.0
+	github.com/lib/pq v1.2.0
+	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/mitchellh/mapstructure v1.1.2 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/spf13/cast v1.3.0 // indirect
 	github.com/stretchr/testify v1.4.0 // indirect
+	github.com/xitongsys/parquet-go v1.5.1
 	github.com/zmap/zlint v1.0.0 // indirect
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
@@ -21,4 +25,5 @@ require (
 	golang.org/x/net v0.0.0-20190813141303-74dc4d7220e7 // indirect
 	golang.org/x/sys v0.0.0-20190813064441-fde4db37ae7a // indirect
 	google.golang.org/grpc v1.23.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )